@@ -0,0 +1,180 @@
+// Command nmap_sd runs network service discovery as a standalone service
+// or as a one-shot scan printing Prometheus HTTP SD targets.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+const usage = `Usage:
+  nmap_sd [serve] [flags]   run the discovery service
+  nmap_sd scan-once [flags] scan once and print the targets as JSON
+
+Run "nmap_sd <command> -h" for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatches the subcommand and returns the process exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args, stderr)
+	case "scan-once":
+		err = scanOnce(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", cmd, usage)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "nmap_sd %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// serve runs the discovery service until SIGINT or SIGTERM
+func serve(args []string, stderr io.Writer) error {
+	opts, err := parseOptions("serve", args, stderr)
+	if err != nil {
+		return err
+	}
+	cfg, file, watcher, err := opts.load()
+	if err != nil {
+		return err
+	}
+	if file.Listen == "" && cfg.FileSD.Path == "" && !cfg.Consul.Enabled() && !cfg.Kubernetes.Enabled() && cfg.DNS.Addr == "" {
+		return fmt.Errorf("no output configured, set -listen, -file-sd, -consul, -kubernetes-namespace or -dns")
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel(cfg.LogLevel)})))
+	// The instance filters its records by LogLevel itself, so reloaded levels take effect
+	cfg.LogHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if watcher != nil {
+		// Changes of the listen address need a restart, everything else is applied live
+		go watcher.Run(ctx)
+	}
+
+	nsd, err := middleware.NewNmapSD(cfg)
+	if err != nil {
+		return err
+	}
+	defer nsd.Stop()
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(nsd.Handler())
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	if file.Listen == "" {
+		slog.Info("HTTP endpoint disabled", "file_sd", cfg.FileSD.Path, "consul", cfg.Consul.Address, "kubernetes", cfg.Kubernetes.Namespace, "dns", cfg.DNS.Addr)
+		<-ctx.Done()
+		return nil
+	}
+
+	srv := &http.Server{Addr: file.Listen, Handler: r}
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Starting server", "listen", file.Listen)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// scanOnce runs a single scan and prints the targets as JSON to stdout
+func scanOnce(args []string, stdout, stderr io.Writer) error {
+	opts, err := parseOptions("scan-once", args, stderr)
+	if err != nil {
+		return err
+	}
+	cfg, _, _, err := opts.load()
+	if err != nil {
+		return err
+	}
+
+	// Logs go to stderr so stdout only holds the targets
+	slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: logLevel(cfg.LogLevel)})))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	targets, err := middleware.ScanOnce(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.FileSD.Path != "" {
+		w, err := filesd.NewWriter(cfg.FileSD)
+		if err != nil {
+			return err
+		}
+		if err := w.Write(targets); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(targets)
+}
+
+// logLevel maps a configured log level name to a slog level
+func logLevel(level string) slog.Level {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "ERROR":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("9182:windows_exporter, 80:http_services:http,")
+	if err != nil {
+		t.Fatalf("parsePorts failed: %v", err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Expected 2 ports, got %d", len(ports))
+	}
+	if ports[0].Port != 9182 || ports[0].Job != "windows_exporter" || ports[0].Name != "" {
+		t.Errorf("Unexpected first port: %+v", ports[0])
+	}
+	if ports[1].Port != 80 || ports[1].Job != "http_services" || ports[1].Name != "http" {
+		t.Errorf("Unexpected second port: %+v", ports[1])
+	}
+
+	for _, invalid := range []string{"80", "80:", "http:web", "0:web", "70000:web"} {
+		if _, err := parsePorts(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestLoadFlagsOverrideConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nmap_sd.yaml")
+	data := `
+targets: [10.0.0.0/24]
+scan_interval: 5
+listen: ":9000"
+file_sd:
+  path: /tmp/a.json
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseOptions("serve", []string{"-config", path, "-targets", "10.1.0.0/24,10.2.0.0/24", "-file-sd-split"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	cfg, file, watcher, err := opts.load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if watcher == nil || cfg.Updates == nil {
+		t.Error("Expected the configuration file to be watched")
+	}
+	if len(cfg.Targets) != 2 || cfg.Targets[0] != "10.1.0.0/24" {
+		t.Errorf("Expected -targets to override the config file, got %v", cfg.Targets)
+	}
+	if cfg.ScanInterval != 5 {
+		t.Errorf("Expected scan interval from the config file, got %d", cfg.ScanInterval)
+	}
+	if file.Listen != ":9000" {
+		t.Errorf("Expected listen address from the config file, got %q", file.Listen)
+	}
+	if cfg.FileSD.Path != "/tmp/a.json" || !cfg.FileSD.SplitByJob {
+		t.Errorf("Expected file_sd to merge file and flags, got %+v", cfg.FileSD)
+	}
+	if cfg.MetricsPath != defaultMetricsPath {
+		t.Errorf("Expected default metrics path without metrics_path, got %q", cfg.MetricsPath)
+	}
+}
+
+func TestLoadConfigFileDisablesMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nmap_sd.yaml")
+	data := `
+targets: [10.0.0.0/24]
+metrics_path: ""
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseOptions("serve", []string{"-config", path}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	cfg, _, _, err := opts.load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if cfg.MetricsPath != "" {
+		t.Errorf("Expected metrics_path: \"\" to disable the metrics, got %q", cfg.MetricsPath)
+	}
+}
+
+func TestLoadFlagsOnly(t *testing.T) {
+	opts, err := parseOptions("serve", []string{"-targets", "10.0.0.1", "-listen=", "-timeout", "2m"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	cfg, file, watcher, err := opts.load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if watcher != nil {
+		t.Error("Expected no watcher without a configuration file")
+	}
+	if file.Listen != "" {
+		t.Errorf("Expected -listen= to disable the HTTP endpoint, got %q", file.Listen)
+	}
+	if cfg.ScanTimeout != 2*time.Minute {
+		t.Errorf("Expected scan timeout 2m, got %v", cfg.ScanTimeout)
+	}
+	if cfg.MetricsPath != defaultMetricsPath {
+		t.Errorf("Expected default metrics path, got %q", cfg.MetricsPath)
+	}
+
+	opts, err = parseOptions("serve", nil, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if _, _, _, err := opts.load(); err == nil {
+		t.Error("Expected missing targets to be rejected")
+	}
+}
+
+func TestScanOnce(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{
+		"scan-once",
+		"-targets", "192.168.2.0/24",
+		"-ports", "9182:windows_exporter",
+		"-replay", filepath.Join("..", "..", "pkg", "sd", "testdata", "nmap", "office.xml"),
+	}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	var targets []sd.ServiceTarget
+	if err := json.Unmarshal(stdout.Bytes(), &targets); err != nil {
+		t.Fatalf("Expected JSON on stdout: %v\n%s", err, stdout.String())
+	}
+	if len(targets) == 0 {
+		t.Fatal("Expected targets from the replayed scan")
+	}
+	for _, st := range targets {
+		if st.Labels["job"] != "windows_exporter" {
+			t.Errorf("Unexpected job label: %v", st.Labels)
+		}
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"bogus"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2, got %d", code)
+	}
+}
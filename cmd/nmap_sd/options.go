@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/config"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/middleware"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// defaultListen is the HTTP listen address used when neither a flag nor the file sets one
+const defaultListen = ":8080"
+
+// defaultMetricsPath is the metrics path used when neither a flag nor the file sets one
+const defaultMetricsPath = "/metrics"
+
+// options holds the parsed command line of a command
+type options struct {
+	configPath string
+	replay     string
+	// override applies the command line flags on top of a loaded configuration file
+	override func(*config.File) error
+}
+
+// parseOptions parses the command line flags of a command
+func parseOptions(name string, args []string, stderr io.Writer) (options, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configPath := fs.String("config", "", "path to a YAML, TOML or JSON configuration file, reloaded when it changes")
+	targets := fs.String("targets", "", "comma separated CIDRs, ranges, hosts or hostnames to scan")
+	excludes := fs.String("exclude", "", "comma separated targets that must never be probed")
+	ports := fs.String("ports", "", "comma separated port:job[:name] list (default: common ports)")
+	interval := fs.Int("interval", 0, "scan interval in minutes (default: 1)")
+	timeout := fs.Duration("timeout", 0, "maximum duration of a single scan (default: 10m)")
+	dualStack := fs.Bool("dual-stack", false, "scan hostnames over both IPv4 and IPv6")
+	listen := fs.String("listen", defaultListen, `HTTP listen address, "" disables the HTTP endpoint`)
+	scanPath := fs.String("scan-path", "", "HTTP path of the discovery endpoint (default: /mgsd)")
+	fileSDPath := fs.String("file-sd", "", "write Prometheus file_sd output to this file, or directory with -file-sd-split")
+	fileSDFormat := fs.String("file-sd-format", "", "file_sd format: json or yaml (default: from extension)")
+	fileSDSplit := fs.Bool("file-sd-split", false, "write one file_sd file per job")
+	metricsPath := fs.String("metrics-path", defaultMetricsPath, `HTTP path of the nmap_sd metrics, "" disables them`)
+	stateFile := fs.String("state-file", "", "save the last results to this file and serve them after a restart")
+	historyPath := fs.String("history", "", "archive every completed scan in this database file")
+	historyMaxScans := fs.Int("history-max-scans", 0, "maximum number of archived scans (default: unlimited)")
+	historyMaxAge := fs.Duration("history-max-age", 0, "maximum age of archived scans (default: unlimited)")
+	consulAddress := fs.String("consul", "", "register the discovered targets on the Consul agent at this address, e.g. http://127.0.0.1:8500")
+	kubeNamespace := fs.String("kubernetes-namespace", "", "mirror every job into this Kubernetes namespace as a Service with EndpointSlices")
+	kubeconfig := fs.String("kubeconfig", "", "kubeconfig file of the Kubernetes cluster (default: in-cluster configuration)")
+	dnsAddr := fs.String("dns", "", "serve SRV and A/AAAA records of the results on this UDP and TCP address, e.g. :5353")
+	dnsZone := fs.String("dns-zone", "", "DNS zone of the served records (default: nmap.local.)")
+	logLevel := fs.String("log-level", "", "log level: INFO, ERROR or DEBUG (default: INFO)")
+	replay := fs.String("replay", "", "replay saved nmap XML files from this file or directory instead of running nmap")
+
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	if fs.NArg() > 0 {
+		return options{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	portList, err := parsePorts(*ports)
+	if err != nil {
+		return options{}, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	override := func(f *config.File) error {
+		if set["targets"] {
+			f.Targets = splitList(*targets)
+		}
+		if set["exclude"] {
+			f.Excludes = splitList(*excludes)
+		}
+		if set["ports"] {
+			f.Ports = portList
+		}
+		if set["interval"] {
+			f.ScanInterval = *interval
+		}
+		if set["timeout"] {
+			f.ScanTimeout = timeout.String()
+		}
+		if set["dual-stack"] {
+			f.DualStack = *dualStack
+		}
+		if set["listen"] {
+			f.Listen = *listen
+		} else if f.Listen == "" {
+			f.Listen = defaultListen
+		}
+		if set["scan-path"] {
+			f.ScanPath = *scanPath
+		}
+		if set["metrics-path"] {
+			f.MetricsPath = metricsPath
+		} else if f.MetricsPath == nil {
+			path := defaultMetricsPath
+			f.MetricsPath = &path
+		}
+		if set["file-sd"] || set["file-sd-format"] || set["file-sd-split"] {
+			if f.FileSD == nil {
+				f.FileSD = &config.FileSD{}
+			}
+			if set["file-sd"] {
+				f.FileSD.Path = *fileSDPath
+			}
+			if set["file-sd-format"] {
+				f.FileSD.Format = *fileSDFormat
+			}
+			if set["file-sd-split"] {
+				f.FileSD.SplitByJob = *fileSDSplit
+			}
+		}
+		if set["state-file"] {
+			f.StateFile = *stateFile
+		}
+		if set["history"] || set["history-max-scans"] || set["history-max-age"] {
+			if f.History == nil {
+				f.History = &config.History{}
+			}
+			if set["history"] {
+				f.History.Path = *historyPath
+			}
+			if set["history-max-scans"] {
+				f.History.MaxScans = *historyMaxScans
+			}
+			if set["history-max-age"] {
+				f.History.MaxAge = historyMaxAge.String()
+			}
+		}
+		if set["consul"] {
+			if f.Consul == nil {
+				f.Consul = &config.Consul{}
+			}
+			f.Consul.Address = *consulAddress
+		}
+		if set["kubernetes-namespace"] || set["kubeconfig"] {
+			if f.Kubernetes == nil {
+				f.Kubernetes = &config.Kubernetes{}
+			}
+			if set["kubernetes-namespace"] {
+				f.Kubernetes.Namespace = *kubeNamespace
+			}
+			if set["kubeconfig"] {
+				f.Kubernetes.Kubeconfig = *kubeconfig
+			}
+		}
+		if set["dns"] || set["dns-zone"] {
+			if f.DNS == nil {
+				f.DNS = &config.DNS{}
+			}
+			if set["dns"] {
+				f.DNS.Addr = *dnsAddr
+			}
+			if set["dns-zone"] {
+				f.DNS.Zone = *dnsZone
+			}
+		}
+		if set["log-level"] {
+			f.LogLevel = *logLevel
+		}
+		return nil
+	}
+
+	return options{configPath: *configPath, replay: *replay, override: override}, nil
+}
+
+// load builds the validated middleware configuration from the configuration file and flags.
+// With a configuration file, the returned watcher reports its changes.
+func (o options) load() (middleware.Config, *config.File, *config.Watcher, error) {
+	var cfg middleware.Config
+	var file *config.File
+	var watcher *config.Watcher
+
+	if o.configPath != "" {
+		watcher = &config.Watcher{Path: o.configPath, Override: o.override}
+		var err error
+		if cfg, err = watcher.Load(); err != nil {
+			return cfg, nil, nil, err
+		}
+		file = watcher.File()
+	} else {
+		file = &config.File{}
+		if err := o.override(file); err != nil {
+			return cfg, nil, nil, err
+		}
+		var err error
+		if cfg, err = file.MiddlewareConfig(); err != nil {
+			return cfg, nil, nil, err
+		}
+		if err := cfg.Validate(); err != nil {
+			return cfg, nil, nil, err
+		}
+	}
+
+	if o.replay != "" {
+		cfg.Scanner = sd.NewReplayScanner(o.replay)
+	}
+	return cfg, file, watcher, nil
+}
+
+// parsePorts parses a comma separated "port:job[:name]" list
+func parsePorts(s string) ([]config.Port, error) {
+	var ports []config.Port
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid port %q, expected port:job[:name]", entry)
+		}
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port number in %q", entry)
+		}
+		p := config.Port{Port: uint16(port), Job: parts[1]}
+		if len(parts) == 3 {
+			p.Name = parts[2]
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// splitList splits a comma separated list and drops empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -16,15 +16,22 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	// Create Gin router
-	r := gin.Default()
-
-	// Register NmapSD middleware
-	r.Use(middleware.New(middleware.Config{
+	// Create NmapSD instance
+	nsd, err := middleware.NewNmapSD(middleware.Config{
 		CIDR:         "192.168.2.0/22", // Scan this CIDR range
 		ScanPath:     "/mgsd",          // Expose results at this path
 		ScanInterval: 1,                // Scan every 1 minute
-	}))
+		Logger:       logger,           // Log to the application logger
+	})
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	defer nsd.Stop()
+
+	// Create Gin router and mount the NmapSD endpoints below /mgsd
+	r := gin.Default()
+	nsd.RegisterRoutes(r)
 
 	// Add other routes as needed
 	r.GET("/", func(c *gin.Context) {
@@ -33,6 +40,7 @@ func main() {
 			"version": "v2.0",
 			"endpoints": gin.H{
 				"discovery": "/mgsd",
+				"info":      "/mgsd/info",
 				"health":    "/health",
 			},
 		})
@@ -0,0 +1,331 @@
+// Package config loads the nmap_sd configuration from YAML, TOML or JSON files
+// and watches them for changes.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/consul"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/dnssd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/kube"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/middleware"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/webhook"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Format is the encoding of a configuration file
+type Format string
+
+const (
+	// YAML configuration file (.yaml, .yml)
+	YAML Format = "yaml"
+	// TOML configuration file (.toml)
+	TOML Format = "toml"
+	// JSON configuration file (.json)
+	JSON Format = "json"
+)
+
+// File is the content of a configuration file
+type File struct {
+	// HTTP listen address of the nmap_sd command
+	Listen string `json:"listen" toml:"listen"`
+	// API path to expose scan results
+	ScanPath string `json:"scan_path" toml:"scan_path"`
+	// CIDR to scan, scanned together with Targets
+	CIDR string `json:"cidr" toml:"cidr"`
+	// Targets to scan: CIDRs, nmap ranges, single hosts or hostnames
+	Targets []string `json:"targets" toml:"targets"`
+	// Targets that must never be probed
+	Excludes []string `json:"excludes" toml:"excludes"`
+	// Ports to scan
+	Ports []Port `json:"ports" toml:"ports"`
+	// Scan interval in minutes
+	ScanInterval int `json:"scan_interval" toml:"scan_interval"`
+	// Maximum duration of a single scan, e.g. "5m"
+	ScanTimeout string `json:"scan_timeout" toml:"scan_timeout"`
+	// Scan hostname targets over both IPv4 and IPv6
+	DualStack bool `json:"dual_stack" toml:"dual_stack"`
+	// Log level: "INFO", "ERROR", "DEBUG"
+	LogLevel string `json:"log_level" toml:"log_level"`
+	// Named scan profiles
+	Profiles []Profile `json:"profiles" toml:"profiles"`
+	// Prometheus style relabel rules
+	RelabelConfigs []relabel.Config `json:"relabel_configs" toml:"relabel_configs"`
+	// Prometheus file_sd output
+	FileSD *FileSD `json:"file_sd" toml:"file_sd"`
+	// Outgoing webhooks notified about added and removed targets
+	Webhooks []Webhook `json:"webhooks" toml:"webhooks"`
+	// Consul agent the discovered targets are registered on
+	Consul *Consul `json:"consul" toml:"consul"`
+	// Kubernetes namespace the jobs are mirrored into as Services with EndpointSlices
+	Kubernetes *Kubernetes `json:"kubernetes" toml:"kubernetes"`
+	// Embedded DNS server for SRV and A/AAAA lookups of the results
+	DNS *DNS `json:"dns" toml:"dns"`
+	// File the last results are saved to and restored from after a restart
+	StateFile string `json:"state_file" toml:"state_file"`
+	// Archive of completed scans
+	History *History `json:"history" toml:"history"`
+	// HTTP path of the self-instrumentation metrics, nil if the key is missing.
+	// An empty path disables the metrics.
+	MetricsPath *string `json:"metrics_path" toml:"metrics_path"`
+}
+
+// Port is a port to scan and the job its targets belong to
+type Port struct {
+	Port uint16 `json:"port" toml:"port"`
+	// Service name (default: Job)
+	Name   string            `json:"name" toml:"name"`
+	Job    string            `json:"job" toml:"job"`
+	Labels map[string]string `json:"labels" toml:"labels"`
+}
+
+// Profile is a named scan profile
+type Profile struct {
+	Name         string            `json:"name" toml:"name"`
+	Targets      []string          `json:"targets" toml:"targets"`
+	Excludes     []string          `json:"excludes" toml:"excludes"`
+	Ports        []Port            `json:"ports" toml:"ports"`
+	ScanInterval int               `json:"scan_interval" toml:"scan_interval"`
+	Labels       map[string]string `json:"labels" toml:"labels"`
+}
+
+// FileSD is the Prometheus file_sd output section
+type FileSD struct {
+	Path       string `json:"path" toml:"path"`
+	Format     string `json:"format" toml:"format"`
+	SplitByJob bool   `json:"split_by_job" toml:"split_by_job"`
+}
+
+// History is the scan archive section, MaxAge is a duration string such as "720h"
+type History struct {
+	Path     string `json:"path" toml:"path"`
+	MaxScans int    `json:"max_scans" toml:"max_scans"`
+	MaxAge   string `json:"max_age" toml:"max_age"`
+}
+
+// Consul is the Consul service registration section, durations are strings such as "30s"
+type Consul struct {
+	Address       string `json:"address" toml:"address"`
+	Token         string `json:"token" toml:"token"`
+	IDPrefix      string `json:"id_prefix" toml:"id_prefix"`
+	Timeout       string `json:"timeout" toml:"timeout"`
+	RetryInterval string `json:"retry_interval" toml:"retry_interval"`
+}
+
+// Kubernetes is the Kubernetes Service export section, durations are strings such as "30s"
+type Kubernetes struct {
+	Namespace     string `json:"namespace" toml:"namespace"`
+	Kubeconfig    string `json:"kubeconfig" toml:"kubeconfig"`
+	NamePrefix    string `json:"name_prefix" toml:"name_prefix"`
+	Timeout       string `json:"timeout" toml:"timeout"`
+	RetryInterval string `json:"retry_interval" toml:"retry_interval"`
+}
+
+// DNS is the embedded DNS server section, TTL is a duration string such as "30s"
+type DNS struct {
+	Addr string `json:"addr" toml:"addr"`
+	Zone string `json:"zone" toml:"zone"`
+	TTL  string `json:"ttl" toml:"ttl"`
+}
+
+// Webhook is an outgoing webhook, durations are strings such as "30s"
+type Webhook struct {
+	URL            string            `json:"url" toml:"url"`
+	Secret         string            `json:"secret" toml:"secret"`
+	MaxRetries     int               `json:"max_retries" toml:"max_retries"`
+	InitialBackoff string            `json:"initial_backoff" toml:"initial_backoff"`
+	MaxBackoff     string            `json:"max_backoff" toml:"max_backoff"`
+	Timeout        string            `json:"timeout" toml:"timeout"`
+	Headers        map[string]string `json:"headers" toml:"headers"`
+}
+
+// FormatFromPath returns the format of a configuration file from its extension
+func FormatFromPath(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML, nil
+	case ".toml":
+		return TOML, nil
+	case ".json":
+		return JSON, nil
+	default:
+		return "", fmt.Errorf("unknown configuration file extension %q, expected .yaml, .yml, .toml or .json", filepath.Ext(path))
+	}
+}
+
+// Load reads a configuration file, the format is taken from the file extension
+func Load(path string) (*File, error) {
+	format, err := FormatFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse decodes a configuration file. Unknown fields are rejected.
+func Parse(data []byte, format Format) (*File, error) {
+	f := &File{}
+	var err error
+	switch format {
+	case YAML:
+		err = yaml.UnmarshalWithOptions(data, f, yaml.DisallowUnknownField())
+	case TOML:
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(f)
+	case JSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(f)
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// MiddlewareConfig converts the file into a middleware configuration.
+// Unset fields are left empty so the middleware applies its defaults.
+func (f *File) MiddlewareConfig() (middleware.Config, error) {
+	cfg := middleware.Config{
+		CIDR:           f.CIDR,
+		Targets:        f.Targets,
+		Excludes:       f.Excludes,
+		ScanPath:       f.ScanPath,
+		ScanInterval:   f.ScanInterval,
+		LogLevel:       f.LogLevel,
+		DualStack:      f.DualStack,
+		RelabelConfigs: f.RelabelConfigs,
+		StateFile:      f.StateFile,
+	}
+	if f.MetricsPath != nil {
+		cfg.MetricsPath = *f.MetricsPath
+	}
+
+	var err error
+	if cfg.Ports, err = portServices(f.Ports); err != nil {
+		return cfg, err
+	}
+	for _, p := range f.Profiles {
+		ports, err := portServices(p.Ports)
+		if err != nil {
+			return cfg, fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+		cfg.Profiles = append(cfg.Profiles, middleware.ScanProfile{
+			Name:         p.Name,
+			Targets:      p.Targets,
+			Excludes:     p.Excludes,
+			Ports:        ports,
+			ScanInterval: p.ScanInterval,
+			Labels:       p.Labels,
+		})
+	}
+
+	if cfg.ScanTimeout, err = parseDuration("scan_timeout", f.ScanTimeout); err != nil {
+		return cfg, err
+	}
+	for i, w := range f.Webhooks {
+		wc := webhook.Config{URL: w.URL, Secret: w.Secret, MaxRetries: w.MaxRetries, Headers: w.Headers}
+		if wc.InitialBackoff, err = parseDuration("initial_backoff", w.InitialBackoff); err != nil {
+			return cfg, fmt.Errorf("webhook %d: %w", i, err)
+		}
+		if wc.MaxBackoff, err = parseDuration("max_backoff", w.MaxBackoff); err != nil {
+			return cfg, fmt.Errorf("webhook %d: %w", i, err)
+		}
+		if wc.Timeout, err = parseDuration("timeout", w.Timeout); err != nil {
+			return cfg, fmt.Errorf("webhook %d: %w", i, err)
+		}
+		cfg.Webhooks = append(cfg.Webhooks, wc)
+	}
+	if f.Consul != nil {
+		cfg.Consul = consul.Config{Address: f.Consul.Address, Token: f.Consul.Token, IDPrefix: f.Consul.IDPrefix}
+		if cfg.Consul.Timeout, err = parseDuration("consul timeout", f.Consul.Timeout); err != nil {
+			return cfg, err
+		}
+		if cfg.Consul.RetryInterval, err = parseDuration("consul retry_interval", f.Consul.RetryInterval); err != nil {
+			return cfg, err
+		}
+	}
+	if f.Kubernetes != nil {
+		cfg.Kubernetes = kube.Config{Namespace: f.Kubernetes.Namespace, Kubeconfig: f.Kubernetes.Kubeconfig, NamePrefix: f.Kubernetes.NamePrefix}
+		if cfg.Kubernetes.Timeout, err = parseDuration("kubernetes timeout", f.Kubernetes.Timeout); err != nil {
+			return cfg, err
+		}
+		if cfg.Kubernetes.RetryInterval, err = parseDuration("kubernetes retry_interval", f.Kubernetes.RetryInterval); err != nil {
+			return cfg, err
+		}
+	}
+	if f.DNS != nil {
+		cfg.DNS = dnssd.Config{Addr: f.DNS.Addr, Zone: f.DNS.Zone}
+		if cfg.DNS.TTL, err = parseDuration("dns ttl", f.DNS.TTL); err != nil {
+			return cfg, err
+		}
+	}
+	if f.History != nil {
+		cfg.History = history.Config{Path: f.History.Path, MaxScans: f.History.MaxScans}
+		if cfg.History.MaxAge, err = parseDuration("history max_age", f.History.MaxAge); err != nil {
+			return cfg, err
+		}
+	}
+	if f.FileSD != nil {
+		cfg.FileSD = filesd.Config{
+			Path:       f.FileSD.Path,
+			Format:     filesd.Format(f.FileSD.Format),
+			SplitByJob: f.FileSD.SplitByJob,
+		}
+	}
+	return cfg, nil
+}
+
+// parseDuration parses an optional duration field
+func parseDuration(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return d, nil
+}
+
+// portServices converts port entries, a port needs a job and its name defaults to the job
+func portServices(ports []Port) ([]sd.PortService, error) {
+	var services []sd.PortService
+	for _, p := range ports {
+		if p.Port == 0 {
+			return nil, fmt.Errorf("port entry without port")
+		}
+		if p.Job == "" {
+			return nil, fmt.Errorf("port %d: job is required", p.Port)
+		}
+		ps := sd.PortService{Port: p.Port, Name: p.Name, Job: p.Job, Labels: p.Labels}
+		if ps.Name == "" {
+			ps.Name = ps.Job
+		}
+		services = append(services, ps)
+	}
+	return services, nil
+}
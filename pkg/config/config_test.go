@@ -0,0 +1,295 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+const yamlConfig = `
+targets: [10.0.0.0/24, db-01.dc.local]
+excludes: [10.0.0.1]
+scan_interval: 5
+scan_timeout: 2m
+log_level: DEBUG
+state_file: /var/lib/nmap_sd/state.json
+metrics_path: /metrics
+ports:
+  - port: 9100
+    job: node
+    labels:
+      team: infra
+  - port: 443
+    name: https
+    job: http_services
+profiles:
+  - name: lab
+    targets: [10.1.0.0/24]
+    scan_interval: 60
+    labels:
+      site: lab
+relabel_configs:
+  - source_labels: [__meta_nmap_hostname]
+    target_label: instance
+file_sd:
+  path: /tmp/targets.yaml
+history:
+  path: /var/lib/nmap_sd/history.db
+  max_age: 720h
+consul:
+  address: http://127.0.0.1:8500
+  retry_interval: 1m
+kubernetes:
+  namespace: monitoring
+  kubeconfig: KUBECONFIG_PATH
+  retry_interval: 1m
+dns:
+  addr: ":5353"
+  zone: nmap.example.
+  ttl: 1m
+webhooks:
+  - url: https://chat.example.com/hooks/nmap
+    secret: s3cret
+    initial_backoff: 2s
+`
+
+const tomlConfig = `
+targets = ["10.0.0.0/24", "db-01.dc.local"]
+excludes = ["10.0.0.1"]
+scan_interval = 5
+scan_timeout = "2m"
+log_level = "DEBUG"
+state_file = "/var/lib/nmap_sd/state.json"
+metrics_path = "/metrics"
+
+[[ports]]
+port = 9100
+job = "node"
+labels = { team = "infra" }
+
+[[ports]]
+port = 443
+name = "https"
+job = "http_services"
+
+[[profiles]]
+name = "lab"
+targets = ["10.1.0.0/24"]
+scan_interval = 60
+labels = { site = "lab" }
+
+[[relabel_configs]]
+source_labels = ["__meta_nmap_hostname"]
+target_label = "instance"
+
+[file_sd]
+path = "/tmp/targets.yaml"
+
+[history]
+path = "/var/lib/nmap_sd/history.db"
+max_age = "720h"
+
+[consul]
+address = "http://127.0.0.1:8500"
+retry_interval = "1m"
+
+[kubernetes]
+namespace = "monitoring"
+kubeconfig = "KUBECONFIG_PATH"
+retry_interval = "1m"
+
+[dns]
+addr = ":5353"
+zone = "nmap.example."
+ttl = "1m"
+
+[[webhooks]]
+url = "https://chat.example.com/hooks/nmap"
+secret = "s3cret"
+initial_backoff = "2s"
+`
+
+const jsonConfig = `{
+  "targets": ["10.0.0.0/24", "db-01.dc.local"],
+  "excludes": ["10.0.0.1"],
+  "scan_interval": 5,
+  "scan_timeout": "2m",
+  "log_level": "DEBUG",
+  "state_file": "/var/lib/nmap_sd/state.json",
+  "metrics_path": "/metrics",
+  "ports": [
+    {"port": 9100, "job": "node", "labels": {"team": "infra"}},
+    {"port": 443, "name": "https", "job": "http_services"}
+  ],
+  "profiles": [
+    {"name": "lab", "targets": ["10.1.0.0/24"], "scan_interval": 60, "labels": {"site": "lab"}}
+  ],
+  "relabel_configs": [
+    {"source_labels": ["__meta_nmap_hostname"], "target_label": "instance"}
+  ],
+  "file_sd": {"path": "/tmp/targets.yaml"},
+  "history": {"path": "/var/lib/nmap_sd/history.db", "max_age": "720h"},
+  "consul": {"address": "http://127.0.0.1:8500", "retry_interval": "1m"},
+  "kubernetes": {"namespace": "monitoring", "kubeconfig": "KUBECONFIG_PATH", "retry_interval": "1m"},
+  "dns": {"addr": ":5353", "zone": "nmap.example.", "ttl": "1m"},
+  "webhooks": [
+    {"url": "https://chat.example.com/hooks/nmap", "secret": "s3cret", "initial_backoff": "2s"}
+  ]
+}`
+
+// kubeconfig is a client configuration for the kubernetes sections, the cluster is never contacted
+const kubeconfig = `
+apiVersion: v1
+kind: Config
+clusters: [{name: test, cluster: {server: "https://127.0.0.1:6443"}}]
+contexts: [{name: test, context: {cluster: test}}]
+current-context: test
+`
+
+func TestLoadFormats(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(kubeconfigPath, []byte(kubeconfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"nmap_sd.yaml": yamlConfig,
+		"nmap_sd.toml": tomlConfig,
+		"nmap_sd.json": jsonConfig,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			content = strings.ReplaceAll(content, "KUBECONFIG_PATH", kubeconfigPath)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			cfg, err := f.MiddlewareConfig()
+			if err != nil {
+				t.Fatalf("MiddlewareConfig failed: %v", err)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Expected valid configuration, got %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.Targets, []string{"10.0.0.0/24", "db-01.dc.local"}) {
+				t.Errorf("Unexpected targets: %v", cfg.Targets)
+			}
+			if cfg.ScanInterval != 5 || cfg.ScanTimeout != 2*time.Minute || cfg.LogLevel != "DEBUG" {
+				t.Errorf("Unexpected schedule: interval %d, timeout %v, log level %s", cfg.ScanInterval, cfg.ScanTimeout, cfg.LogLevel)
+			}
+			wantPorts := []sd.PortService{
+				{Port: 9100, Name: "node", Job: "node", Labels: map[string]string{"team": "infra"}},
+				{Port: 443, Name: "https", Job: "http_services"},
+			}
+			if !reflect.DeepEqual(cfg.Ports, wantPorts) {
+				t.Errorf("Unexpected ports: %+v", cfg.Ports)
+			}
+			if len(cfg.Profiles) != 1 || cfg.Profiles[0].Name != "lab" || cfg.Profiles[0].ScanInterval != 60 || cfg.Profiles[0].Labels["site"] != "lab" {
+				t.Errorf("Unexpected profiles: %+v", cfg.Profiles)
+			}
+			wantRelabel := []relabel.Config{{SourceLabels: []string{"__meta_nmap_hostname"}, TargetLabel: "instance"}}
+			if !reflect.DeepEqual(cfg.RelabelConfigs, wantRelabel) {
+				t.Errorf("Unexpected relabel configs: %+v", cfg.RelabelConfigs)
+			}
+			if cfg.FileSD.Path != "/tmp/targets.yaml" {
+				t.Errorf("Unexpected file_sd path: %q", cfg.FileSD.Path)
+			}
+			if cfg.History.Path != "/var/lib/nmap_sd/history.db" || cfg.History.MaxAge != 720*time.Hour {
+				t.Errorf("Unexpected history: %+v", cfg.History)
+			}
+			if cfg.Consul.Address != "http://127.0.0.1:8500" || cfg.Consul.RetryInterval != time.Minute {
+				t.Errorf("Unexpected consul: %+v", cfg.Consul)
+			}
+			if cfg.Kubernetes.Namespace != "monitoring" || cfg.Kubernetes.Kubeconfig != kubeconfigPath || cfg.Kubernetes.RetryInterval != time.Minute {
+				t.Errorf("Unexpected kubernetes: %+v", cfg.Kubernetes)
+			}
+			if cfg.DNS.Addr != ":5353" || cfg.DNS.Zone != "nmap.example." || cfg.DNS.TTL != time.Minute {
+				t.Errorf("Unexpected dns: %+v", cfg.DNS)
+			}
+			if cfg.StateFile != "/var/lib/nmap_sd/state.json" || cfg.MetricsPath != "/metrics" {
+				t.Errorf("Unexpected state file %q or metrics path %q", cfg.StateFile, cfg.MetricsPath)
+			}
+			if len(cfg.Webhooks) != 1 || cfg.Webhooks[0].Secret != "s3cret" || cfg.Webhooks[0].InitialBackoff != 2*time.Second {
+				t.Errorf("Unexpected webhooks: %+v", cfg.Webhooks)
+			}
+		})
+	}
+}
+
+func TestParseRejectsUnknownFields(t *testing.T) {
+	tests := map[Format]string{
+		YAML: "targets: [10.0.0.0/24]\nscan_intervall: 5\n",
+		TOML: "targets = [\"10.0.0.0/24\"]\nscan_intervall = 5\n",
+		JSON: `{"targets": ["10.0.0.0/24"], "scan_intervall": 5}`,
+	}
+	for format, content := range tests {
+		if _, err := Parse([]byte(content), format); err == nil {
+			t.Errorf("%s: expected unknown field to be rejected", format)
+		}
+	}
+}
+
+func TestParseEmptyReplacement(t *testing.T) {
+	tests := map[Format]string{
+		YAML: "relabel_configs:\n  - {source_labels: [job], target_label: job, replacement: \"\"}\n  - {source_labels: [job], target_label: team}\n",
+		TOML: "[[relabel_configs]]\nsource_labels = [\"job\"]\ntarget_label = \"job\"\nreplacement = \"\"\n\n[[relabel_configs]]\nsource_labels = [\"job\"]\ntarget_label = \"team\"\n",
+		JSON: `{"relabel_configs": [{"source_labels": ["job"], "target_label": "job", "replacement": ""}, {"source_labels": ["job"], "target_label": "team"}]}`,
+	}
+	for format, content := range tests {
+		f, err := Parse([]byte(content), format)
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", format, err)
+		}
+		if len(f.RelabelConfigs) != 2 {
+			t.Fatalf("%s: expected 2 relabel rules, got %d", format, len(f.RelabelConfigs))
+		}
+		if r := f.RelabelConfigs[0].Replacement; r == nil || *r != "" {
+			t.Errorf("%s: expected an explicit empty replacement, got %v", format, r)
+		}
+		if r := f.RelabelConfigs[1].Replacement; r != nil {
+			t.Errorf("%s: expected a missing replacement to stay unset, got %q", format, *r)
+		}
+	}
+}
+
+func TestMiddlewareConfigErrors(t *testing.T) {
+	tests := map[string]File{
+		"port without job":           {Ports: []Port{{Port: 80}}},
+		"port without number":        {Ports: []Port{{Job: "web"}}},
+		"profile port":               {Profiles: []Profile{{Name: "lab", Ports: []Port{{Port: 80}}}}},
+		"invalid scan timeout":       {ScanTimeout: "soon"},
+		"invalid webhook timeout":    {Webhooks: []Webhook{{URL: "http://localhost/hook", Timeout: "10"}}},
+		"invalid history max_age":    {History: &History{Path: "history.db", MaxAge: "30d"}},
+		"invalid consul timeout":     {Consul: &Consul{Address: "http://127.0.0.1:8500", Timeout: "10"}},
+		"invalid kubernetes timeout": {Kubernetes: &Kubernetes{Namespace: "monitoring", Timeout: "10"}},
+		"invalid dns ttl":            {DNS: &DNS{Addr: ":5353", TTL: "1d"}},
+	}
+	for name, f := range tests {
+		if _, err := f.MiddlewareConfig(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	for path, want := range map[string]Format{"a.yml": YAML, "a.YAML": YAML, "a.toml": TOML, "a.json": JSON} {
+		if got, err := FormatFromPath(path); err != nil || got != want {
+			t.Errorf("FormatFromPath(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if _, err := FormatFromPath("nmap_sd.conf"); err == nil {
+		t.Error("Expected unknown extension to be rejected")
+	}
+}
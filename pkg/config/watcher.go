@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/middleware"
+)
+
+// DefaultWatchInterval is how often a Watcher checks the file for changes
+const DefaultWatchInterval = 5 * time.Second
+
+// Watcher loads a configuration file and sends a new middleware configuration
+// to the running NmapSD whenever the file content changes.
+//
+//	w := &config.Watcher{Path: "nmap_sd.yaml"}
+//	cfg, err := w.Load()
+//	...
+//	go w.Run(ctx)
+//	r.Use(middleware.New(cfg))
+//
+// The file is polled rather than watched with inotify, so editors that replace
+// the file and Kubernetes ConfigMap symlink swaps are picked up as well.
+type Watcher struct {
+	// Configuration file to load, the format is taken from the extension
+	Path string
+	// How often the file is checked for changes (default: DefaultWatchInterval)
+	Interval time.Duration
+	// Optional hook applied to every loaded file before it is converted,
+	// e.g. to apply command line overrides
+	Override func(*File) error
+	// Logger of the watcher (default: slog.Default())
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	file    *File
+	content []byte
+	updates chan middleware.Config
+}
+
+// Load reads and validates the file and returns its middleware configuration
+// with Updates connected to the watcher
+func (w *Watcher) Load() (middleware.Config, error) {
+	content, err := os.ReadFile(w.Path)
+	if err != nil {
+		return middleware.Config{}, err
+	}
+	f, cfg, err := w.parse(content)
+	if err != nil {
+		return cfg, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.file = f
+	w.content = content
+	if w.updates == nil {
+		w.updates = make(chan middleware.Config)
+	}
+	cfg.Updates = w.updates
+	w.logger().Debug("Watcher.Load: Configuration loaded", "path", w.Path)
+	return cfg, nil
+}
+
+// logger returns the logger of the watcher
+func (w *Watcher) logger() *slog.Logger {
+	if w.Logger == nil {
+		return slog.Default()
+	}
+	return w.Logger
+}
+
+// File returns the last successfully loaded file
+func (w *Watcher) File() *File {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file
+}
+
+// Run checks the file for changes until ctx is done. Load must be called first.
+// Changed files that fail to parse or validate are logged and skipped.
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w.logger().Debug("Watcher.Run: Watching configuration file", "path", w.Path, "interval", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			w.logger().Debug("Watcher.Run: Stopped", "path", w.Path)
+			return
+		case <-ticker.C:
+		}
+
+		cfg, changed, err := w.check()
+		if err != nil {
+			w.logger().Error("Failed to reload configuration file, keeping current configuration", "path", w.Path, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		w.logger().Info("Configuration file changed, reloading", "path", w.Path)
+		select {
+		case w.updates <- cfg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check reloads the file if its content changed
+func (w *Watcher) check() (middleware.Config, bool, error) {
+	content, err := os.ReadFile(w.Path)
+	if err != nil {
+		return middleware.Config{}, false, err
+	}
+
+	w.mu.Lock()
+	unchanged := bytes.Equal(content, w.content)
+	w.mu.Unlock()
+	if unchanged {
+		return middleware.Config{}, false, nil
+	}
+
+	f, cfg, err := w.parse(content)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Remember the content even if it is invalid so the error is logged only once
+	w.content = content
+	if err != nil {
+		return cfg, false, err
+	}
+	w.file = f
+	return cfg, true, nil
+}
+
+// parse decodes, converts and validates the file content
+func (w *Watcher) parse(content []byte) (*File, middleware.Config, error) {
+	format, err := FormatFromPath(w.Path)
+	if err != nil {
+		return nil, middleware.Config{}, err
+	}
+	f, err := Parse(content, format)
+	if err != nil {
+		return nil, middleware.Config{}, fmt.Errorf("failed to parse %s: %w", w.Path, err)
+	}
+	if w.Override != nil {
+		if err := w.Override(f); err != nil {
+			return nil, middleware.Config{}, err
+		}
+	}
+	cfg, err := f.MiddlewareConfig()
+	if err != nil {
+		return nil, cfg, fmt.Errorf("%s: %w", w.Path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, cfg, fmt.Errorf("%s: %w", w.Path, err)
+	}
+	return f, cfg, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherSendsChangedConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nmap_sd.yaml")
+	if err := os.WriteFile(path, []byte("targets: [10.0.0.0/24]\nscan_interval: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watcher{Path: path, Interval: 10 * time.Millisecond}
+	cfg, err := w.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.ScanInterval != 5 || cfg.Updates == nil {
+		t.Fatalf("Unexpected initial configuration: %+v", cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// Invalid changes are skipped, the next valid change is sent
+	if err := os.WriteFile(path, []byte("targets: [10.0.0.0/99]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("targets: [10.0.0.0/24]\nscan_interval: 10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case updated := <-cfg.Updates:
+		if updated.ScanInterval != 10 {
+			t.Errorf("Expected updated scan interval 10, got %d", updated.ScanInterval)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the changed configuration to be sent")
+	}
+	if w.File().ScanInterval != 10 {
+		t.Errorf("Expected File to return the reloaded file, got interval %d", w.File().ScanInterval)
+	}
+}
+
+func TestWatcherOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nmap_sd.toml")
+	if err := os.WriteFile(path, []byte("targets = [\"10.0.0.0/24\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watcher{Path: path, Override: func(f *File) error {
+		f.Targets = []string{"10.9.0.0/24"}
+		return nil
+	}}
+	cfg, err := w.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Targets) != 1 || cfg.Targets[0] != "10.9.0.0/24" {
+		t.Errorf("Expected override to be applied, got %v", cfg.Targets)
+	}
+}
+
+func TestWatcherLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nmap_sd.yaml")
+	if err := os.WriteFile(path, []byte("targets: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Watcher{Path: path}).Load(); err == nil {
+		t.Error("Expected configuration without targets to be rejected")
+	}
+}
@@ -0,0 +1,360 @@
+// Package consul registers discovered targets as Consul services and
+// deregisters them when they disappear from the scan results.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/syncloop"
+)
+
+const (
+	// ManagedMetaKey is the service meta key marking services registered by nmap_sd
+	ManagedMetaKey = "managed_by"
+	// ManagedMetaValue is the value of ManagedMetaKey on services registered by nmap_sd
+	ManagedMetaValue = "nmap_sd"
+	// TokenHeader carries the Consul ACL token
+	TokenHeader = "X-Consul-Token"
+
+	// DefaultIDPrefix starts the IDs of registered services
+	DefaultIDPrefix = "nmap-sd"
+	// DefaultTimeout bounds a single request to the Consul agent
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetryInterval is the delay before a failed sync is retried
+	DefaultRetryInterval = 30 * time.Second
+)
+
+// idPrefixPattern matches the characters allowed in an ID prefix
+var idPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Config of the Consul service registration
+type Config struct {
+	// HTTP address of the Consul agent, e.g. "http://127.0.0.1:8500"
+	// (disabled when empty and no Registrar is set)
+	Address string
+	// Optional ACL token sent in the TokenHeader
+	Token string
+	// Prefix of the IDs of registered services (default: DefaultIDPrefix). Only services with
+	// this prefix and ManagedMetaKey are deregistered, so instances must use different prefixes.
+	IDPrefix string
+	// Timeout of a single request to the Consul agent (default: DefaultTimeout)
+	Timeout time.Duration
+	// Delay before a failed sync is retried (default: DefaultRetryInterval)
+	RetryInterval time.Duration
+	// Registrar used instead of the Consul agent at Address, e.g. a stand-in in tests
+	Registrar Registrar
+	// Logger of the syncer (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Enabled reports whether services should be registered
+func (c Config) Enabled() bool {
+	return c.Address != "" || c.Registrar != nil
+}
+
+// Service is a service registered on the Consul agent
+type Service struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+// Registrar registers services, implemented by Client for the Consul agent HTTP API
+type Registrar interface {
+	// Services returns all services registered on the agent
+	Services(ctx context.Context) ([]Service, error)
+	// Register adds or replaces a service
+	Register(ctx context.Context, s Service) error
+	// Deregister removes the service with the given ID
+	Deregister(ctx context.Context, id string) error
+}
+
+// Client is a Registrar using the Consul agent HTTP API
+type Client struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// NewClient creates a client of the Consul agent at address
+func NewClient(address, token string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid consul address %q", address)
+	}
+	return &Client{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// agentService is a service in the /v1/agent/services response
+type agentService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+// registration is the body of /v1/agent/service/register
+type registration struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+// Services implements Registrar
+func (c *Client) Services(ctx context.Context) ([]Service, error) {
+	body, err := c.do(ctx, http.MethodGet, "/v1/agent/services", nil)
+	if err != nil {
+		return nil, err
+	}
+	var agentServices map[string]agentService
+	if err := json.Unmarshal(body, &agentServices); err != nil {
+		return nil, fmt.Errorf("failed to decode services: %w", err)
+	}
+	services := make([]Service, 0, len(agentServices))
+	for _, s := range agentServices {
+		services = append(services, Service{ID: s.ID, Name: s.Service, Tags: s.Tags, Address: s.Address, Port: s.Port, Meta: s.Meta})
+	}
+	return services, nil
+}
+
+// Register implements Registrar
+func (c *Client) Register(ctx context.Context, s Service) error {
+	body, err := json.Marshal(registration(s))
+	if err != nil {
+		return fmt.Errorf("failed to encode service: %w", err)
+	}
+	_, err = c.do(ctx, http.MethodPut, "/v1/agent/service/register", body)
+	return err
+}
+
+// Deregister implements Registrar
+func (c *Client) Deregister(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+	return err
+}
+
+// do sends a request to the agent and returns the response body
+func (c *Client) do(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set(TokenHeader, c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: unexpected status %s: %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// Services builds the services of the targets: one per host:port and job, named after
+// the job and tagged with it and the "name=value" pairs of the labels not starting with "__".
+// All labels but the scan time are added as service meta, along with ManagedMetaKey.
+func Services(targets []sd.ServiceTarget, idPrefix string) []Service {
+	return services(slog.Default(), targets, idPrefix)
+}
+
+// services is Services logging to log
+func services(log *slog.Logger, targets []sd.ServiceTarget, idPrefix string) []Service {
+	var services []Service
+	seen := make(map[string]bool)
+	for _, st := range targets {
+		job := st.Labels["job"]
+		var labelTags []string
+		meta := map[string]string{ManagedMetaKey: ManagedMetaValue}
+		for name, value := range st.Labels {
+			if name == sd.MetaLabelScanTime {
+				// Changes with every scan and would update the service each time
+				continue
+			}
+			meta[name] = value
+			if name != "job" && !strings.HasPrefix(name, "__") {
+				labelTags = append(labelTags, name+"="+value)
+			}
+		}
+		sort.Strings(labelTags)
+		tags := []string{}
+		if job != "" {
+			tags = append(tags, job)
+		}
+		tags = append(tags, labelTags...)
+
+		name := job
+		if name == "" {
+			name = ManagedMetaValue
+		}
+		for _, target := range st.Targets {
+			host, portStr, err := net.SplitHostPort(target)
+			port, portErr := strconv.Atoi(portStr)
+			if err != nil || portErr != nil {
+				log.Debug("Services: Skipping target without port", "target", target)
+				continue
+			}
+			id := strings.Join([]string{idPrefix, sanitizeID(name), sanitizeID(host), portStr}, "-")
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			services = append(services, Service{ID: id, Name: name, Tags: tags, Address: host, Port: port, Meta: meta})
+		}
+	}
+	return services
+}
+
+// sanitizeID replaces the characters not allowed in service IDs
+func sanitizeID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// Syncer keeps the services registered in Consul in line with the latest targets
+type Syncer struct {
+	cfg       Config
+	registrar Registrar
+	log       *slog.Logger
+	loop      *syncloop.Loop[[]sd.ServiceTarget]
+}
+
+// New validates the configuration and creates a Syncer. Run must be started to sync updates.
+func New(cfg Config) (*Syncer, error) {
+	if cfg.IDPrefix == "" {
+		cfg.IDPrefix = DefaultIDPrefix
+	}
+	if !idPrefixPattern.MatchString(cfg.IDPrefix) {
+		return nil, fmt.Errorf("invalid consul ID prefix %q", cfg.IDPrefix)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	registrar := cfg.Registrar
+	if registrar == nil {
+		client, err := NewClient(cfg.Address, cfg.Token, cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		registrar = client
+	}
+	cfg.Logger.Debug("consul.New: Created Consul syncer", "address", cfg.Address, "id_prefix", cfg.IDPrefix)
+	s := &Syncer{cfg: cfg, registrar: registrar, log: cfg.Logger}
+	s.loop = syncloop.New("consul", s.Sync, cfg.RetryInterval, cfg.Logger.With("address", cfg.Address))
+	return s, nil
+}
+
+// Update hands the latest targets to Run. Targets not synced yet are replaced.
+func (s *Syncer) Update(targets []sd.ServiceTarget) {
+	s.loop.Update(targets)
+}
+
+// Run syncs the targets of every Update until ctx is done, retrying failed syncs
+func (s *Syncer) Run(ctx context.Context) {
+	s.loop.Run(ctx)
+}
+
+// Sync registers the services of the targets that are missing or changed and deregisters
+// the services registered by this Syncer whose targets disappeared
+func (s *Syncer) Sync(ctx context.Context, targets []sd.ServiceTarget) error {
+	current, err := s.registrar.Services(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	managed := make(map[string]Service)
+	for _, svc := range current {
+		if svc.Meta[ManagedMetaKey] == ManagedMetaValue && strings.HasPrefix(svc.ID, s.cfg.IDPrefix+"-") {
+			managed[svc.ID] = svc
+		}
+	}
+
+	var errs []error
+	registered, deregistered := 0, 0
+	wanted := services(s.log, targets, s.cfg.IDPrefix)
+	for _, svc := range wanted {
+		if existing, ok := managed[svc.ID]; ok {
+			delete(managed, svc.ID)
+			if equal(existing, svc) {
+				continue
+			}
+		}
+		if err := s.registrar.Register(ctx, svc); err != nil {
+			errs = append(errs, fmt.Errorf("register %s: %w", svc.ID, err))
+			continue
+		}
+		registered++
+	}
+	for id := range managed {
+		if err := s.registrar.Deregister(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("deregister %s: %w", id, err))
+			continue
+		}
+		deregistered++
+	}
+
+	s.log.Debug("Sync: Consul services synced", "services", len(wanted), "registered", registered, "deregistered", deregistered, "errors", len(errs))
+	return errors.Join(errs...)
+}
+
+// equal reports whether a registered service matches the wanted one
+func equal(registered, wanted Service) bool {
+	return registered.Name == wanted.Name &&
+		registered.Address == wanted.Address &&
+		registered.Port == wanted.Port &&
+		slices.Equal(registered.Tags, wanted.Tags) &&
+		maps.Equal(registered.Meta, wanted.Meta)
+}
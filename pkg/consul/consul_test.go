@@ -0,0 +1,215 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// agent is a stand-in for the service endpoints of the Consul agent HTTP API
+type agent struct {
+	mu       sync.Mutex
+	token    string
+	services map[string]registration
+	fail     bool
+}
+
+func newAgent(t *testing.T, token string) (*agent, *httptest.Server) {
+	a := &agent{token: token, services: make(map[string]registration)}
+	srv := httptest.NewServer(a)
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+func (a *agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && r.Header.Get(TokenHeader) != a.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	if a.fail {
+		http.Error(w, "agent unavailable", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/agent/services":
+		services := make(map[string]agentService)
+		for id, s := range a.services {
+			services[id] = agentService{ID: s.ID, Service: s.Name, Tags: s.Tags, Address: s.Address, Port: s.Port, Meta: s.Meta}
+		}
+		json.NewEncoder(w).Encode(services)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		var s registration
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.services[s.ID] = s
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if _, ok := a.services[id]; !ok {
+			http.Error(w, "Unknown service ID", http.StatusNotFound)
+			return
+		}
+		delete(a.services, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *agent) snapshot() map[string]registration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	services := make(map[string]registration, len(a.services))
+	for id, s := range a.services {
+		services[id] = s
+	}
+	return services
+}
+
+func testTargets(targets ...string) []sd.ServiceTarget {
+	var sts []sd.ServiceTarget
+	for _, target := range targets {
+		sts = append(sts, sd.ServiceTarget{
+			Targets: []string{target},
+			Labels: map[string]string{
+				"job":                "node",
+				"env":                "prod",
+				sd.MetaLabelIP:       strings.Split(target, ":")[0],
+				sd.MetaLabelScanTime: time.Now().Format(time.RFC3339Nano),
+			},
+		})
+	}
+	return sts
+}
+
+func TestServices(t *testing.T) {
+	services := Services([]sd.ServiceTarget{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node", "env": "prod", "dc": "eu", sd.MetaLabelScanTime: "now"}},
+		{Targets: []string{"[2001:db8::1]:80"}, Labels: map[string]string{}},
+		{Targets: []string{"no-port"}, Labels: map[string]string{"job": "node"}},
+	}, "nmap-sd")
+
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services, got %+v", services)
+	}
+	node := services[0]
+	if node.ID != "nmap-sd-node-10.0.0.1-9100" || node.Name != "node" || node.Address != "10.0.0.1" || node.Port != 9100 {
+		t.Errorf("Unexpected service: %+v", node)
+	}
+	if strings.Join(node.Tags, ",") != "node,dc=eu,env=prod" {
+		t.Errorf("Unexpected tags: %v", node.Tags)
+	}
+	if node.Meta[ManagedMetaKey] != ManagedMetaValue || node.Meta["env"] != "prod" {
+		t.Errorf("Unexpected meta: %v", node.Meta)
+	}
+	if _, ok := node.Meta[sd.MetaLabelScanTime]; ok {
+		t.Error("Expected the scan time to be left out of the meta")
+	}
+
+	v6 := services[1]
+	if v6.ID != "nmap-sd-nmap_sd-2001-db8--1-80" || v6.Name != ManagedMetaValue || v6.Address != "2001:db8::1" {
+		t.Errorf("Unexpected service without job: %+v", v6)
+	}
+}
+
+func TestSync(t *testing.T) {
+	a, srv := newAgent(t, "secret")
+	// Services registered by others are never touched
+	a.services["web"] = registration{ID: "web", Name: "web", Port: 80}
+	a.services["nmap-sd-node-10.0.0.9-9100"] = registration{ID: "nmap-sd-node-10.0.0.9-9100", Name: "node", Port: 9100}
+
+	s, err := New(Config{Address: srv.URL, Token: "secret"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Sync(ctx, testTargets("10.0.0.1:9100", "10.0.0.2:9100")); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	services := a.snapshot()
+	if len(services) != 4 {
+		t.Fatalf("Expected 2 registered and 2 foreign services, got %v", services)
+	}
+	registered := services["nmap-sd-node-10.0.0.1-9100"]
+	if registered.Name != "node" || registered.Address != "10.0.0.1" || registered.Port != 9100 || registered.Meta[ManagedMetaKey] != ManagedMetaValue {
+		t.Errorf("Unexpected registration: %+v", registered)
+	}
+
+	// A target disappears, the other one is unchanged
+	if err := s.Sync(ctx, testTargets("10.0.0.1:9100")); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	services = a.snapshot()
+	if _, ok := services["nmap-sd-node-10.0.0.2-9100"]; ok {
+		t.Error("Expected the disappeared target to be deregistered")
+	}
+	if _, ok := services["nmap-sd-node-10.0.0.1-9100"]; !ok {
+		t.Error("Expected the remaining target to stay registered")
+	}
+	if _, ok := services["web"]; !ok {
+		t.Error("Expected foreign services to stay registered")
+	}
+	if _, ok := services["nmap-sd-node-10.0.0.9-9100"]; !ok {
+		t.Error("Expected services without the managed meta to stay registered")
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	_, srv := newAgent(t, "secret")
+	s, err := New(Config{Address: srv.URL, Token: "wrong"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := s.Sync(context.Background(), testTargets("10.0.0.1:9100")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected the agent error to be reported, got %v", err)
+	}
+}
+
+func TestSyncerRun(t *testing.T) {
+	a, srv := newAgent(t, "")
+	a.fail = true
+	s, err := New(Config{Address: srv.URL, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	s.Update(testTargets("10.0.0.1:9100"))
+	s.Update(testTargets("10.0.0.1:9100", "10.0.0.2:9100"))
+	time.Sleep(30 * time.Millisecond)
+	a.mu.Lock()
+	a.fail = false
+	a.mu.Unlock()
+
+	// The failed sync is retried with the latest targets
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.snapshot()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the retried sync, services: %v", a.snapshot())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Address: "127.0.0.1:8500"},
+		{Address: "http://127.0.0.1:8500", IDPrefix: "nmap sd"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Package dnssd serves discovered services over DNS: SRV records per job and
+// A/AAAA records per host, for tools that only support DNS based discovery.
+package dnssd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+const (
+	// DefaultZone is the zone the records are served in
+	DefaultZone = "nmap.local."
+	// DefaultTTL is the TTL of the served records
+	DefaultTTL = 30 * time.Second
+)
+
+// Config of the DNS server
+type Config struct {
+	// UDP and TCP listen address, e.g. ":5353" (disabled when empty)
+	Addr string
+	// Zone the server is authoritative for (default: DefaultZone)
+	Zone string
+	// TTL of the served records (default: DefaultTTL)
+	TTL time.Duration
+	// Logger of the server (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Server is an authoritative DNS server answering from the latest scan results:
+// SRV queries for _<job>._tcp.<zone> and A/AAAA queries for <hostname>.<zone>.
+// Hosts without a hostname are named after their address, e.g. ip-10-0-0-1.<zone>.
+type Server struct {
+	addr string
+	log  *slog.Logger
+
+	// updateMu serializes Update and Reconfigure
+	updateMu sync.Mutex
+	mu       sync.RWMutex
+	zone     string
+	ttl      uint32
+	records  map[string][]dns.RR
+	serial   uint32
+	// Results of the last Update, to rebuild the records on Reconfigure
+	targets []sd.ServiceTarget
+	hosts   []sd.HostInfo
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+// New validates the configuration and creates a Server. Listen and Serve must be called to answer queries.
+func New(cfg Config) (*Server, error) {
+	zone, ttl, err := zoneAndTTL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	return &Server{
+		addr:    cfg.Addr,
+		log:     log,
+		zone:    zone,
+		ttl:     ttl,
+		records: make(map[string][]dns.RR),
+		serial:  uint32(time.Now().Unix()),
+	}, nil
+}
+
+// zoneAndTTL returns the canonical zone and the TTL in seconds of cfg
+func zoneAndTTL(cfg Config) (string, uint32, error) {
+	zone := cfg.Zone
+	if zone == "" {
+		zone = DefaultZone
+	}
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return "", 0, fmt.Errorf("invalid zone %q", zone)
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return dns.CanonicalName(zone), uint32(ttl.Seconds()), nil
+}
+
+// Reconfigure applies the zone and TTL of cfg to the server, keeping its sockets,
+// and rebuilds the records of the last Update. The address and logger of cfg are ignored.
+func (s *Server) Reconfigure(cfg Config) error {
+	zone, ttl, err := zoneAndTTL(cfg)
+	if err != nil {
+		return err
+	}
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.mu.Lock()
+	s.zone, s.ttl = zone, ttl
+	s.mu.Unlock()
+	s.update(s.targets, s.hosts)
+	return nil
+}
+
+// Update replaces the served records with the records of the targets and hosts
+func (s *Server) Update(targets []sd.ServiceTarget, hosts []sd.HostInfo) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.update(targets, hosts)
+}
+
+// update replaces the served records, the caller must hold updateMu
+func (s *Server) update(targets []sd.ServiceTarget, hosts []sd.HostInfo) {
+	s.mu.RLock()
+	zone, ttl := s.zone, s.ttl
+	s.mu.RUnlock()
+
+	records := make(map[string][]dns.RR)
+	add := func(rr dns.RR) {
+		name := rr.Header().Name
+		for _, existing := range records[name] {
+			if dns.IsDuplicate(existing, rr) {
+				return
+			}
+		}
+		records[name] = append(records[name], rr)
+	}
+
+	names := make(map[string]string, len(hosts))
+	for _, h := range hosts {
+		ip := net.ParseIP(h.IP)
+		if ip == nil {
+			continue
+		}
+		name := hostName(zone, h.Hostname, ip)
+		names[h.IP] = name
+		add(addressRecord(name, ip, ttl))
+	}
+
+	for _, st := range targets {
+		job := st.Labels["job"]
+		if job == "" {
+			continue
+		}
+		srvName := "_" + label(job) + "._tcp." + zone
+		for _, target := range st.Targets {
+			host, portStr, err := net.SplitHostPort(target)
+			port, portErr := strconv.ParseUint(portStr, 10, 16)
+			if err != nil || portErr != nil {
+				s.log.Debug("Update: Skipping target without port", "target", target)
+				continue
+			}
+			name, ok := names[host]
+			if !ok {
+				if ip := net.ParseIP(host); ip != nil {
+					// Targets whose host was not reported by the scan, e.g. after relabeling
+					name = hostName(zone, "", ip)
+					add(addressRecord(name, ip, ttl))
+				} else {
+					name = dns.Fqdn(strings.ToLower(host))
+				}
+			}
+			add(&dns.SRV{
+				Hdr:      dns.RR_Header{Name: srvName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+				Priority: 10,
+				Weight:   10,
+				Port:     uint16(port),
+				Target:   name,
+			})
+		}
+	}
+	for _, rrs := range records {
+		slices.SortFunc(rrs, func(a, b dns.RR) int { return strings.Compare(a.String(), b.String()) })
+	}
+
+	s.mu.Lock()
+	s.records = records
+	s.targets, s.hosts = targets, hosts
+	s.serial++
+	s.mu.Unlock()
+	s.log.Debug("Update: DNS records updated", "names", len(records))
+}
+
+// hostName returns the name of a host in the zone
+func hostName(zone, hostname string, ip net.IP) string {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if _, ok := dns.IsDomainName(hostname); hostname == "" || !ok {
+		hostname = "ip-" + strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	}
+	return hostname + "." + zone
+}
+
+// addressRecord returns the A or AAAA record of ip
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip4}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip}
+}
+
+// label turns a job name into a DNS label
+func label(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// soa returns the SOA record of the zone
+func soa(zone string, ttl, serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: ttl,
+		Retry:   ttl,
+		Expire:  ttl * 10,
+		Minttl:  ttl,
+	}
+}
+
+// ServeDNS implements dns.Handler
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	s.mu.RLock()
+	zone, ttl, serial := s.zone, s.ttl, s.serial
+	rrs, exists := s.records[name]
+	for _, rr := range rrs {
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	// Addresses of the SRV targets save clients another lookup
+	for _, rr := range m.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			m.Extra = append(m.Extra, s.records[srv.Target]...)
+		}
+	}
+	s.mu.RUnlock()
+
+	if !dns.IsSubDomain(zone, name) {
+		s.log.Debug("ServeDNS: Refusing query outside the zone", "name", q.Name)
+		m.Authoritative = false
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	switch {
+	case name == zone && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY):
+		m.Answer = append(m.Answer, soa(zone, ttl, serial))
+	case len(m.Answer) > 0:
+	case exists || name == zone:
+		// The name exists without records of the queried type
+		m.Ns = []dns.RR{soa(zone, ttl, serial)}
+	default:
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = []dns.RR{soa(zone, ttl, serial)}
+	}
+	m.Truncate(maxSize(w, r))
+	s.log.Debug("ServeDNS: Answering query", "name", q.Name, "type", dns.TypeToString[q.Qtype], "answers", len(m.Answer), "truncated", m.Truncated, "rcode", dns.RcodeToString[m.Rcode])
+	w.WriteMsg(m)
+}
+
+// maxSize returns the largest reply the client accepts: the EDNS0 UDP size advertised
+// in the query or 512 bytes over UDP, and the DNS message limit over TCP
+func maxSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.LocalAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// Listen opens the UDP and TCP sockets on the configured address, using the same port for both
+func (s *Server) Listen() error {
+	udp, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", s.addr, err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", s.addr, err)
+	}
+	s.udp, s.tcp = udp, tcp
+	return nil
+}
+
+// Addr returns the address the server listens on, nil before Listen
+func (s *Server) Addr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Serve answers queries on the sockets opened by Listen until ctx is done
+func (s *Server) Serve(ctx context.Context) {
+	servers := []*dns.Server{
+		{PacketConn: s.udp, Handler: s},
+		{Listener: s.tcp, Handler: s},
+	}
+	// Shutdown fails for servers that did not start yet, so wait for them first
+	var started sync.WaitGroup
+	for _, srv := range servers {
+		started.Add(1)
+		done := sync.OnceFunc(started.Done)
+		srv.NotifyStartedFunc = done
+		go func() {
+			err := srv.ActivateAndServe()
+			done()
+			if err != nil && ctx.Err() == nil {
+				s.log.Error("DNS server failed", "addr", s.addr, "error", err)
+			}
+		}()
+	}
+	started.Wait()
+	s.log.Debug("Serve: DNS server started", "addr", s.Addr())
+	<-ctx.Done()
+	for _, srv := range servers {
+		srv.Shutdown()
+	}
+	s.log.Debug("Serve: DNS server stopped", "addr", s.Addr())
+}
@@ -0,0 +1,182 @@
+package dnssd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// startServer runs a server on a free local port and returns its address
+func startServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	cfg.Addr = "127.0.0.1:0"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, s.Addr().String()
+}
+
+func query(t *testing.T, addr, network, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	c := &dns.Client{Net: network}
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Query %s %s over %s failed: %v", name, dns.TypeToString[qtype], network, err)
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	s, addr := startServer(t, Config{Zone: "sd.example"})
+	s.Update([]sd.ServiceTarget{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node"}},
+		{Targets: []string{"10.0.0.2:9100"}, Labels: map[string]string{"job": "node"}},
+		{Targets: []string{"[2001:db8::1]:443"}, Labels: map[string]string{"job": "HTTP Services"}},
+	}, []sd.HostInfo{
+		{IP: "10.0.0.1", Hostname: "db-01.dc.local"},
+		{IP: "2001:db8::1", Hostname: "db-01.dc.local"},
+		{IP: "10.0.0.2"},
+	})
+
+	resp := query(t, addr, "udp", "_node._tcp.sd.example.", dns.TypeSRV)
+	if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 2 {
+		t.Fatalf("Unexpected SRV response: %v", resp)
+	}
+	targets := map[string]uint16{}
+	for _, rr := range resp.Answer {
+		srv := rr.(*dns.SRV)
+		targets[srv.Target] = srv.Port
+	}
+	if targets["db-01.dc.local.sd.example."] != 9100 || targets["ip-10-0-0-2.sd.example."] != 9100 {
+		t.Errorf("Unexpected SRV targets: %v", targets)
+	}
+	if len(resp.Extra) != 3 {
+		t.Errorf("Expected the addresses of the SRV targets as additional records, got %v", resp.Extra)
+	}
+
+	resp = query(t, addr, "tcp", "_http-services._tcp.sd.example.", dns.TypeSRV)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 443 {
+		t.Errorf("Unexpected SRV response for a job with spaces: %v", resp)
+	}
+
+	resp = query(t, addr, "udp", "DB-01.dc.local.sd.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unexpected A response: %v", resp)
+	}
+	resp = query(t, addr, "udp", "db-01.dc.local.sd.example.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Unexpected AAAA response: %v", resp)
+	}
+
+	// Existing name without records of the type, unknown name and foreign zone
+	resp = query(t, addr, "udp", "ip-10-0-0-2.sd.example.", dns.TypeAAAA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("Expected an empty answer with the SOA, got %v", resp)
+	}
+	resp = query(t, addr, "udp", "missing.sd.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Errorf("Expected NXDOMAIN, got %v", resp)
+	}
+	resp = query(t, addr, "udp", "example.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected queries outside the zone to be refused, got %v", resp)
+	}
+
+	// Records follow the latest results
+	s.Update(nil, nil)
+	resp = query(t, addr, "udp", "_node._tcp.sd.example.", dns.TypeSRV)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN after the targets disappeared, got %v", resp)
+	}
+	resp = query(t, addr, "udp", "sd.example.", dns.TypeSOA)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Unexpected SOA response: %v", resp)
+	}
+}
+
+func TestNewInvalidZone(t *testing.T) {
+	if _, err := New(Config{Addr: ":5353", Zone: "bad..zone"}); err == nil {
+		t.Error("Expected an invalid zone to be rejected")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	s, addr := startServer(t, Config{Zone: "old.example"})
+	s.Update([]sd.ServiceTarget{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node"}},
+	}, nil)
+
+	if err := s.Reconfigure(Config{Zone: "new.example", TTL: time.Minute}); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	resp := query(t, addr, "udp", "_node._tcp.new.example.", dns.TypeSRV)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 60 {
+		t.Errorf("Expected the records of the last update in the new zone, got %v", resp)
+	}
+	if resp := query(t, addr, "udp", "_node._tcp.old.example.", dns.TypeSRV); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the old zone to be refused, got %v", resp)
+	}
+	if err := s.Reconfigure(Config{Zone: "bad..zone"}); err == nil {
+		t.Error("Expected an invalid zone to be rejected")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	s, addr := startServer(t, Config{Zone: "sd.example"})
+	var targets []sd.ServiceTarget
+	for i := range 100 {
+		targets = append(targets, sd.ServiceTarget{
+			Targets: []string{fmt.Sprintf("10.0.0.%d:9100", i+1)},
+			Labels:  map[string]string{"job": "node"},
+		})
+	}
+	s.Update(targets, nil)
+
+	resp := query(t, addr, "udp", "_node._tcp.sd.example.", dns.TypeSRV)
+	if !resp.Truncated || len(resp.Answer) == 0 || len(resp.Answer) == 100 {
+		t.Errorf("Expected a truncated UDP reply, got %d answers (truncated: %v)", len(resp.Answer), resp.Truncated)
+	}
+	resp.Compress = true
+	if resp.Len() > dns.MinMsgSize {
+		t.Errorf("Expected the UDP reply to fit in %d bytes, got %d", dns.MinMsgSize, resp.Len())
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("_node._tcp.sd.example.", dns.TypeSRV)
+	m.SetEdns0(4096, false)
+	resp, _, err := (&dns.Client{Net: "udp", UDPSize: 4096}).Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("EDNS0 query failed: %v", err)
+	}
+	resp.Compress = true
+	if !resp.Truncated || resp.Len() > 4096 || resp.Len() <= dns.MinMsgSize {
+		t.Errorf("Expected the reply to use the advertised UDP size, got %d bytes (truncated: %v)", resp.Len(), resp.Truncated)
+	}
+
+	resp = query(t, addr, "tcp", "_node._tcp.sd.example.", dns.TypeSRV)
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Errorf("Expected every record over TCP, got %d answers (truncated: %v)", len(resp.Answer), resp.Truncated)
+	}
+}
@@ -0,0 +1,186 @@
+package filesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Format is the encoding of a file_sd file
+type Format string
+
+const (
+	// JSON writes the targets as a JSON array
+	JSON Format = "json"
+	// YAML writes the targets as a YAML list
+	YAML Format = "yaml"
+)
+
+// Config for the Prometheus file_sd writer
+type Config struct {
+	// File to write, or the directory to write one file per job into when SplitByJob is set
+	Path string
+	// File format: "json" or "yaml" (default: from the Path extension, otherwise "json")
+	Format Format
+	// Write one "<job>.<format>" file per job instead of a single file
+	SplitByJob bool
+	// Logger of the writer (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Writer atomically writes service targets to Prometheus file_sd files
+type Writer struct {
+	cfg     Config
+	log     *slog.Logger
+	mu      sync.Mutex
+	written map[string]bool
+}
+
+// NewWriter validates the configuration and creates a Writer
+func NewWriter(cfg Config) (*Writer, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file_sd path is required")
+	}
+	if cfg.Format == "" {
+		cfg.Format = formatFromPath(cfg.Path, cfg.SplitByJob)
+	}
+	cfg.Format = Format(strings.ToLower(string(cfg.Format)))
+	if cfg.Format != JSON && cfg.Format != YAML {
+		return nil, fmt.Errorf("unknown file_sd format %q", cfg.Format)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	cfg.Logger.Debug("NewWriter: Created file_sd writer", "path", cfg.Path, "format", cfg.Format, "split_by_job", cfg.SplitByJob)
+	return &Writer{cfg: cfg, log: cfg.Logger, written: make(map[string]bool)}, nil
+}
+
+// Write writes the targets to the configured file or per-job files.
+// With SplitByJob, files of jobs that are no longer present are removed.
+func (w *Writer) Write(targets []sd.ServiceTarget) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.cfg.SplitByJob {
+		w.log.Debug("Write: Writing file_sd file", "path", w.cfg.Path, "service_groups", len(targets))
+		return w.writeFile(w.cfg.Path, targets)
+	}
+
+	if err := os.MkdirAll(w.cfg.Path, 0755); err != nil {
+		return fmt.Errorf("failed to create file_sd directory: %w", err)
+	}
+
+	byJob := make(map[string][]sd.ServiceTarget)
+	for _, st := range targets {
+		job := st.Labels["job"]
+		byJob[job] = append(byJob[job], st)
+	}
+	jobs := make([]string, 0, len(byJob))
+	for job := range byJob {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+
+	current := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		path := filepath.Join(w.cfg.Path, jobFileName(job)+"."+string(w.cfg.Format))
+		w.log.Debug("Write: Writing file_sd job file", "path", path, "job", job, "service_groups", len(byJob[job]))
+		if err := w.writeFile(path, byJob[job]); err != nil {
+			return err
+		}
+		current[path] = true
+	}
+
+	for path := range w.written {
+		if current[path] {
+			continue
+		}
+		w.log.Debug("Write: Removing file_sd file of vanished job", "path", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	w.written = current
+	return nil
+}
+
+// writeFile encodes the targets and atomically replaces path with them
+func (w *Writer) writeFile(path string, targets []sd.ServiceTarget) error {
+	if targets == nil {
+		targets = []sd.ServiceTarget{}
+	}
+
+	var data []byte
+	var err error
+	switch w.cfg.Format {
+	case YAML:
+		data, err = yaml.Marshal(targets)
+	default:
+		data, err = json.MarshalIndent(targets, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode targets: %w", err)
+	}
+
+	// Write to a temporary file in the same directory and rename it so
+	// Prometheus never reads a partially written file
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), path, err)
+	}
+	return nil
+}
+
+// formatFromPath guesses the format from the file extension
+func formatFromPath(path string, dir bool) Format {
+	if dir {
+		return JSON
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return YAML
+	default:
+		return JSON
+	}
+}
+
+// jobFileName turns a job name into a safe file name
+func jobFileName(job string) string {
+	if job == "" {
+		return "_unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, job)
+}
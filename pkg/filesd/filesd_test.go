@@ -0,0 +1,138 @@
+package filesd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func testTargets() []sd.ServiceTarget {
+	return []sd.ServiceTarget{
+		{Targets: []string{"10.0.3.15:9182"}, Labels: map[string]string{"job": "windows_exporter"}},
+		{Targets: []string{"10.0.3.14:8080"}, Labels: map[string]string{"job": "http_services"}},
+		{Targets: []string{"[fd00:10::14]:8080"}, Labels: map[string]string{"job": "http_services"}},
+	}
+}
+
+func TestNewWriterValidation(t *testing.T) {
+	if _, err := NewWriter(Config{}); err == nil {
+		t.Error("Expected error for empty path")
+	}
+
+	if _, err := NewWriter(Config{Path: "targets.json", Format: "toml"}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+
+	w, err := NewWriter(Config{Path: "targets.yml"})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+	if w.cfg.Format != YAML {
+		t.Errorf("Expected format yaml from extension, got %s", w.cfg.Format)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	w, err := NewWriter(Config{Path: path})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	if err := w.Write(testTargets()); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	var got []sd.ServiceTarget
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	if len(got) != 3 || got[2].Targets[0] != "[fd00:10::14]:8080" {
+		t.Errorf("Unexpected targets: %+v", got)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the target file, found %d entries", len(entries))
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	w, err := NewWriter(Config{Path: path})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	if err := w.Write(testTargets()[:1]); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	for _, want := range []string{"- targets:", "10.0.3.15:9182", "labels:", "job: windows_exporter"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected YAML to contain %q, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestWriteSplitByJob(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "file_sd")
+	w, err := NewWriter(Config{Path: dir, SplitByJob: true})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	if err := w.Write(testTargets()); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	for _, name := range []string{"http_services.json", "windows_exporter.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+
+	// windows_exporter disappears on the next scan
+	if err := w.Write(testTargets()[1:]); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "windows_exporter.json")); !os.IsNotExist(err) {
+		t.Error("Expected file of vanished job to be removed")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "http_services.json"))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	var got []sd.ServiceTarget
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("Expected 2 http_services targets, got %d", len(got))
+	}
+}
+
+func TestJobFileName(t *testing.T) {
+	if got := jobFileName("team/web services"); got != "team_web_services" {
+		t.Errorf("Expected team_web_services, got %s", got)
+	}
+	if got := jobFileName(""); got != "_unknown" {
+		t.Errorf("Expected _unknown, got %s", got)
+	}
+}
@@ -0,0 +1,302 @@
+// Package history archives completed scans in an embedded bbolt database and
+// looks them up by ID or point in time.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// ErrNotFound is returned when no archived scan matches a lookup
+var ErrNotFound = errors.New("scan not found")
+
+// openTimeout is how long Open waits for another process to release the database
+const openTimeout = time.Second
+
+var (
+	// scansBucket maps time keys to scans, in scan order
+	scansBucket = []byte("scans")
+	// idsBucket maps scan IDs to the time keys of scansBucket
+	idsBucket = []byte("ids")
+)
+
+// Config for the scan archive
+type Config struct {
+	// Database file (disabled when empty)
+	Path string
+	// Maximum number of archived scans, older scans are removed first (0: unlimited)
+	MaxScans int
+	// Maximum age of archived scans (0: unlimited)
+	MaxAge time.Duration
+	// Logger of the archive (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Validate checks the retention limits
+func (c Config) Validate() error {
+	if c.MaxScans < 0 {
+		return fmt.Errorf("max scans must not be negative")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max age must not be negative")
+	}
+	return nil
+}
+
+// Scan is an archived scan with the results served after it completed
+type Scan struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Profile whose scan produced this result
+	Profile string             `json:"profile"`
+	Targets []sd.ServiceTarget `json:"targets"`
+	Hosts   []sd.HostInfo      `json:"hosts"`
+}
+
+// Summary describes an archived scan without its results
+type Summary struct {
+	ID            string    `json:"id"`
+	Time          time.Time `json:"time"`
+	Profile       string    `json:"profile"`
+	ServiceGroups int       `json:"service_groups"`
+	Hosts         int       `json:"hosts"`
+}
+
+// Archive stores completed scans with retention limits
+type Archive struct {
+	cfg Config
+	db  *bolt.DB
+	log *slog.Logger
+}
+
+// Open opens or creates the archive database
+func Open(cfg Config) (*Archive, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("history path is required")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(cfg.Path, 0644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scansBucket, idsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s: %w", cfg.Path, err)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	cfg.Logger.Debug("Open: History archive opened", "path", cfg.Path, "max_scans", cfg.MaxScans, "max_age", cfg.MaxAge)
+	return &Archive{cfg: cfg, db: db, log: cfg.Logger}, nil
+}
+
+// Close closes the database
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+// Add archives a scan, assigning its ID, and removes scans beyond the retention limits.
+// Scans must be added in time order.
+func (a *Archive) Add(s Scan) (Scan, error) {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		scans, ids := tx.Bucket(scansBucket), tx.Bucket(idsBucket)
+		seq, err := ids.NextSequence()
+		if err != nil {
+			return err
+		}
+		s.ID = strconv.FormatUint(seq, 10)
+
+		// Keep keys unique and ordered even if two scans share a timestamp
+		key := timeKey(s.Time)
+		if last, _ := scans.Cursor().Last(); last != nil && binary.BigEndian.Uint64(last) >= binary.BigEndian.Uint64(key) {
+			binary.BigEndian.PutUint64(key, binary.BigEndian.Uint64(last)+1)
+		}
+		value, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed to encode scan: %w", err)
+		}
+		if err := scans.Put(key, value); err != nil {
+			return err
+		}
+		if err := ids.Put([]byte(s.ID), key); err != nil {
+			return err
+		}
+		return a.expire(tx, s.Time)
+	})
+	if err != nil {
+		return Scan{}, err
+	}
+	a.log.Debug("Add: Scan archived", "id", s.ID, "profile", s.Profile, "time", s.Time)
+	return s, nil
+}
+
+// expire removes the oldest scans beyond MaxScans and scans older than MaxAge
+func (a *Archive) expire(tx *bolt.Tx, now time.Time) error {
+	scans, ids := tx.Bucket(scansBucket), tx.Bucket(idsBucket)
+	excess := 0
+	if a.cfg.MaxScans > 0 {
+		// Bucket stats do not include the pending writes of this transaction, so count the keys
+		c := scans.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			excess++
+		}
+		excess -= a.cfg.MaxScans
+	}
+	var cutoff []byte
+	if a.cfg.MaxAge > 0 {
+		cutoff = timeKey(now.Add(-a.cfg.MaxAge))
+	}
+
+	c := scans.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if excess <= 0 && (cutoff == nil || binary.BigEndian.Uint64(k) >= binary.BigEndian.Uint64(cutoff)) {
+			break
+		}
+		var s Scan
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("failed to decode scan: %w", err)
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		if err := ids.Delete([]byte(s.ID)); err != nil {
+			return err
+		}
+		excess--
+		a.log.Debug("expire: Removed scan beyond retention", "id", s.ID, "time", s.Time)
+	}
+	return nil
+}
+
+// Get returns the scan with the given ID
+func (a *Archive) Get(id string) (*Scan, error) {
+	var s *Scan
+	err := a.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(idsBucket).Get([]byte(id))
+		if key == nil {
+			return ErrNotFound
+		}
+		var err error
+		s, err = decode(tx.Bucket(scansBucket).Get(key))
+		return err
+	})
+	return s, err
+}
+
+// At returns the results that were served at t: the last scan at or before t
+func (a *Archive) At(t time.Time) (*Scan, error) {
+	var s *Scan
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(scansBucket).Cursor()
+		k, v := c.Seek(timeKey(t))
+		switch {
+		case k == nil:
+			// t is after the last scan
+			_, v = c.Last()
+		case binary.BigEndian.Uint64(k) > binary.BigEndian.Uint64(timeKey(t)):
+			_, v = c.Prev()
+		}
+		if v == nil {
+			return ErrNotFound
+		}
+		var err error
+		s, err = decode(v)
+		return err
+	})
+	return s, err
+}
+
+// List returns the summaries of the archived scans, newest first
+func (a *Archive) List() ([]Summary, error) {
+	summaries := []Summary{}
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(scansBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			s, err := decode(v)
+			if err != nil {
+				return err
+			}
+			summaries = append(summaries, Summary{
+				ID:            s.ID,
+				Time:          s.Time,
+				Profile:       s.Profile,
+				ServiceGroups: len(s.Targets),
+				Hosts:         len(s.Hosts),
+			})
+		}
+		return nil
+	})
+	return summaries, err
+}
+
+// Filter returns a copy of the scan limited to the hosts and targets of ip
+func (s *Scan) Filter(ip string) *Scan {
+	filtered := &Scan{ID: s.ID, Time: s.Time, Profile: s.Profile, Targets: []sd.ServiceTarget{}, Hosts: []sd.HostInfo{}}
+	for _, h := range s.Hosts {
+		if h.IP == ip {
+			filtered.Hosts = append(filtered.Hosts, h)
+		}
+	}
+	for _, st := range s.Targets {
+		var targets []string
+		for _, target := range st.Targets {
+			if targetHost(target) == ip {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) > 0 {
+			filtered.Targets = append(filtered.Targets, sd.ServiceTarget{Targets: targets, Labels: st.Labels})
+		}
+	}
+	return filtered
+}
+
+// targetHost returns the address of a "host:port" or "[addr]:port" target
+func targetHost(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	return host
+}
+
+// decode decodes a stored scan
+func decode(v []byte) (*Scan, error) {
+	var s Scan
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode scan: %w", err)
+	}
+	return &s, nil
+}
+
+// timeKey encodes a time as a big-endian key so keys sort by time.
+// Times before the Unix epoch are clamped to it.
+func timeKey(t time.Time) []byte {
+	nanos := t.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	return key
+}
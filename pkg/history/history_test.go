@@ -0,0 +1,134 @@
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+var base = time.Date(2026, 1, 6, 12, 0, 0, 0, time.UTC)
+
+func testScan(hour int, ips ...string) Scan {
+	s := Scan{Time: base.Add(time.Duration(hour) * time.Hour), Profile: "office"}
+	for _, ip := range ips {
+		s.Hosts = append(s.Hosts, sd.HostInfo{IP: ip, Ports: []sd.PortInfo{{Port: 22, State: "open"}}})
+		s.Targets = append(s.Targets, sd.ServiceTarget{Targets: []string{ip + ":22"}, Labels: map[string]string{"job": "ssh"}})
+	}
+	return s
+}
+
+func openTest(t *testing.T, cfg Config) *Archive {
+	cfg.Path = filepath.Join(t.TempDir(), "history.db")
+	a, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestArchiveLookup(t *testing.T) {
+	a := openTest(t, Config{})
+	var ids []string
+	for i, ips := range [][]string{{"10.0.3.14"}, {"10.0.3.14", "10.0.3.15"}, {"10.0.3.15"}} {
+		s, err := a.Add(testScan(i, ips...))
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		ids = append(ids, s.ID)
+	}
+
+	s, err := a.Get(ids[1])
+	if err != nil || len(s.Hosts) != 2 {
+		t.Fatalf("Get(%s) = %+v, %v", ids[1], s, err)
+	}
+	if _, err := a.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{base, ids[0]},
+		{base.Add(90 * time.Minute), ids[1]},
+		{base.Add(2 * time.Hour), ids[2]},
+		{base.Add(48 * time.Hour), ids[2]},
+	}
+	for _, tt := range tests {
+		s, err := a.At(tt.at)
+		if err != nil || s.ID != tt.want {
+			t.Errorf("At(%v) = %+v, %v, want scan %s", tt.at, s, err, tt.want)
+		}
+	}
+	if _, err := a.At(base.Add(-time.Minute)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound before the first scan, got %v", err)
+	}
+
+	filtered := s.Filter("10.0.3.14")
+	if len(filtered.Hosts) != 1 || len(filtered.Targets) != 1 || filtered.Targets[0].Targets[0] != "10.0.3.14:22" {
+		t.Errorf("Unexpected filtered scan: %+v", filtered)
+	}
+
+	summaries, err := a.List()
+	if err != nil || len(summaries) != 3 || summaries[0].ID != ids[2] || summaries[1].Hosts != 2 {
+		t.Errorf("Unexpected summaries: %+v, %v", summaries, err)
+	}
+}
+
+func TestArchiveRetention(t *testing.T) {
+	t.Run("max scans", func(t *testing.T) {
+		a := openTest(t, Config{MaxScans: 2})
+		for i := 0; i < 4; i++ {
+			if _, err := a.Add(testScan(i, "10.0.0.1")); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+		}
+		summaries, _ := a.List()
+		if len(summaries) != 2 || summaries[1].Time != base.Add(2*time.Hour) {
+			t.Errorf("Expected the two newest scans, got %+v", summaries)
+		}
+		if _, err := a.Get("1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected expired scan to be removed, got %v", err)
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		a := openTest(t, Config{MaxAge: 90 * time.Minute})
+		for i := 0; i < 4; i++ {
+			if _, err := a.Add(testScan(i, "10.0.0.1")); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+		}
+		summaries, _ := a.List()
+		if len(summaries) != 2 || summaries[1].Time != base.Add(2*time.Hour) {
+			t.Errorf("Expected the scans of the last 90 minutes, got %+v", summaries)
+		}
+	})
+}
+
+func TestArchiveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	a, err := Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	first, _ := a.Add(testScan(0, "10.0.0.1"))
+	a.Close()
+
+	a, err = Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer a.Close()
+	second, _ := a.Add(testScan(1, "10.0.0.1"))
+	if second.ID == first.ID {
+		t.Errorf("Expected a new ID after reopening, got %s twice", first.ID)
+	}
+	if _, err := a.Get(first.ID); err != nil {
+		t.Errorf("Expected scan from before reopening, got %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+// Package kube mirrors the discovered targets into Kubernetes as selector-less
+// Services with EndpointSlices, so in-cluster workloads and the Prometheus
+// Operator can address scanned services like any other Service.
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/syncloop"
+)
+
+const (
+	// ManagedByLabel marks the Services and EndpointSlices created by nmap_sd
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel on objects created by nmap_sd
+	ManagedByValue = "nmap_sd"
+	// EndpointSliceManagedBy is the endpointslice.kubernetes.io/managed-by value of the
+	// EndpointSlices, keeping the EndpointSlice controller away from them
+	EndpointSliceManagedBy = "nmap-sd"
+	// JobAnnotation holds the job name of a Service, which may not be a valid label value
+	JobAnnotation = "nmap-sd/job"
+
+	// MaxEndpointsPerSlice is the number of endpoints the API server accepts in an EndpointSlice
+	MaxEndpointsPerSlice = 1000
+
+	// DefaultNamePrefix starts the names of the created Services
+	DefaultNamePrefix = "nmap-sd"
+	// DefaultTimeout bounds a single request to the API server
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetryInterval is the delay before a failed sync is retried
+	DefaultRetryInterval = 30 * time.Second
+)
+
+// Config of the Kubernetes export
+type Config struct {
+	// Namespace the Services and EndpointSlices are created in (disabled when empty)
+	Namespace string
+	// Path of a kubeconfig file, the in-cluster configuration is used when empty
+	Kubeconfig string
+	// Prefix of the Service names (default: DefaultNamePrefix). Only objects with this prefix
+	// and ManagedByLabel are deleted, so instances sharing a namespace must use different prefixes.
+	NamePrefix string
+	// Timeout of a single request to the API server (default: DefaultTimeout)
+	Timeout time.Duration
+	// Delay before a failed sync is retried (default: DefaultRetryInterval)
+	RetryInterval time.Duration
+	// Client used instead of the one built from Kubeconfig, e.g. a fake clientset in tests
+	Client kubernetes.Interface
+	// Logger of the syncer (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Enabled reports whether the targets should be exported
+func (c Config) Enabled() bool {
+	return c.Namespace != ""
+}
+
+// Objects builds the Services and EndpointSlices of the targets: one headless Service per job,
+// named "<prefix>-<job>" with a port per open port, and EndpointSlices per address family and port
+// listing the hosts with that port open, MaxEndpointsPerSlice at most in each and numbered from 0,
+// e.g. "<prefix>-<job>-ipv4-9100-0". Labels shared by all targets of a job that are valid
+// Kubernetes labels and do not start with "__" are added to its Service.
+// Targets whose host is not an IP address are skipped.
+func Objects(targets []sd.ServiceTarget, namespace, namePrefix string) ([]corev1.Service, []discoveryv1.EndpointSlice) {
+	return objects(slog.Default(), targets, namespace, namePrefix)
+}
+
+// objects is Objects logging to log
+func objects(log *slog.Logger, targets []sd.ServiceTarget, namespace, namePrefix string) ([]corev1.Service, []discoveryv1.EndpointSlice) {
+	type job struct {
+		name      string
+		labels    map[string]string
+		portNames map[int32]string
+		// addresses per address type and port
+		addresses map[discoveryv1.AddressType]map[int32][]string
+	}
+	jobs := make(map[string]*job)
+	for _, st := range targets {
+		name := st.Labels["job"]
+		if name == "" {
+			name = ManagedByValue
+		}
+		j, ok := jobs[name]
+		if !ok {
+			j = &job{name: name, labels: serviceLabels(st.Labels), portNames: make(map[int32]string), addresses: make(map[discoveryv1.AddressType]map[int32][]string)}
+			jobs[name] = j
+		} else {
+			for k, v := range j.labels {
+				if k != ManagedByLabel && st.Labels[k] != v {
+					delete(j.labels, k)
+				}
+			}
+		}
+		for _, target := range st.Targets {
+			host, portStr, err := net.SplitHostPort(target)
+			port, portErr := strconv.ParseInt(portStr, 10, 32)
+			ip := net.ParseIP(host)
+			if err != nil || portErr != nil || port < 1 || port > 65535 || ip == nil {
+				log.Debug("Objects: Skipping target without IP address and port", "target", target)
+				continue
+			}
+			addressType := discoveryv1.AddressTypeIPv6
+			if ip.To4() != nil {
+				addressType = discoveryv1.AddressTypeIPv4
+			}
+			if j.addresses[addressType] == nil {
+				j.addresses[addressType] = make(map[int32][]string)
+			}
+			j.addresses[addressType][int32(port)] = append(j.addresses[addressType][int32(port)], ip.String())
+			if _, ok := j.portNames[int32(port)]; !ok {
+				j.portNames[int32(port)] = st.Labels[sd.MetaLabelPortName]
+			}
+		}
+	}
+
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var services []corev1.Service
+	var slices []discoveryv1.EndpointSlice
+	seen := make(map[string]bool)
+	for _, name := range names {
+		j := jobs[name]
+		if len(j.portNames) == 0 {
+			continue
+		}
+		svcName := objectName(namePrefix, name)
+		if seen[svcName] {
+			log.Debug("Objects: Skipping job with a conflicting Service name", "job", name, "service", svcName)
+			continue
+		}
+		seen[svcName] = true
+
+		portNames := uniquePortNames(j.portNames)
+		svc := corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        svcName,
+				Namespace:   namespace,
+				Labels:      j.labels,
+				Annotations: map[string]string{JobAnnotation: name},
+			},
+			// Headless, the endpoints are addressed directly and no cluster IP is allocated
+			Spec: corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone},
+		}
+		for _, port := range sortedPorts(j.portNames) {
+			svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+				Name:       portNames[port],
+				Protocol:   corev1.ProtocolTCP,
+				Port:       port,
+				TargetPort: intstr.FromInt32(port),
+			})
+		}
+		services = append(services, svc)
+
+		for _, addressType := range []discoveryv1.AddressType{discoveryv1.AddressTypeIPv4, discoveryv1.AddressTypeIPv6} {
+			for _, port := range sortedPorts(j.addresses[addressType]) {
+				var endpoints []discoveryv1.Endpoint
+				addresses := j.addresses[addressType][port]
+				sort.Strings(addresses)
+				for i, address := range addresses {
+					if i > 0 && address == addresses[i-1] {
+						continue
+					}
+					endpoints = append(endpoints, discoveryv1.Endpoint{
+						Addresses:  []string{address},
+						Conditions: discoveryv1.EndpointConditions{Ready: ptr(true)},
+					})
+				}
+				for i := 0; i*MaxEndpointsPerSlice < len(endpoints); i++ {
+					slices = append(slices, discoveryv1.EndpointSlice{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      fmt.Sprintf("%s-%s-%d-%d", svcName, strings.ToLower(string(addressType)), port, i),
+							Namespace: namespace,
+							Labels: map[string]string{
+								ManagedByLabel:               ManagedByValue,
+								discoveryv1.LabelServiceName: svcName,
+								discoveryv1.LabelManagedBy:   EndpointSliceManagedBy,
+							},
+						},
+						AddressType: addressType,
+						Ports: []discoveryv1.EndpointPort{{
+							Name:     ptr(portNames[port]),
+							Protocol: ptr(corev1.ProtocolTCP),
+							Port:     ptr(port),
+						}},
+						Endpoints: endpoints[i*MaxEndpointsPerSlice : min((i+1)*MaxEndpointsPerSlice, len(endpoints))],
+					})
+				}
+			}
+		}
+	}
+	return services, slices
+}
+
+// serviceLabels returns the labels of a target usable as Service labels, along with ManagedByLabel
+func serviceLabels(labels map[string]string) map[string]string {
+	result := map[string]string{ManagedByLabel: ManagedByValue}
+	for name, value := range labels {
+		if name == "job" || strings.HasPrefix(name, "__") || name == ManagedByLabel {
+			continue
+		}
+		if len(validation.IsQualifiedName(name)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// objectName returns the Service name of a job, a DNS label of at most 63 characters
+func objectName(prefix, job string) string {
+	name := strings.Trim(prefix+"-"+dnsLabel(job), "-")
+	if len(name) > validation.DNS1035LabelMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1035LabelMaxLength], "-")
+	}
+	return name
+}
+
+// uniquePortNames turns the configured port names into unique DNS labels, falling back to "port-<port>"
+func uniquePortNames(names map[int32]string) map[int32]string {
+	result := make(map[int32]string, len(names))
+	used := make(map[string]bool)
+	for _, port := range sortedPorts(names) {
+		name := strings.Trim(dnsLabel(names[port]), "-")
+		if len(validation.IsDNS1123Label(name)) > 0 || used[name] {
+			name = "port-" + strconv.Itoa(int(port))
+		}
+		used[name] = true
+		result[port] = name
+	}
+	return result
+}
+
+// dnsLabel lowercases s and replaces the characters not allowed in DNS labels
+func dnsLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// sortedPorts returns the keys of m in ascending order
+func sortedPorts[V any](m map[int32]V) []int32 {
+	ports := make([]int32, 0, len(m))
+	for port := range m {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, k int) bool { return ports[i] < ports[k] })
+	return ports
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Syncer keeps the Services and EndpointSlices in the namespace in line with the latest targets
+type Syncer struct {
+	cfg    Config
+	client kubernetes.Interface
+	log    *slog.Logger
+	loop   *syncloop.Loop[[]sd.ServiceTarget]
+}
+
+// New validates the configuration and creates a Syncer. Run must be started to sync updates.
+func New(cfg Config) (*Syncer, error) {
+	if errs := validation.IsDNS1123Label(cfg.Namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid namespace %q: %s", cfg.Namespace, strings.Join(errs, ", "))
+	}
+	if cfg.NamePrefix == "" {
+		cfg.NamePrefix = DefaultNamePrefix
+	}
+	if errs := validation.IsDNS1035Label(cfg.NamePrefix); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid name prefix %q: %s", cfg.NamePrefix, strings.Join(errs, ", "))
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	client := cfg.Client
+	if client == nil {
+		var err error
+		if client, err = newClient(cfg.Kubeconfig, cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Logger.Debug("kube.New: Created Kubernetes syncer", "namespace", cfg.Namespace, "name_prefix", cfg.NamePrefix)
+	s := &Syncer{cfg: cfg, client: client, log: cfg.Logger}
+	s.loop = syncloop.New("kubernetes", s.Sync, cfg.RetryInterval, cfg.Logger.With("namespace", cfg.Namespace))
+	return s, nil
+}
+
+// newClient creates a client from the kubeconfig file, or the in-cluster configuration when empty
+func newClient(kubeconfig string, timeout time.Duration) (kubernetes.Interface, error) {
+	var restCfg *rest.Config
+	var err error
+	if kubeconfig == "" {
+		restCfg, err = rest.InClusterConfig()
+	} else {
+		restCfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client configuration: %w", err)
+	}
+	restCfg.Timeout = timeout
+	restCfg.UserAgent = ManagedByValue
+	return kubernetes.NewForConfig(restCfg)
+}
+
+// Update hands the latest targets to Run. Targets not synced yet are replaced.
+func (s *Syncer) Update(targets []sd.ServiceTarget) {
+	s.loop.Update(targets)
+}
+
+// Run syncs the targets of every Update until ctx is done, retrying failed syncs
+func (s *Syncer) Run(ctx context.Context) {
+	s.loop.Run(ctx)
+}
+
+// Sync creates or updates the Services and EndpointSlices of the targets and deletes the
+// ones created by this Syncer whose jobs, address families or ports disappeared
+func (s *Syncer) Sync(ctx context.Context, targets []sd.ServiceTarget) error {
+	selector := metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + ManagedByValue}
+	services := s.client.CoreV1().Services(s.cfg.Namespace)
+	slices := s.client.DiscoveryV1().EndpointSlices(s.cfg.Namespace)
+
+	svcList, err := services.List(ctx, selector)
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	sliceList, err := slices.List(ctx, selector)
+	if err != nil {
+		return fmt.Errorf("failed to list endpoint slices: %w", err)
+	}
+	managedServices := make(map[string]corev1.Service)
+	for _, svc := range svcList.Items {
+		if strings.HasPrefix(svc.Name, s.cfg.NamePrefix+"-") {
+			managedServices[svc.Name] = svc
+		}
+	}
+	managedSlices := make(map[string]discoveryv1.EndpointSlice)
+	for _, slice := range sliceList.Items {
+		if strings.HasPrefix(slice.Name, s.cfg.NamePrefix+"-") {
+			managedSlices[slice.Name] = slice
+		}
+	}
+
+	var errs []error
+	applied, deleted := 0, 0
+	wantedServices, wantedSlices := objects(s.log, targets, s.cfg.Namespace, s.cfg.NamePrefix)
+	for _, svc := range wantedServices {
+		existing, ok := managedServices[svc.Name]
+		delete(managedServices, svc.Name)
+		switch {
+		case !ok:
+			_, err = services.Create(ctx, &svc, metav1.CreateOptions{})
+		case equality.Semantic.DeepEqual(existing.Labels, svc.Labels) &&
+			equality.Semantic.DeepEqual(existing.Annotations, svc.Annotations) &&
+			equality.Semantic.DeepEqual(existing.Spec.Ports, svc.Spec.Ports):
+			continue
+		default:
+			// Keep the fields set by the API server, such as the cluster IP
+			updated := existing.DeepCopy()
+			updated.Labels, updated.Annotations, updated.Spec.Ports = svc.Labels, svc.Annotations, svc.Spec.Ports
+			_, err = services.Update(ctx, updated, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("apply service %s: %w", svc.Name, err))
+			continue
+		}
+		applied++
+	}
+	for _, slice := range wantedSlices {
+		existing, ok := managedSlices[slice.Name]
+		delete(managedSlices, slice.Name)
+		switch {
+		case !ok:
+			_, err = slices.Create(ctx, &slice, metav1.CreateOptions{})
+		case equality.Semantic.DeepEqual(existing.Labels, slice.Labels) &&
+			equality.Semantic.DeepEqual(existing.Ports, slice.Ports) &&
+			equality.Semantic.DeepEqual(existing.Endpoints, slice.Endpoints):
+			continue
+		default:
+			slice.ResourceVersion = existing.ResourceVersion
+			_, err = slices.Update(ctx, &slice, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("apply endpoint slice %s: %w", slice.Name, err))
+			continue
+		}
+		applied++
+	}
+
+	// EndpointSlices first, so no slice is left behind pointing to a deleted Service
+	for name := range managedSlices {
+		if err := slices.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("delete endpoint slice %s: %w", name, err))
+			continue
+		}
+		deleted++
+	}
+	for name := range managedServices {
+		if err := services.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("delete service %s: %w", name, err))
+			continue
+		}
+		deleted++
+	}
+
+	s.log.Debug("Sync: Kubernetes objects synced", "namespace", s.cfg.Namespace, "services", len(wantedServices), "endpoint_slices", len(wantedSlices), "applied", applied, "deleted", deleted, "errors", len(errs))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,180 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func target(addr, job, portName string, labels map[string]string) sd.ServiceTarget {
+	l := map[string]string{"job": job, sd.MetaLabelPortName: portName}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return sd.ServiceTarget{Targets: []string{addr}, Labels: l}
+}
+
+func TestObjects(t *testing.T) {
+	services, endpointSlices := Objects([]sd.ServiceTarget{
+		target("10.0.0.1:9100", "node_exporter", "node_exporter", map[string]string{"team": "infra", "env": "prod"}),
+		target("10.0.0.2:9100", "node_exporter", "node_exporter", map[string]string{"team": "infra", "env": "dev"}),
+		target("10.0.0.2:9101", "node_exporter", "", map[string]string{"team": "infra", "bad label": "x"}),
+		target("[2001:db8::1]:9100", "node_exporter", "node_exporter", map[string]string{"team": "infra"}),
+		target("db.example.com:5432", "postgres", "", nil),
+	}, "monitoring", "nmap-sd")
+
+	if len(services) != 1 {
+		t.Fatalf("Expected one service, got %d", len(services))
+	}
+	svc := services[0]
+	if svc.Name != "nmap-sd-node-exporter" || svc.Namespace != "monitoring" || svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("Unexpected service: %+v", svc.ObjectMeta)
+	}
+	wantLabels := map[string]string{ManagedByLabel: ManagedByValue, "team": "infra"}
+	if len(svc.Labels) != len(wantLabels) || svc.Labels["team"] != "infra" || svc.Labels[ManagedByLabel] != ManagedByValue {
+		t.Errorf("Expected only the shared labels on the service, got %v", svc.Labels)
+	}
+	if svc.Annotations[JobAnnotation] != "node_exporter" {
+		t.Errorf("Expected the job annotation, got %v", svc.Annotations)
+	}
+	if len(svc.Spec.Ports) != 2 || svc.Spec.Ports[0].Name != "node-exporter" || svc.Spec.Ports[0].Port != 9100 || svc.Spec.Ports[1].Name != "port-9101" {
+		t.Errorf("Unexpected service ports: %+v", svc.Spec.Ports)
+	}
+
+	var names []string
+	for _, slice := range endpointSlices {
+		names = append(names, slice.Name)
+		if slice.Labels[discoveryv1.LabelServiceName] != svc.Name || slice.Labels[discoveryv1.LabelManagedBy] != EndpointSliceManagedBy {
+			t.Errorf("Unexpected labels on %s: %v", slice.Name, slice.Labels)
+		}
+	}
+	want := []string{"nmap-sd-node-exporter-ipv4-9100-0", "nmap-sd-node-exporter-ipv4-9101-0", "nmap-sd-node-exporter-ipv6-9100-0"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("Expected endpoint slices %v, got %v", want, names)
+	}
+	ipv4 := endpointSlices[0]
+	if ipv4.AddressType != discoveryv1.AddressTypeIPv4 || len(ipv4.Endpoints) != 2 || ipv4.Endpoints[0].Addresses[0] != "10.0.0.1" || *ipv4.Ports[0].Name != "node-exporter" {
+		t.Errorf("Unexpected IPv4 endpoint slice: %+v", ipv4)
+	}
+	if ipv6 := endpointSlices[2]; ipv6.AddressType != discoveryv1.AddressTypeIPv6 || ipv6.Endpoints[0].Addresses[0] != "2001:db8::1" {
+		t.Errorf("Unexpected IPv6 endpoint slice: %+v", ipv6)
+	}
+}
+
+func TestObjectsSplitsEndpointSlices(t *testing.T) {
+	var targets []sd.ServiceTarget
+	for i := range 2*MaxEndpointsPerSlice + 1 {
+		targets = append(targets, target(fmt.Sprintf("10.%d.%d.1:9100", i/256, i%256), "node", "node", nil))
+	}
+	_, endpointSlices := Objects(targets, "monitoring", "nmap-sd")
+
+	var names []string
+	var sizes []int
+	for _, slice := range endpointSlices {
+		names = append(names, slice.Name)
+		sizes = append(sizes, len(slice.Endpoints))
+	}
+	if want := []string{"nmap-sd-node-ipv4-9100-0", "nmap-sd-node-ipv4-9100-1", "nmap-sd-node-ipv4-9100-2"}; !slices.Equal(names, want) {
+		t.Fatalf("Expected endpoint slices %v, got %v", want, names)
+	}
+	if want := []int{MaxEndpointsPerSlice, MaxEndpointsPerSlice, 1}; !slices.Equal(sizes, want) {
+		t.Errorf("Expected %v endpoints per slice, got %v", want, sizes)
+	}
+}
+
+func TestSync(t *testing.T) {
+	foreign := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "nmap-sd-unmanaged", Namespace: "monitoring"}}
+	other := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name: "other-web", Namespace: "monitoring", Labels: map[string]string{ManagedByLabel: ManagedByValue},
+	}}
+	client := fake.NewClientset(foreign, other)
+	s, err := New(Config{Namespace: "monitoring", Client: client})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx := context.Background()
+
+	serviceNames := func() []string {
+		list, err := client.CoreV1().Services("monitoring").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		var names []string
+		for _, svc := range list.Items {
+			names = append(names, svc.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	slice := func(name string) *discoveryv1.EndpointSlice {
+		slice, err := client.DiscoveryV1().EndpointSlices("monitoring").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		return slice
+	}
+
+	if err := s.Sync(ctx, []sd.ServiceTarget{
+		target("10.0.0.1:80", "web", "http", nil),
+		target("10.0.0.1:9100", "node", "node", nil),
+	}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if got := serviceNames(); !slices.Equal(got, []string{"nmap-sd-node", "nmap-sd-unmanaged", "nmap-sd-web", "other-web"}) {
+		t.Errorf("Unexpected services after the first sync: %v", got)
+	}
+	if slice("nmap-sd-web-ipv4-80-0") == nil || slice("nmap-sd-node-ipv4-9100-0") == nil {
+		t.Fatal("Expected endpoint slices for both jobs")
+	}
+
+	// Changed endpoints update the slice, disappeared jobs are deleted along with their slices
+	if err := s.Sync(ctx, []sd.ServiceTarget{
+		target("10.0.0.1:80", "web", "http", nil),
+		target("10.0.0.2:80", "web", "http", nil),
+	}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if got := serviceNames(); !slices.Equal(got, []string{"nmap-sd-unmanaged", "nmap-sd-web", "other-web"}) {
+		t.Errorf("Unexpected services after the second sync: %v", got)
+	}
+	if slice("nmap-sd-node-ipv4-9100-0") != nil {
+		t.Error("Expected the endpoint slice of the disappeared job to be deleted")
+	}
+	if web := slice("nmap-sd-web-ipv4-80-0"); web == nil || len(web.Endpoints) != 2 {
+		t.Errorf("Expected the endpoint slice to list both hosts, got %+v", web)
+	}
+
+	// Unchanged objects are not written again
+	client.ClearActions()
+	if err := s.Sync(ctx, []sd.ServiceTarget{
+		target("10.0.0.2:80", "web", "http", nil),
+		target("10.0.0.1:80", "web", "http", nil),
+	}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "list" {
+			t.Errorf("Unexpected %s of %s for unchanged targets", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"namespace":   {Namespace: "Monitoring"},
+		"name prefix": {Namespace: "monitoring", NamePrefix: "1nmap"},
+	} {
+		cfg.Client = fake.NewClientset()
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected an invalid %s to be rejected", name)
+		}
+	}
+}
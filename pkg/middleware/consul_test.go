@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/consul"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// memRegistrar is a consul.Registrar keeping the services in memory
+type memRegistrar struct {
+	mu       sync.Mutex
+	services map[string]consul.Service
+}
+
+func (m *memRegistrar) Services(ctx context.Context) ([]consul.Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var services []consul.Service
+	for _, s := range m.services {
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+func (m *memRegistrar) Register(ctx context.Context, s consul.Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.services[s.ID] = s
+	return nil
+}
+
+func (m *memRegistrar) Deregister(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.services, id)
+	return nil
+}
+
+func (m *memRegistrar) ids() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id := range m.services {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestConsulRegistration(t *testing.T) {
+	registrar := &memRegistrar{services: make(map[string]consul.Service)}
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {
+			{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+			{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+		},
+		"10.0.1.0/24": {{IP: "10.0.1.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	cfg := Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "web", Labels: map[string]string{"team": "infra"}}},
+		Scanner: scanner,
+		Consul:  consul.Config{Registrar: registrar},
+	}
+	nsd, err := NewNmapSD(cfg)
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+
+	want := []string{"nmap-sd-web-10.0.0.1-80", "nmap-sd-web-10.0.0.2-80"}
+	waitFor(t, "registration", func() bool { return slices.Equal(registrar.ids(), want) })
+	registrar.mu.Lock()
+	s := registrar.services[want[0]]
+	registrar.mu.Unlock()
+	if s.Name != "web" || !slices.Equal(s.Tags, []string{"web", "team=infra"}) || s.Address != "10.0.0.1" || s.Port != 80 {
+		t.Errorf("Unexpected service: %+v", s)
+	}
+
+	// Targets that disappear after a scan are deregistered
+	cfg.Targets = []string{"10.0.1.0/24"}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+	waitFor(t, "deregistration", func() bool {
+		return slices.Equal(registrar.ids(), []string{"nmap-sd-web-10.0.1.1-80"})
+	})
+}
+
+func TestConsulLogger(t *testing.T) {
+	var logs logBuffer
+	nsd, err := NewNmapSD(Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "web"}},
+		Scanner: &staticScanner{hosts: map[string][]sd.HostInfo{
+			"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		}},
+		LogLevel: "DEBUG",
+		Logger:   slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Consul:   consul.Config{Registrar: &memRegistrar{services: make(map[string]consul.Service)}},
+	})
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+
+	var msgs []string
+	waitFor(t, "Consul sync log", func() bool {
+		for _, record := range logs.records(t) {
+			msgs = append(msgs, record["msg"].(string))
+		}
+		return slices.Contains(msgs, "Sync: Consul services synced")
+	})
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/dnssd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func TestDNSServer(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Hostname: "web-01", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	cfg := Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "web"}},
+		Scanner: scanner,
+		DNS:     dnssd.Config{Addr: "127.0.0.1:0", Zone: "sd.test"},
+	}
+	nsd, err := NewNmapSD(cfg)
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	nsd.dataMutex.RLock()
+	addr := nsd.dns.Addr().String()
+	nsd.dataMutex.RUnlock()
+	m := new(dns.Msg)
+	m.SetQuestion("_web._tcp.sd.test.", dns.TypeSRV)
+	resp, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("SRV query failed: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Unexpected SRV response: %v", resp)
+	}
+	if srv := resp.Answer[0].(*dns.SRV); srv.Target != "web-01.sd.test." || srv.Port != 80 {
+		t.Errorf("Unexpected SRV record: %v", srv)
+	}
+
+	// Reloading with the same DNS configuration keeps the server
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	nsd.dataMutex.RLock()
+	sameAddr := nsd.dns.Addr().String() == addr
+	nsd.dataMutex.RUnlock()
+	if !sameAddr {
+		t.Error("Expected the DNS server to keep running across reloads")
+	}
+
+	// A zone change keeps the sockets
+	cfg.DNS.Zone = "other.test"
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	m.SetQuestion("_web._tcp.other.test.", dns.TypeSRV)
+	if resp, err := dns.Exchange(m, addr); err != nil || len(resp.Answer) != 1 {
+		t.Errorf("Expected the records in the new zone on the same address, got %v (%v)", resp, err)
+	}
+
+	// A new address that cannot be bound keeps the running server and its configuration
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	running := cfg.DNS
+	running.Logger = nsd.log
+	cfg.DNS.Addr = busy.LocalAddr().String()
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	nsd.dataMutex.RLock()
+	kept := nsd.dns != nil && nsd.dns.Addr().String() == addr && nsd.dnsCfg == running
+	nsd.dataMutex.RUnlock()
+	if !kept {
+		t.Error("Expected the DNS server to keep running when the new address cannot be bound")
+	}
+	if _, err := dns.Exchange(m, addr); err != nil {
+		t.Errorf("Expected the running server to keep answering: %v", err)
+	}
+
+	cfg.DNS = dnssd.Config{}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, err := dns.Exchange(m, addr); err == nil {
+		t.Error("Expected the DNS server to stop when disabled")
+	}
+}
+
+func TestDNSServerBindError(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, err = NewNmapSD(Config{
+		Targets: []string{"10.0.0.0/24"},
+		Scanner: &staticScanner{},
+		DNS:     dnssd.Config{Addr: busy.LocalAddr().String()},
+	})
+	if err == nil {
+		t.Error("Expected NewNmapSD to fail when the DNS address cannot be bound")
+	}
+}
+
+func TestDNSLogger(t *testing.T) {
+	var logs logBuffer
+	nsd, err := NewNmapSD(Config{
+		Targets:  []string{"10.0.0.0/24"},
+		Scanner:  &staticScanner{},
+		LogLevel: "DEBUG",
+		Logger:   slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		DNS:      dnssd.Config{Addr: "127.0.0.1:0", Zone: "sd.test"},
+	})
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+
+	nsd.dataMutex.RLock()
+	addr := nsd.dns.Addr().String()
+	nsd.dataMutex.RUnlock()
+	m := new(dns.Msg)
+	m.SetQuestion("sd.test.", dns.TypeSOA)
+	if _, err := dns.Exchange(m, addr); err != nil {
+		t.Fatalf("SOA query failed: %v", err)
+	}
+	var msgs []string
+	for _, record := range logs.records(t) {
+		msgs = append(msgs, record["msg"].(string))
+	}
+	if !slices.Contains(msgs, "ServeDNS: Answering query") {
+		t.Errorf("Expected the DNS server to log to the injected logger, got %v", msgs)
+	}
+}
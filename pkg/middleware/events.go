@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Server-Sent Events published on the events endpoint
+const (
+	// EventScanStarted is sent with a ScanEvent when a profile scan starts
+	EventScanStarted = "scan_started"
+	// EventScanCompleted is sent with a ScanEvent when a profile scan finishes or fails
+	EventScanCompleted = "scan_completed"
+	// EventTargetsChanged is sent with the sd.ScanDiff when the served results change
+	EventTargetsChanged = "targets_changed"
+)
+
+// EventsPathSuffix is appended to the scan path to form the events endpoint
+const EventsPathSuffix = "/events"
+
+// eventKeepAlive is how often a comment is sent on idle event streams
+const eventKeepAlive = 30 * time.Second
+
+// eventBufferSize is the number of events buffered per subscriber before events are dropped
+const eventBufferSize = 16
+
+// ScanEvent is the payload of scan_started and scan_completed events
+type ScanEvent struct {
+	Profile string    `json:"profile"`
+	Time    time.Time `json:"time"`
+	// ID of the scan, the scan_id attribute of its log messages
+	ScanID string `json:"scan_id,omitempty"`
+	// Duration of the scan, set on scan_completed
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// Size of the published result and number of changes, set on successful scans
+	ServiceGroups int `json:"service_groups,omitempty"`
+	Hosts         int `json:"hosts,omitempty"`
+	Changes       int `json:"changes,omitempty"`
+	// Error of a failed scan
+	Error string `json:"error,omitempty"`
+}
+
+// event is a published Server-Sent Event
+type event struct {
+	id   uint64
+	name string
+	data any
+}
+
+// eventBroker fans events out to the connected event streams.
+// The zero value is ready to use and logs nothing.
+type eventBroker struct {
+	log         *slog.Logger
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[chan event]struct{}
+}
+
+// subscribe registers a new event stream and returns its channel and an unsubscribe function
+func (b *eventBroker) subscribe() (<-chan event, func()) {
+	ch := make(chan event, eventBufferSize)
+	b.mu.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan event]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends an event to all subscribers, dropping it for subscribers that fall behind
+func (b *eventBroker) publish(name string, data any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	ev := event{id: b.nextID, name: name, data: data}
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			if b.log != nil {
+				b.log.Debug("publish: Event stream falling behind, dropping event", "event", name, "id", ev.id)
+			}
+		}
+	}
+}
+
+// handleEvents streams scan events to the client until it disconnects or the instance stops
+func (n *NmapSD) handleEvents(c *gin.Context) {
+	events, unsubscribe := n.events.subscribe()
+	defer unsubscribe()
+	n.log.Debug("handleEvents: Event stream connected", "remote", c.ClientIP())
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Disable response buffering in nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			n.log.Debug("handleEvents: Event stream disconnected", "remote", c.ClientIP())
+			return false
+		case <-n.ctx.Done():
+			return false
+		case ev := <-events:
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(ev.id, 10), Event: ev.name, Data: ev.data})
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ":\n\n")
+			return err == nil
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent is an event read from an event stream
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents parses the Server-Sent Events of a response body onto a channel
+func readEvents(resp *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var ev sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev.name != "" {
+					events <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "event:"):
+				ev.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				ev.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			}
+		}
+	}()
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	profile := &profileState{ScanProfile: ScanProfile{
+		Name:    DefaultProfileName,
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		scanPath:    "/mgsd",
+		profiles:    []*profileState{profile},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	r := gin.New()
+	r.GET("/mgsd/events", nsd.handleEvents)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	reqCtx, stopStream := context.WithCancel(context.Background())
+	defer stopStream()
+	req, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, srv.URL+"/mgsd/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect to event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+	events := readEvents(resp)
+
+	nsd.performScan(profile)
+	scanner.hosts["10.0.0.0/24"] = append(scanner.hosts["10.0.0.0/24"], sd.HostInfo{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}})
+	nsd.performScan(profile)
+
+	want := []string{EventScanStarted, EventScanCompleted, EventScanStarted, EventTargetsChanged, EventScanCompleted}
+	var got []sseEvent
+	for range want {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %+v", got)
+		}
+	}
+	for i, name := range want {
+		if got[i].name != name {
+			t.Errorf("Event %d: expected %s, got %s", i, name, got[i].name)
+		}
+	}
+
+	var completed ScanEvent
+	if err := json.Unmarshal([]byte(got[4].data), &completed); err != nil {
+		t.Fatalf("Failed to decode scan_completed: %v", err)
+	}
+	if completed.Profile != DefaultProfileName || completed.ServiceGroups != 2 || completed.Hosts != 2 || completed.Changes != 3 {
+		t.Errorf("Unexpected scan_completed payload: %+v", completed)
+	}
+
+	var diff sd.ScanDiff
+	if err := json.Unmarshal([]byte(got[3].data), &diff); err != nil {
+		t.Fatalf("Failed to decode targets_changed: %v", err)
+	}
+	if len(diff.Changes) != 3 || diff.Changes[2].Target != "10.0.0.2:80" {
+		t.Errorf("Unexpected targets_changed payload: %+v", diff)
+	}
+}
+
+func TestEventBrokerUnsubscribe(t *testing.T) {
+	var b eventBroker
+	events, unsubscribe := b.subscribe()
+	b.publish(EventScanStarted, ScanEvent{Profile: "office"})
+	if ev := <-events; ev.name != EventScanStarted || ev.id != 1 {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+
+	unsubscribe()
+	b.publish(EventScanStarted, ScanEvent{Profile: "office"})
+	select {
+	case ev := <-events:
+		t.Errorf("Expected no event after unsubscribe, got %+v", ev)
+	default:
+	}
+}
+
+func TestScanEventCountsProfileHosts(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		"10.0.1.0/24": {
+			{IP: "10.0.1.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+			{IP: "10.0.1.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+		},
+	}}
+	ports := []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}}
+	office := &profileState{ScanProfile: ScanProfile{Name: "office", Targets: []string{"10.0.0.0/24"}, Ports: ports}}
+	lab := &profileState{ScanProfile: ScanProfile{Name: "lab", Targets: []string{"10.0.1.0/24"}, Ports: ports}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		profiles:    []*profileState{office, lab},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	events, unsubscribe := nsd.events.subscribe()
+	defer unsubscribe()
+
+	nsd.performScan(lab)
+	nsd.performScan(office)
+	var completed []ScanEvent
+	for len(completed) < 2 {
+		select {
+		case ev := <-events:
+			if ev.name == EventScanCompleted {
+				completed = append(completed, ev.data.(ScanEvent))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for scan_completed events")
+		}
+	}
+	if completed[0].Hosts != 2 || completed[1].Hosts != 1 {
+		t.Errorf("Expected the hosts of the scanned profile only, got %d and %d", completed[0].Hosts, completed[1].Hosts)
+	}
+}
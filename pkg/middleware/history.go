@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HistoryPathSuffix is appended to the scan path to form the history endpoints:
+// ScanPath + "/history" lists the archived scans or looks one up with ?at=<time>,
+// ScanPath + "/history/<id>" returns a single scan. Both accept ?ip= to filter by host.
+const HistoryPathSuffix = "/history"
+
+// openHistory replaces the scan archive if its configuration changed.
+// The caller must hold publishMutex.
+func (n *NmapSD) openHistory(cfg history.Config) {
+	n.dataMutex.RLock()
+	current, currentCfg := n.history, n.historyCfg
+	n.dataMutex.RUnlock()
+	if current != nil && cfg == currentCfg {
+		return
+	}
+
+	var archive *history.Archive
+	if cfg.Path != "" {
+		var err error
+		if archive, err = history.Open(cfg); err != nil {
+			n.log.Error("Failed to open history archive, scans are not archived", "path", cfg.Path, "error", err)
+		} else {
+			n.log.Debug("openHistory: History archive enabled", "path", cfg.Path, "max_scans", cfg.MaxScans, "max_age", cfg.MaxAge)
+		}
+	}
+
+	n.dataMutex.Lock()
+	n.history, n.historyCfg = archive, cfg
+	n.dataMutex.Unlock()
+	if current != nil {
+		if err := current.Close(); err != nil {
+			n.log.Error("Failed to close history archive", "error", err)
+		}
+	}
+}
+
+// closeHistory closes the scan archive
+func (n *NmapSD) closeHistory() {
+	n.dataMutex.Lock()
+	archive := n.history
+	n.history = nil
+	n.dataMutex.Unlock()
+	if archive != nil {
+		if err := archive.Close(); err != nil {
+			n.log.Error("Failed to close history archive", "error", err)
+		}
+	}
+}
+
+// recordHistory archives the results published after a scan of profile if the archive is enabled.
+// The caller must hold publishMutex so scans are archived in publication order.
+func recordHistory(log *slog.Logger, archive *history.Archive, profile string, data []sd.ServiceTarget, hostInfo []sd.HostInfo) {
+	if archive == nil {
+		return
+	}
+	scan, err := archive.Add(history.Scan{Time: time.Now(), Profile: profile, Targets: data, Hosts: hostInfo})
+	if err != nil {
+		log.Error("Failed to archive scan", "profile", profile, "error", err)
+		return
+	}
+	log.Debug("recordHistory: Scan archived", "id", scan.ID, "profile", profile)
+}
+
+// handleHistory serves the history endpoints, id is empty for the history path itself
+func (n *NmapSD) handleHistory(c *gin.Context, id string) {
+	n.dataMutex.RLock()
+	archive := n.history
+	n.dataMutex.RUnlock()
+	if archive == nil {
+		n.log.Debug("handleHistory: History archive disabled")
+		c.JSON(404, gin.H{"error": "scan history is not enabled"})
+		return
+	}
+
+	var scan *history.Scan
+	var err error
+	at := c.Query("at")
+	switch {
+	case id != "":
+		n.log.Debug("handleHistory: Looking up scan by ID", "id", id)
+		scan, err = archive.Get(id)
+	case at != "":
+		t, parseErr := parseTime(at)
+		if parseErr != nil {
+			c.JSON(400, gin.H{"error": parseErr.Error()})
+			return
+		}
+		n.log.Debug("handleHistory: Looking up scan by time", "at", t)
+		scan, err = archive.At(t)
+	default:
+		summaries, err := archive.List()
+		if err != nil {
+			n.log.Error("Failed to list archived scans", "error", err)
+			c.JSON(500, gin.H{"error": "failed to read scan history"})
+			return
+		}
+		n.log.Debug("handleHistory: Returning archived scans", "count", len(summaries))
+		c.JSON(200, summaries)
+		return
+	}
+
+	if errors.Is(err, history.ErrNotFound) {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		n.log.Error("Failed to read archived scan", "error", err)
+		c.JSON(500, gin.H{"error": "failed to read scan history"})
+		return
+	}
+	if ip := c.Query("ip"); ip != "" {
+		scan = scan.Filter(ip)
+	}
+	c.JSON(200, scan)
+}
+
+// parseTime parses an RFC 3339 timestamp, a date or Unix seconds
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		// A date refers to the state at the end of that day
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, errors.New("invalid at parameter, expected an RFC 3339 timestamp, a date (2006-01-02) or Unix seconds")
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHistoryEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.3.0/24": {{IP: "10.0.3.14", Ports: []sd.PortInfo{{Port: 22, State: "open"}}}},
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	nsd.publishMutex.Lock()
+	nsd.openHistory(history.Config{Path: filepath.Join(t.TempDir(), "history.db"), MaxScans: 10})
+	nsd.publishMutex.Unlock()
+	profile := &profileState{ScanProfile: ScanProfile{
+		Name:    "office",
+		Targets: []string{"10.0.3.0/24"},
+		Ports:   []sd.PortService{{Port: 22, Name: "ssh", Job: "ssh"}},
+	}}
+	nsd.profiles = []*profileState{profile}
+
+	nsd.performScan(profile)
+	between := time.Now()
+	scanner.hosts["10.0.3.0/24"] = []sd.HostInfo{{IP: "10.0.3.15", Ports: []sd.PortInfo{{Port: 22, State: "open"}}}}
+	nsd.performScan(profile)
+
+	r := gin.New()
+	handler := func(c *gin.Context) { nsd.handleHistory(c, c.Param("id")) }
+	r.GET("/mgsd/history", handler)
+	r.GET("/mgsd/history/:id", handler)
+	get := func(url string, v any) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if v != nil && w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s: failed to decode response: %v", url, err)
+			}
+		}
+		return w.Code
+	}
+
+	var summaries []history.Summary
+	if code := get("/mgsd/history", &summaries); code != 200 || len(summaries) != 2 {
+		t.Fatalf("Expected 2 archived scans, got %d %+v", code, summaries)
+	}
+
+	var scan history.Scan
+	if code := get("/mgsd/history?at="+between.Format(time.RFC3339Nano), &scan); code != 200 || len(scan.Hosts) != 1 || scan.Hosts[0].IP != "10.0.3.14" {
+		t.Errorf("Expected the first scan at %v, got %d %+v", between, code, scan)
+	}
+
+	scan = history.Scan{}
+	if code := get("/mgsd/history/"+summaries[0].ID+"?ip=10.0.3.14", &scan); code != 200 || len(scan.Hosts) != 0 || len(scan.Targets) != 0 {
+		t.Errorf("Expected no 10.0.3.14 results in the latest scan, got %d %+v", code, scan)
+	}
+
+	for url, want := range map[string]int{
+		"/mgsd/history/999":          404,
+		"/mgsd/history?at=tuesday":   400,
+		"/mgsd/history?at=946684800": 404,
+	} {
+		if code := get(url, nil); code != want {
+			t.Errorf("%s: expected status %d, got %d", url, want, code)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"2026-01-06T12:00:00Z": time.Date(2026, 1, 6, 12, 0, 0, 0, time.UTC),
+		"2026-01-06":           time.Date(2026, 1, 7, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond),
+		"1767700800":           time.Unix(1767700800, 0),
+	}
+	for s, want := range tests {
+		if got, err := parseTime(s); err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := parseTime("last tuesday"); err == nil {
+		t.Error("Expected invalid time to be rejected")
+	}
+}
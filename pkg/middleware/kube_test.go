@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/kube"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func TestKubernetesSync(t *testing.T) {
+	client := fake.NewClientset()
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {
+			{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 9100, State: "open"}}},
+			{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 9100, State: "open"}}},
+		},
+	}}
+	cfg := Config{
+		Targets:    []string{"10.0.0.0/24"},
+		Ports:      []sd.PortService{{Port: 9100, Name: "node_exporter", Job: "node"}},
+		Scanner:    scanner,
+		Kubernetes: kube.Config{Namespace: "monitoring", Client: client},
+	}
+	nsd, err := NewNmapSD(cfg)
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	endpoints := func() int {
+		slice, err := client.DiscoveryV1().EndpointSlices("monitoring").Get(context.Background(), "nmap-sd-node-ipv4-9100-0", metav1.GetOptions{})
+		if err != nil {
+			return -1
+		}
+		return len(slice.Endpoints)
+	}
+	waitFor(t, "endpoint slice", func() bool { return endpoints() == 2 })
+	svc, err := client.CoreV1().Services("monitoring").Get(context.Background(), "nmap-sd-node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the service of the job: %v", err)
+	}
+	if len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].Name != "node-exporter" || svc.Spec.Ports[0].Port != 9100 {
+		t.Errorf("Unexpected service ports: %+v", svc.Spec.Ports)
+	}
+
+	// A host that goes away is removed from the endpoints after the next scan
+	cfg.Scanner = &staticScanner{hosts: map[string][]sd.HostInfo{"10.0.0.0/24": scanner.hosts["10.0.0.0/24"][:1]}}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+	waitFor(t, "endpoint removal", func() bool { return endpoints() == 1 })
+}
+
+func TestKubernetesLogger(t *testing.T) {
+	var logs logBuffer
+	nsd, err := NewNmapSD(Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 9100, Name: "node_exporter", Job: "node"}},
+		Scanner: &staticScanner{hosts: map[string][]sd.HostInfo{
+			"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 9100, State: "open"}}}},
+		}},
+		LogLevel:   "DEBUG",
+		Logger:     slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Kubernetes: kube.Config{Namespace: "monitoring", Client: fake.NewClientset()},
+	})
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	var msgs []string
+	waitFor(t, "Kubernetes sync log", func() bool {
+		for _, record := range logs.records(t) {
+			msgs = append(msgs, record["msg"].(string))
+		}
+		return slices.Contains(msgs, "Sync: Kubernetes objects synced")
+	})
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/webhook"
+)
+
+// levelHandler drops the records below the configured log level before they reach the
+// handler of the instance, so LogLevel only affects the logger of the instance
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+// Enabled implements slog.Handler
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// newLogger returns the logger of an instance: Logger, LogHandler or the handler of
+// slog.Default() in that order of preference, limited to the given level
+func newLogger(cfg Config, level slog.Leveler) *slog.Logger {
+	handler := cfg.LogHandler
+	if cfg.Logger != nil {
+		handler = cfg.Logger.Handler()
+	}
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	return slog.New(&levelHandler{level: level, handler: handler})
+}
+
+// withLoggers sets log as the logger of the webhooks, outputs and history archive of cfg
+// that have none, so they log to the instance logger
+func withLoggers(log *slog.Logger, cfg Config) Config {
+	if len(cfg.Webhooks) > 0 {
+		webhooks := make([]webhook.Config, len(cfg.Webhooks))
+		for i, wc := range cfg.Webhooks {
+			if wc.Logger == nil {
+				wc.Logger = log
+			}
+			webhooks[i] = wc
+		}
+		cfg.Webhooks = webhooks
+	}
+	if cfg.FileSD.Logger == nil {
+		cfg.FileSD.Logger = log
+	}
+	if cfg.Consul.Logger == nil {
+		cfg.Consul.Logger = log
+	}
+	if cfg.Kubernetes.Logger == nil {
+		cfg.Kubernetes.Logger = log
+	}
+	if cfg.DNS.Logger == nil {
+		cfg.DNS.Logger = log
+	}
+	if cfg.History.Logger == nil {
+		cfg.History.Logger = log
+	}
+	return cfg
+}
+
+// parseLogLevel returns the slog level of a LogLevel setting, INFO if it is unknown
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "ERROR":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// newScanID returns a random ID correlating the log messages and events of a scan
+func newScanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
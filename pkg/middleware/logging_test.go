@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/webhook"
+)
+
+// logBuffer collects JSON log records written concurrently
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the decoded records and empties the buffer
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	b.buf.Reset()
+	return records
+}
+
+func TestInjectedLogger(t *testing.T) {
+	global := slog.Default()
+	var logs logBuffer
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	cfg := Config{
+		Targets:  []string{"10.0.0.0/24"},
+		Ports:    []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Scanner:  scanner,
+		LogLevel: "DEBUG",
+		Logger:   slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	nsd, err := NewNmapSD(cfg)
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+	if slog.Default() != global {
+		t.Error("Expected the global default logger to be left alone")
+	}
+
+	// The messages of the middleware and of pkg/sd share the ID of their scan
+	scanIDs := make(map[string][]string)
+	for _, record := range logs.records(t) {
+		if id, ok := record[sd.LogKeyScanID].(string); ok {
+			scanIDs[id] = append(scanIDs[id], record["msg"].(string))
+		}
+	}
+	if len(scanIDs) == 0 {
+		t.Fatal("Expected log messages with a scan ID")
+	}
+	for id, msgs := range scanIDs {
+		joined := strings.Join(msgs, "\n")
+		if !strings.Contains(joined, "performScan: Starting network scan") || !strings.Contains(joined, "Scan: Starting") {
+			t.Errorf("Expected middleware and scan messages for scan %s, got:\n%s", id, joined)
+		}
+	}
+
+	// LogLevel is reloadable and only filters the injected logger
+	cfg.LogLevel = "ERROR"
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	logs.records(t)
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+	if records := logs.records(t); len(records) != 0 {
+		t.Errorf("Expected no records below ERROR, got %v", records)
+	}
+}
+
+func TestInjectedLoggerComponents(t *testing.T) {
+	var global logBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&global, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	dir := t.TempDir()
+	var logs logBuffer
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	nsd, err := NewNmapSD(Config{
+		Targets:        []string{"10.0.0.0/24"},
+		Ports:          []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Scanner:        scanner,
+		RelabelConfigs: []relabel.Config{{SourceLabels: []string{"job"}, TargetLabel: "service"}},
+		FileSD:         filesd.Config{Path: filepath.Join(dir, "targets.json")},
+		Webhooks:       []webhook.Config{{URL: "http://127.0.0.1:9/hook"}},
+		History:        history.Config{Path: filepath.Join(dir, "history.db")},
+		StateFile:      filepath.Join(dir, "state.json"),
+		LogLevel:       "DEBUG",
+		Logger:         slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	var msgs []string
+	for _, record := range logs.records(t) {
+		msgs = append(msgs, record["msg"].(string))
+	}
+	joined := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"relabel.New: Compiling relabel rules",
+		"Process: Relabeling completed",
+		"NewWriter: Created file_sd writer",
+		"Write: Writing file_sd file",
+		"webhook.New: Created webhook notifier",
+		"Open: History archive opened",
+		"Add: Scan archived",
+		"Save: Snapshot written",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected %q in the injected logger, got:\n%s", want, joined)
+		}
+	}
+	if records := global.records(t); len(records) != 0 {
+		t.Errorf("Expected no records in the global default logger, got %v", records)
+	}
+}
+
+func TestNewLoggerHandler(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	log := newLogger(Config{LogHandler: slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})}, level)
+
+	level.Set(slog.LevelDebug)
+	log.Debug("dropped by the handler")
+	log.With("key", "value").Info("kept")
+	level.Set(slog.LevelError)
+	log.Info("dropped by the level")
+
+	out := buf.String()
+	if strings.Contains(out, "dropped") || !strings.Contains(out, "key=value") {
+		t.Errorf("Unexpected log output: %q", out)
+	}
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the names of the self-instrumentation metrics
+const metricsNamespace = "nmap_sd"
+
+// Scan phases of the nmap_sd_scan_phase_duration_seconds metric
+const (
+	phaseDiscovery = "discovery"
+	phasePorts     = "ports"
+)
+
+var (
+	hostsUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "hosts_up"),
+		"Hosts found up by host discovery in the last successful scan of a profile.",
+		[]string{"profile"}, nil,
+	)
+	openPortsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "open_ports"),
+		"Open ports found by the last successful scans, by job, before relabeling.",
+		[]string{"job"}, nil,
+	)
+	lastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "last_successful_scan_timestamp_seconds"),
+		"Unix time of the last successful scan of a profile.",
+		[]string{"profile"}, nil,
+	)
+	targetsServedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "targets_served"),
+		"Targets currently served to Prometheus, after relabeling.",
+		nil, nil,
+	)
+	staleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "results_stale"),
+		"Whether the results of a profile were restored from the state file and not rescanned yet.",
+		[]string{"profile"}, nil,
+	)
+)
+
+// metrics is the Prometheus collector of the instance. Scan events update the
+// histogram and counters, the gauges are read from the served results on collection.
+type metrics struct {
+	n             *NmapSD
+	phaseDuration *prometheus.HistogramVec
+	failures      *prometheus.CounterVec
+	warnings      *prometheus.CounterVec
+	registry      *prometheus.Registry
+}
+
+// newMetrics creates the collector of n and registers it on its own registry
+func newMetrics(n *NmapSD) *metrics {
+	m := &metrics{
+		n: n,
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "scan_phase_duration_seconds",
+			Help:      "Duration of the host discovery and port scan phases of a scan.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		}, []string{"profile", "phase"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scan_failures_total",
+			Help:      "Scans that failed or timed out.",
+		}, []string{"profile"}),
+		warnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "nmap_warnings_total",
+			Help:      "Warnings reported by nmap.",
+		}, []string{"profile"}),
+		registry: prometheus.NewRegistry(),
+	}
+	m.registry.MustRegister(m)
+	return m
+}
+
+// Describe implements prometheus.Collector
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.phaseDuration.Describe(ch)
+	m.failures.Describe(ch)
+	m.warnings.Describe(ch)
+	ch <- hostsUpDesc
+	ch <- openPortsDesc
+	ch <- lastSuccessDesc
+	ch <- targetsServedDesc
+	ch <- staleDesc
+}
+
+// Collect implements prometheus.Collector
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.phaseDuration.Collect(ch)
+	m.failures.Collect(ch)
+	m.warnings.Collect(ch)
+
+	m.n.dataMutex.RLock()
+	defer m.n.dataMutex.RUnlock()
+
+	openPorts := make(map[string]int)
+	for _, p := range m.n.profiles {
+		if !p.initialized {
+			continue
+		}
+		// The discovery result of restored profiles is unknown until they are rescanned
+		if !p.stale {
+			ch <- prometheus.MustNewConstMetric(hostsUpDesc, prometheus.GaugeValue, float64(p.hostsUp), p.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, float64(p.scanTime.UnixNano())/1e9, p.Name)
+		stale := 0.0
+		if p.stale {
+			stale = 1
+		}
+		ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, stale, p.Name)
+		for _, st := range p.data {
+			openPorts[st.Labels["job"]] += len(st.Targets)
+		}
+	}
+	for job, count := range openPorts {
+		ch <- prometheus.MustNewConstMetric(openPortsDesc, prometheus.GaugeValue, float64(count), job)
+	}
+
+	served := 0
+	for _, st := range m.n.data {
+		served += len(st.Targets)
+	}
+	ch <- prometheus.MustNewConstMetric(targetsServedDesc, prometheus.GaugeValue, float64(served))
+}
+
+// observeScan records the phase durations and warnings of a scan, and whether it failed
+func (m *metrics) observeScan(profile string, stats sd.ScanStats, failed bool) {
+	if stats.DiscoveryDuration > 0 {
+		m.phaseDuration.WithLabelValues(profile, phaseDiscovery).Observe(stats.DiscoveryDuration.Seconds())
+	}
+	if stats.PortScanDuration > 0 {
+		m.phaseDuration.WithLabelValues(profile, phasePorts).Observe(stats.PortScanDuration.Seconds())
+	}
+	m.warnings.WithLabelValues(profile).Add(float64(stats.Warnings))
+	if failed {
+		m.failures.WithLabelValues(profile).Inc()
+	} else {
+		// Report the profile with zero failures once it has been scanned
+		m.failures.WithLabelValues(profile)
+	}
+}
+
+// handleMetrics serves the self-instrumentation metrics in the Prometheus exposition format
+func (n *NmapSD) handleMetrics(c *gin.Context) {
+	n.log.Debug("handleMetrics: Serving metrics")
+	promhttp.HandlerFor(n.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failingScanner is a Scanner whose discovery always fails
+type failingScanner struct{}
+
+func (failingScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]sd.HostInfo, error) {
+	return nil, errors.New("nmap exited with status 1")
+}
+
+func (failingScanner) ScanPorts(ctx context.Context, hosts []string, ports []sd.PortService) ([]sd.HostInfo, error) {
+	return nil, errors.New("nmap exited with status 1")
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {
+			{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}, {Port: 9100, State: "open"}}},
+			{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+		},
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	nsd.metrics = newMetrics(nsd)
+	nsd.metricsPath = "/metrics"
+	// Relabeling drops the node targets from the served results
+	nsd.relabeler, _ = relabel.New([]relabel.Config{{SourceLabels: []string{"job"}, Regex: "node", Action: relabel.Drop}}, nsd.log)
+	office := &profileState{ScanProfile: ScanProfile{
+		Name:    "office",
+		Targets: []string{"10.0.0.0/24"},
+		Ports: []sd.PortService{
+			{Port: 80, Name: "http", Job: "http_services"},
+			{Port: 9100, Name: "node", Job: "node"},
+		},
+	}}
+	nsd.profiles = []*profileState{office}
+
+	nsd.performScan(office)
+	nsd.scanner = failingScanner{}
+	nsd.performScan(office)
+
+	r := gin.New()
+	r.GET("/metrics", nsd.handleMetrics)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	text := string(body)
+
+	for _, want := range []string{
+		`nmap_sd_hosts_up{profile="office"} 2`,
+		`nmap_sd_open_ports{job="http_services"} 2`,
+		`nmap_sd_open_ports{job="node"} 1`,
+		`nmap_sd_targets_served 2`,
+		`nmap_sd_scan_failures_total{profile="office"} 1`,
+		`nmap_sd_nmap_warnings_total{profile="office"} 0`,
+		`nmap_sd_results_stale{profile="office"} 0`,
+		`nmap_sd_scan_phase_duration_seconds_count{phase="discovery",profile="office"} 2`,
+		`nmap_sd_scan_phase_duration_seconds_count{phase="ports",profile="office"} 1`,
+		`nmap_sd_last_successful_scan_timestamp_seconds{profile="office"}`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, text)
+		}
+	}
+}
@@ -1,43 +1,147 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
 	"html/template"
 	"log/slog"
-	"os"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Hoverhuang-er/nmap_sd/pkg/consul"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/dnssd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/kube"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
 	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/webhook"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-co-op/gocron"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // NmapSD Gin middleware for network service discovery
 type NmapSD struct {
-	cidr        string
 	scanPath    string
-	ports       []sd.PortService
+	profiles    []*profileState
+	relabeler   *relabel.Relabeler
+	fileSD      *filesd.Writer
+	fileSDCfg   filesd.Config
+	onDiff      func(sd.ScanDiff)
+	diffs       chan<- sd.ScanDiff
+	diffQueue   diffQueue
+	webhooks    []*webhook.Notifier
+	webhookCfgs []webhook.Config
+	stopHooks   context.CancelFunc
+	consul      output
+	consulCfg   consul.Config
+	kube        output
+	kubeCfg     kube.Config
+	dns         *dnssd.Server
+	dnsOutput   output
+	dnsCfg      dnssd.Config
+	events      eventBroker
+	stateFile   string
+	history     *history.Archive
+	historyCfg  history.Config
+	metrics     *metrics
+	metricsPath string
+	log         *slog.Logger
+	logLevel    *slog.LevelVar
+	scanner     sd.Scanner
+	scanTimeout time.Duration
 	scheduler   *gocron.Scheduler
+	ctx         context.Context
+	cancel      context.CancelFunc
 	data        []sd.ServiceTarget
 	hostInfo    []sd.HostInfo
 	dataMutex   sync.RWMutex
 	initialized bool
+
+	// publishMutex keeps outputs in the same order as data updates
+	// and serializes configuration reloads
+	publishMutex sync.Mutex
+
+	// Single-flight scan state per profile name, see requestScan
+	scanMu  sync.Mutex
+	flights map[string]*scanFlight
 }
 
 // Config for NmapSD middleware
 type Config struct {
-	// CIDR to scan (e.g., "192.168.2.0/22")
+	// CIDR to scan (e.g., "192.168.2.0/22"), scanned together with Targets
 	CIDR string
-	// API path to expose scan results (default: "/mgsd")
+	// Additional targets to scan: CIDRs, nmap ranges, single hosts or hostnames
+	Targets []string
+	// Targets that must never be probed (nmap --exclude)
+	Excludes []string
+	// API path to expose scan results (default: "/mgsd").
+	// Scan events are streamed as Server-Sent Events on ScanPath + "/events",
+	// scans are triggered on ScanPath + "/scan", archived scans are served on ScanPath + "/history"
+	// and the host information page on ScanPath + "/info".
 	ScanPath string
 	// Scan interval in minutes (default: 1)
 	ScanInterval int
 	// Ports to scan (default: common ports)
 	Ports []sd.PortService
-	// Log level: "INFO", "ERROR", "DEBUG" (default: "INFO")
+	// Log level: "INFO", "ERROR", "DEBUG" (default: "INFO").
+	// It only applies to the logger of the instance and cannot enable records its handler drops.
 	LogLevel string
+	// Logger the instance and its scans log to (default: slog.Default()).
+	// The global default logger is never replaced.
+	Logger *slog.Logger
+	// Handler the instance logs to, used when Logger is not set
+	LogHandler slog.Handler
+	// Scanner backend used for discovery and port scans (default: nmap)
+	Scanner sd.Scanner
+	// Scan hostname targets over both IPv4 and IPv6 with the default nmap scanner
+	DualStack bool
+	// Maximum duration of a single scan (default: 10 minutes)
+	ScanTimeout time.Duration
+	// Named scan profiles with their own targets, ports, interval and labels.
+	// Top-level CIDR and Targets are scanned as an extra profile named "default".
+	Profiles []ScanProfile
+	// Prometheus style relabel rules applied to all targets before they are served
+	RelabelConfigs []relabel.Config
+	// Prometheus file_sd output written after every scan (disabled when Path is empty)
+	FileSD filesd.Config
+	// Called with the changes between consecutive results after every published scan.
+	// Calls are made one at a time in publication order from a goroutine of their own, so the
+	// callback may call back into the instance, e.g. Reload; the first result is not reported.
+	OnDiff func(sd.ScanDiff)
+	// Like OnDiff, but the changes are sent on a channel after the callback. Diffs wait in
+	// publication order until they are received or the instance stops, without holding up scans.
+	Diffs chan<- sd.ScanDiff
+	// Outgoing webhooks receiving the added and removed targets of every diff
+	Webhooks []webhook.Config
+	// Consul agent the served targets are registered on as services after every scan
+	// (disabled when Address and Registrar are empty)
+	Consul consul.Config
+	// Kubernetes namespace every job of the served targets is mirrored into as a selector-less
+	// Service with EndpointSlices after every scan (disabled when Namespace is empty)
+	Kubernetes kube.Config
+	// Embedded DNS server answering SRV queries for _<job>._tcp.<zone> and A/AAAA queries
+	// for <hostname>.<zone> from the served results (disabled when Addr is empty)
+	DNS dnssd.Config
+	// File the last results are saved to after every scan and restored from in New, so they
+	// can be served before the first scan finishes (disabled when empty). Restored results
+	// are served with the StaleHeader until their profile is scanned again.
+	StateFile string
+	// Archive of every published scan with retention limits (disabled when Path is empty),
+	// served on ScanPath + "/history"
+	History history.Config
+	// Path to serve the self-instrumentation metrics on, e.g. "/metrics" (disabled when empty)
+	MetricsPath string
+	// Additional registry the metrics collector is registered on, e.g. prometheus.DefaultRegisterer
+	MetricsRegisterer prometheus.Registerer
+	// Configurations received on this channel are applied to the running instance with
+	// Reload, e.g. from a config.Watcher. The Updates field of received configurations is ignored.
+	Updates <-chan Config
 }
 
 // DefaultConfig returns default configuration
@@ -57,150 +161,741 @@ func DefaultConfig() Config {
 			{Port: 8888, Name: "http-alt", Job: "http_services"},
 			{Port: 38089, Name: "custom", Job: "http_services"},
 		},
+		ScanTimeout: sd.DefaultScanTimeout,
 	}
 }
 
-// New creates a new NmapSD middleware instance
-func New(config ...Config) gin.HandlerFunc {
-	slog.Debug("New: Creating NmapSD middleware instance")
-	cfg := DefaultConfig()
-	if len(config) > 0 {
-		slog.Debug("New: Using custom configuration")
-		cfg = config[0]
-		if cfg.CIDR == "" {
-			slog.Debug("New: CIDR empty, using default", "default", "192.168.2.0/22")
-			cfg.CIDR = "192.168.2.0/22"
+// Validate checks the scan targets and exclusions of the configuration and its profiles as well as
+// the relabel rules, file_sd output, webhooks, Consul registration, Kubernetes sync, DNS zone and
+// history retention
+func (c Config) Validate() error {
+	return c.validate(newLogger(c, parseLogLevel(c.LogLevel)))
+}
+
+// validate is Validate with the checked components logging to log
+func (c Config) validate(log *slog.Logger) error {
+	c = withLoggers(log, c)
+	if err := validateProfiles(c.scanProfiles()); err != nil {
+		return err
+	}
+	if _, err := relabel.New(c.RelabelConfigs, log); err != nil {
+		return fmt.Errorf("relabel: %w", err)
+	}
+	if c.FileSD.Path != "" {
+		if _, err := filesd.NewWriter(c.FileSD); err != nil {
+			return fmt.Errorf("file_sd: %w", err)
 		}
-		if cfg.ScanPath == "" {
-			slog.Debug("New: ScanPath empty, using default", "default", "/mgsd")
-			cfg.ScanPath = "/mgsd"
+	}
+	for i, wc := range c.Webhooks {
+		if _, err := webhook.New(wc); err != nil {
+			return fmt.Errorf("webhook %d: %w", i, err)
 		}
-		if cfg.ScanInterval <= 0 {
-			slog.Debug("New: ScanInterval invalid, using default", "default", 1)
-			cfg.ScanInterval = 1
+	}
+	if c.Consul.Enabled() {
+		if _, err := consul.New(c.Consul); err != nil {
+			return fmt.Errorf("consul: %w", err)
 		}
-		if len(cfg.Ports) == 0 {
-			slog.Debug("New: Ports empty, using default ports")
-			cfg.Ports = DefaultConfig().Ports
+	}
+	if c.Kubernetes.Enabled() {
+		if _, err := kube.New(c.Kubernetes); err != nil {
+			return fmt.Errorf("kubernetes: %w", err)
 		}
-		if cfg.LogLevel == "" {
-			slog.Debug("New: LogLevel empty, using default", "default", "INFO")
-			cfg.LogLevel = "INFO"
+	}
+	if c.DNS.Addr != "" {
+		if _, err := dnssd.New(c.DNS); err != nil {
+			return fmt.Errorf("dns: %w", err)
 		}
+	}
+	if err := c.History.Validate(); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	return nil
+}
+
+// scanTargets returns CIDR followed by Targets
+func (c Config) scanTargets() []string {
+	var targets []string
+	if c.CIDR != "" {
+		targets = append(targets, c.CIDR)
+	}
+	return append(targets, c.Targets...)
+}
+
+// withDefaults fills the unset fields of a custom configuration with defaults
+func withDefaults(log *slog.Logger, cfg Config) Config {
+	if cfg.CIDR == "" && len(cfg.Targets) == 0 && len(cfg.Profiles) == 0 {
+		log.Debug("withDefaults: CIDR, Targets and Profiles empty, using default", "default", "192.168.2.0/22")
+		cfg.CIDR = "192.168.2.0/22"
+	}
+	if cfg.ScanPath == "" {
+		log.Debug("withDefaults: ScanPath empty, using default", "default", "/mgsd")
+		cfg.ScanPath = "/mgsd"
+	}
+	if cfg.ScanInterval <= 0 {
+		log.Debug("withDefaults: ScanInterval invalid, using default", "default", 1)
+		cfg.ScanInterval = 1
+	}
+	if len(cfg.Ports) == 0 {
+		log.Debug("withDefaults: Ports empty, using default ports")
+		cfg.Ports = DefaultConfig().Ports
+	}
+	if cfg.LogLevel == "" {
+		log.Debug("withDefaults: LogLevel empty, using default", "default", "INFO")
+		cfg.LogLevel = "INFO"
+	}
+	if cfg.ScanTimeout <= 0 {
+		log.Debug("withDefaults: ScanTimeout invalid, using default", "default", sd.DefaultScanTimeout)
+		cfg.ScanTimeout = sd.DefaultScanTimeout
+	}
+	return withLoggers(log, cfg)
+}
+
+// New creates a new NmapSD middleware instance and returns its middleware handler.
+// New panics if the configuration fails validation; use NewNmapSD to handle the
+// error and to control the instance.
+func New(config ...Config) gin.HandlerFunc {
+	nsd, err := NewNmapSD(config...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return nsd.Handler()
+}
+
+// NewNmapSD creates and starts a new NmapSD instance. Without a configuration
+// DefaultConfig is used, unset fields of a custom configuration get their defaults.
+// Call Stop to end the scheduled scans.
+func NewNmapSD(config ...Config) (*NmapSD, error) {
+	cfg := DefaultConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parseLogLevel(cfg.LogLevel))
+	log := newLogger(cfg, logLevel)
+	if len(config) > 0 {
+		log.Debug("NewNmapSD: Using custom configuration")
+		cfg = withDefaults(log, cfg)
 	} else {
-		slog.Debug("New: Using default configuration")
+		log.Debug("NewNmapSD: Using default configuration")
+		cfg = withLoggers(log, cfg)
+	}
+	if cfg.Scanner == nil {
+		log.Debug("NewNmapSD: Scanner empty, using nmap scanner", "dual_stack", cfg.DualStack)
+		cfg.Scanner = &sd.NmapScanner{DualStack: cfg.DualStack}
 	}
 
-	slog.Debug("New: Final configuration", "cidr", cfg.CIDR, "scanPath", cfg.ScanPath, "scanInterval", cfg.ScanInterval, "logLevel", cfg.LogLevel, "portCount", len(cfg.Ports))
+	log.Debug("NewNmapSD: Validating configuration")
+	if err := cfg.validate(log); err != nil {
+		log.Error("NewNmapSD: Invalid configuration", "error", err)
+		return nil, fmt.Errorf("nmap_sd: invalid configuration: %w", err)
+	}
+	dnsServer, err := listenDNS(log, cfg.DNS)
+	if err != nil {
+		log.Error("NewNmapSD: Failed to start DNS server", "addr", cfg.DNS.Addr, "error", err)
+		return nil, fmt.Errorf("nmap_sd: dns: %w", err)
+	}
 
-	// Set log level
-	slog.Debug("New: Setting log level", "level", cfg.LogLevel)
-	setLogLevel(cfg.LogLevel)
+	log.Debug("NewNmapSD: Final configuration", "targets", cfg.scanTargets(), "excludes", cfg.Excludes, "profileCount", len(cfg.scanProfiles()), "scanPath", cfg.ScanPath, "scanInterval", cfg.ScanInterval, "scanTimeout", cfg.ScanTimeout, "logLevel", cfg.LogLevel, "portCount", len(cfg.Ports))
 
-	slog.Debug("New: Creating NmapSD instance")
+	log.Debug("NewNmapSD: Creating NmapSD instance")
+	// Relabel rules were already checked by Validate
+	relabeler, _ := relabel.New(cfg.RelabelConfigs, log)
+	ctx, cancel := context.WithCancel(context.Background())
 	nsd := &NmapSD{
-		cidr:     cfg.CIDR,
-		scanPath: cfg.ScanPath,
-		ports:    cfg.Ports,
-		data:     []sd.ServiceTarget{},
+		scanPath:    cfg.ScanPath,
+		relabeler:   relabeler,
+		onDiff:      cfg.OnDiff,
+		diffs:       cfg.Diffs,
+		stateFile:   cfg.StateFile,
+		metricsPath: cfg.MetricsPath,
+		log:         log,
+		logLevel:    logLevel,
+		scanner:     cfg.Scanner,
+		scanTimeout: cfg.ScanTimeout,
+		ctx:         ctx,
+		cancel:      cancel,
+		data:        []sd.ServiceTarget{},
+	}
+	nsd.events.log = log
+	for _, p := range cfg.scanProfiles() {
+		nsd.profiles = append(nsd.profiles, &profileState{ScanProfile: p})
+	}
+	nsd.metrics = newMetrics(nsd)
+	if cfg.MetricsRegisterer != nil {
+		if err := cfg.MetricsRegisterer.Register(nsd.metrics); err != nil {
+			log.Error("Failed to register metrics", "error", err)
+		}
+	}
+	nsd.restoreState()
+	if cfg.FileSD.Path != "" {
+		// The file_sd configuration was already checked by Validate
+		nsd.fileSD, _ = filesd.NewWriter(cfg.FileSD)
+		nsd.fileSDCfg = cfg.FileSD
+		log.Debug("NewNmapSD: file_sd output enabled", "path", cfg.FileSD.Path)
 	}
-	slog.Debug("New: NmapSD instance created")
+	nsd.startWebhooks(cfg.Webhooks)
+	nsd.startConsul(cfg.Consul)
+	nsd.startKube(cfg.Kubernetes)
+	nsd.startDNS(cfg.DNS, dnsServer)
+	nsd.openHistory(cfg.History)
+	log.Debug("NewNmapSD: NmapSD instance created", "profile_count", len(nsd.profiles))
 
-	// Start background scanner
-	slog.Debug("New: Creating scheduler", "interval_minutes", cfg.ScanInterval)
+	// Start background scanner, one job per profile
 	nsd.scheduler = gocron.NewScheduler(time.Local)
-	nsd.scheduler.Every(cfg.ScanInterval).Minutes().Do(func() {
-		nsd.performScan()
-	})
-	slog.Debug("New: Starting scheduler asynchronously")
+	for _, p := range nsd.profiles {
+		nsd.schedule(p)
+	}
+	log.Debug("NewNmapSD: Starting scheduler asynchronously")
 	nsd.scheduler.StartAsync()
 
-	// Perform initial scan
-	slog.Debug("New: Launching initial scan in background")
-	go nsd.performScan()
+	// Perform initial scans
+	for _, p := range nsd.profiles {
+		log.Debug("NewNmapSD: Launching initial scan in background", "profile", p.Name)
+		nsd.requestScan(p.Name)
+	}
 
-	slog.Debug("New: Middleware handler created successfully")
+	if cfg.Updates != nil {
+		log.Debug("NewNmapSD: Watching for configuration updates")
+		go nsd.watchUpdates(cfg.Updates)
+	}
+
+	log.Debug("NewNmapSD: NmapSD instance started")
+	return nsd, nil
+}
+
+// Handler returns a middleware serving all endpoints below the scan path and the metrics
+// endpoint by matching the request path. Other requests are passed to the next handler.
+// RegisterRoutes mounts the same endpoints as gin routes instead.
+func (n *NmapSD) Handler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		slog.Debug("Middleware: Request received", "path", c.Request.URL.Path, "method", c.Request.Method)
-		// Check if this is the scan result endpoint
-		if c.Request.URL.Path == cfg.ScanPath && c.Request.Method == "GET" {
-			slog.Debug("Middleware: Handling scan result request")
-			nsd.handleScanResult(c)
+		n.log.Debug("Middleware: Request received", "path", c.Request.URL.Path, "method", c.Request.Method)
+		handle := n.route(c)
+		if handle == nil {
+			n.log.Debug("Middleware: Passing request to next handler")
+			c.Next()
 			return
 		}
-		// Check if this is the info endpoint
-		if c.Request.URL.Path == "/info" && c.Request.Method == "GET" {
-			slog.Debug("Middleware: Handling info page request")
-			nsd.handleInfo(c)
-			return
+		// Without a matching route gin defaults to 404 when served by the middleware
+		c.Status(200)
+		handle(c)
+	}
+}
+
+// route returns the handler of the endpoint a request is for, nil if it is for none of them
+func (n *NmapSD) route(c *gin.Context) gin.HandlerFunc {
+	path, method := c.Request.URL.Path, c.Request.Method
+	scanPath := n.currentScanPath()
+	// Check if this is the scan result endpoint
+	if path == scanPath && method == "GET" {
+		n.log.Debug("Middleware: Handling scan result request")
+		return n.handleScanResult
+	}
+	// Check if this is the scan events endpoint
+	if path == scanPath+EventsPathSuffix && method == "GET" {
+		n.log.Debug("Middleware: Handling scan events request")
+		return n.handleEvents
+	}
+	// Check if this is the manual scan endpoint
+	if path == scanPath+TriggerPathSuffix {
+		switch method {
+		case "POST":
+			n.log.Debug("Middleware: Handling scan trigger request")
+			return n.handleTriggerScan
+		case "GET":
+			n.log.Debug("Middleware: Handling scan status request")
+			return n.handleScanStatus
+		}
+	}
+	// Check if this is a history endpoint
+	historyPath := scanPath + HistoryPathSuffix
+	if (path == historyPath || strings.HasPrefix(path, historyPath+"/")) && method == "GET" {
+		n.log.Debug("Middleware: Handling scan history request")
+		return func(c *gin.Context) {
+			n.handleHistory(c, strings.TrimPrefix(strings.TrimPrefix(path, historyPath), "/"))
+		}
+	}
+	// Check if this is a render endpoint
+	renderPath := scanPath + RenderPathSuffix + "/"
+	if strings.HasPrefix(path, renderPath) && method == "GET" {
+		n.log.Debug("Middleware: Handling render request")
+		return func(c *gin.Context) {
+			n.handleRender(c, strings.TrimPrefix(path, renderPath))
 		}
-		slog.Debug("Middleware: Passing request to next handler")
-		c.Next()
 	}
+	// Check if this is the metrics endpoint
+	if metricsPath := n.currentMetricsPath(); metricsPath != "" && path == metricsPath && method == "GET" {
+		n.log.Debug("Middleware: Handling metrics request")
+		return n.handleMetrics
+	}
+	// Check if this is the info endpoint
+	if path == scanPath+InfoPathSuffix && method == "GET" {
+		n.log.Debug("Middleware: Handling info page request")
+		return n.handleInfo
+	}
+	return nil
 }
 
-// performScan executes the network scan and updates data
-func (n *NmapSD) performScan() {
-	slog.Debug("performScan: Starting network scan", "cidr", n.cidr, "port_count", len(n.ports))
-	slog.Info("Starting network scan...")
+// performScan executes the network scan of a profile and updates data
+func (n *NmapSD) performScan(p *profileState) {
+	scanID := newScanID()
+	log := n.log.With(sd.LogKeyScanID, scanID)
+	log.Debug("performScan: Starting network scan", "profile", p.Name, "targets", p.Targets, "excludes", p.Excludes, "port_count", len(p.Ports))
+	log.Info("Starting network scan...", "profile", p.Name)
+
+	n.dataMutex.RLock()
+	scanner, scanTimeout := n.scanner, n.scanTimeout
+	n.dataMutex.RUnlock()
+
+	started := time.Now()
+	n.events.publish(EventScanStarted, ScanEvent{Profile: p.Name, ScanID: scanID, Time: started})
 
-	slog.Debug("performScan: Calling ScanNetworkRange")
-	results, hostInfo, err := sd.ScanNetworkRange(n.cidr, n.ports)
+	ctx, cancel := context.WithTimeout(sd.WithLogger(n.ctx, n.log), scanTimeout)
+	defer cancel()
+
+	log.Debug("performScan: Calling Scan", "profile", p.Name, "timeout", scanTimeout)
+	var stats sd.ScanStats
+	results, hostInfo, err := sd.Scan(ctx, scanner, sd.ScanSpec{
+		Targets:  p.Targets,
+		Excludes: p.Excludes,
+		Ports:    p.Ports,
+		Profile:  p.Name,
+		Stats:    &stats,
+		ID:       scanID,
+	})
+	if n.metrics != nil && n.ctx.Err() == nil {
+		n.metrics.observeScan(p.Name, stats, err != nil)
+	}
 	if err != nil {
-		slog.Error("Failed to scan network", "error", err)
-		slog.Debug("performScan: Scan failed, returning without updating data")
+		if n.ctx.Err() != nil {
+			log.Info("Scan cancelled", "profile", p.Name, "error", err)
+			log.Debug("performScan: Instance stopped, returning without updating data")
+			return
+		}
+		log.Error("Failed to scan network", "profile", p.Name, "error", err)
+		n.events.publish(EventScanCompleted, ScanEvent{
+			Profile:         p.Name,
+			ScanID:          scanID,
+			Time:            time.Now(),
+			DurationSeconds: time.Since(started).Seconds(),
+			Error:           err.Error(),
+		})
+		log.Debug("performScan: Scan failed, returning without updating data")
 		return
 	}
-	slog.Debug("performScan: Scan completed successfully", "service_groups", len(results), "hosts", len(hostInfo))
+	log.Debug("performScan: Scan completed successfully", "profile", p.Name, "service_groups", len(results), "hosts", len(hostInfo))
+
+	n.publishMutex.Lock()
+	defer n.publishMutex.Unlock()
 
-	slog.Debug("performScan: Acquiring data mutex lock")
+	log.Debug("performScan: Acquiring data mutex lock")
 	n.dataMutex.Lock()
-	slog.Debug("performScan: Updating scan results")
-	n.data = results
-	n.hostInfo = hostInfo
-	n.initialized = true
-	slog.Debug("performScan: Results updated, releasing mutex")
+	if !slices.Contains(n.profiles, p) {
+		// A reload replaced or removed the profile while it was scanned
+		n.dataMutex.Unlock()
+		log.Info("Profile changed during the scan, discarding results", "profile", p.Name)
+		n.events.publish(EventScanCompleted, ScanEvent{
+			Profile:         p.Name,
+			ScanID:          scanID,
+			Time:            time.Now(),
+			DurationSeconds: time.Since(started).Seconds(),
+			Error:           "profile changed during the scan, results discarded",
+		})
+		return
+	}
+	log.Debug("performScan: Updating scan results")
+	p.data = results
+	p.hostInfo = hostInfo
+	p.initialized = true
+	p.scanTime = time.Now()
+	p.hostsUp = stats.HostsUp
+	p.stale = false
+	changes := n.mergeLocked()
+	data, mergedHosts, fileSD, archive := n.data, n.hostInfo, n.fileSD, n.history
+	outputs := []output{n.consul, n.kube, n.dnsOutput}
+	log.Debug("performScan: Results updated, releasing mutex")
 	n.dataMutex.Unlock()
 
-	slog.Info("Scan completed", "service_groups", len(results), "hosts", len(hostInfo))
-	slog.Debug("performScan: Network scan finished")
+	writeFileSD(log, fileSD, data)
+	for _, o := range outputs {
+		o.Update(data, mergedHosts)
+	}
+	n.saveState()
+	recordHistory(log, archive, p.Name, data, mergedHosts)
+	n.notifyDiff(p.Name, changes)
+	n.events.publish(EventScanCompleted, ScanEvent{
+		Profile:         p.Name,
+		ScanID:          scanID,
+		Time:            time.Now(),
+		DurationSeconds: time.Since(started).Seconds(),
+		ServiceGroups:   len(results),
+		Hosts:           len(hostInfo),
+		Changes:         len(changes),
+	})
+
+	log.Info("Scan completed", "profile", p.Name, "service_groups", len(results), "hosts", len(hostInfo))
+	log.Debug("performScan: Network scan finished")
+}
+
+// ScanOnce scans every profile of the configuration once, without starting a scheduler,
+// and returns the targets as the middleware would serve them
+func ScanOnce(ctx context.Context, cfg Config) ([]sd.ServiceTarget, error) {
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parseLogLevel(cfg.LogLevel))
+	log := newLogger(cfg, logLevel)
+	cfg = withDefaults(log, cfg)
+	if cfg.Scanner == nil {
+		cfg.Scanner = &sd.NmapScanner{DualStack: cfg.DualStack}
+	}
+	if err := cfg.validate(log); err != nil {
+		return nil, fmt.Errorf("nmap_sd: invalid configuration: %w", err)
+	}
+
+	var profiles []*profileState
+	for _, sp := range cfg.scanProfiles() {
+		log.Debug("ScanOnce: Scanning profile", "profile", sp.Name, "targets", sp.Targets)
+		scanCtx, cancel := context.WithTimeout(ctx, cfg.ScanTimeout)
+		results, hostInfo, err := sd.Scan(sd.WithLogger(scanCtx, log), cfg.Scanner, sd.ScanSpec{
+			Targets:  sp.Targets,
+			Excludes: sp.Excludes,
+			Ports:    sp.Ports,
+			Profile:  sp.Name,
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", sp.Name, err)
+		}
+		profiles = append(profiles, &profileState{ScanProfile: sp, data: results, hostInfo: hostInfo, initialized: true})
+	}
+
+	data, _, _ := mergeResults(log, profiles)
+	// Relabel rules were already checked by Validate
+	relabeler, _ := relabel.New(cfg.RelabelConfigs, log)
+	return relabeler.Process(data), nil
+}
+
+// mergeLocked rebuilds the served results from the profile results and returns
+// the changes to the previous results, or nil if there were none before.
+// The caller must hold dataMutex.
+func (n *NmapSD) mergeLocked() []sd.Change {
+	prevData, prevHosts, prevInitialized := n.data, n.hostInfo, n.initialized
+	n.data, n.hostInfo, n.initialized = mergeResults(n.log, n.profiles)
+	if n.relabeler != nil {
+		n.data = n.relabeler.Process(n.data)
+	}
+	if !prevInitialized || !n.initialized {
+		return nil
+	}
+	return sd.Diff(prevHosts, n.hostInfo, prevData, n.data)
+}
+
+// notifyDiff reports changes to the event streams and webhooks and queues them for the diff
+// callback and channel. The caller must hold publishMutex so diffs are reported in publication order.
+func (n *NmapSD) notifyDiff(profile string, changes []sd.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	diff := sd.ScanDiff{Time: time.Now(), Profile: profile, Changes: changes}
+	n.log.Debug("notifyDiff: Reporting scan changes", "profile", profile, "changes", len(changes))
+	n.events.publish(EventTargetsChanged, diff)
+	for _, w := range n.webhooks {
+		w.Enqueue(diff)
+	}
+	n.diffQueue.push(diff, n.deliverDiff)
+}
+
+// deliverDiff hands a diff to the diff callback and channel
+func (n *NmapSD) deliverDiff(diff sd.ScanDiff) {
+	n.dataMutex.RLock()
+	onDiff, diffs := n.onDiff, n.diffs
+	n.dataMutex.RUnlock()
+	if n.ctx.Err() != nil {
+		n.log.Debug("deliverDiff: Instance stopped, dropping diff")
+		return
+	}
+	if onDiff != nil {
+		onDiff(diff)
+	}
+	if diffs != nil {
+		select {
+		case diffs <- diff:
+		case <-n.ctx.Done():
+			n.log.Debug("deliverDiff: Instance stopped, dropping diff")
+		}
+	}
+}
+
+// diffQueue delivers diffs in the order they were pushed from a goroutine that runs while
+// diffs are pending, so consumers neither hold up publishing nor hold its locks.
+// The zero value is ready to use.
+type diffQueue struct {
+	mu         sync.Mutex
+	pending    []sd.ScanDiff
+	delivering bool
+}
+
+// push queues a diff for deliver, starting the delivery goroutine if none is running
+func (q *diffQueue) push(diff sd.ScanDiff, deliver func(sd.ScanDiff)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, diff)
+	if q.delivering {
+		return
+	}
+	q.delivering = true
+	go func() {
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.delivering = false
+				q.mu.Unlock()
+				return
+			}
+			diff := q.pending[0]
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			deliver(diff)
+		}
+	}()
+}
+
+// writeFileSD writes the targets to the file_sd output if it is enabled
+func writeFileSD(log *slog.Logger, w *filesd.Writer, data []sd.ServiceTarget) {
+	if w == nil {
+		return
+	}
+	log.Debug("writeFileSD: Writing file_sd output")
+	if err := w.Write(data); err != nil {
+		log.Error("Failed to write file_sd output", "error", err)
+	}
+}
+
+// startWebhooks starts a notifier per webhook, replacing the running ones.
+// Deliveries still pending for the previous webhooks are dropped.
+func (n *NmapSD) startWebhooks(configs []webhook.Config) {
+	if n.stopHooks != nil {
+		n.stopHooks()
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.webhooks = nil
+	for _, wc := range configs {
+		// Webhooks were already checked by Validate
+		notifier, _ := webhook.New(wc)
+		go notifier.Run(ctx)
+		n.webhooks = append(n.webhooks, notifier)
+	}
+	n.webhookCfgs = configs
+	n.stopHooks = cancel
+	n.log.Debug("startWebhooks: Webhooks started", "count", len(n.webhooks))
+}
+
+// output is a background consumer of the served results, such as the Consul registration
+type output struct {
+	// update hands the served results to the running output, nil when none is running
+	update func(data []sd.ServiceTarget, hosts []sd.HostInfo)
+	// stop stops the running output and waits for it to return
+	stop func()
+}
+
+// Update hands the served results to the output if it is running
+func (o output) Update(data []sd.ServiceTarget, hosts []sd.HostInfo) {
+	if o.update != nil {
+		o.update(data, hosts)
+	}
+}
+
+// replaceOutput stops the running output o and, unless run is nil, starts run in its place
+// until the next replacement or Stop, handing update the served results if there are any.
+// The caller must hold publishMutex.
+func (n *NmapSD) replaceOutput(o *output, run func(context.Context), update func([]sd.ServiceTarget, []sd.HostInfo)) {
+	if o.stop != nil {
+		o.stop()
+	}
+	n.dataMutex.Lock()
+	defer n.dataMutex.Unlock()
+	*o = output{}
+	if run == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	done := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(done)
+	}()
+	if n.initialized {
+		update(n.data, n.hostInfo)
+	}
+	*o = output{
+		update: update,
+		stop: func() {
+			cancel()
+			<-done
+		},
+	}
+}
+
+// startConsul starts the Consul syncer, replacing the running one. The caller must hold publishMutex.
+func (n *NmapSD) startConsul(cfg consul.Config) {
+	n.consulCfg = cfg
+	if !cfg.Enabled() {
+		n.replaceOutput(&n.consul, nil, nil)
+		return
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = n.log
+	}
+	// The Consul configuration was already checked by Validate
+	syncer, _ := consul.New(cfg)
+	n.replaceOutput(&n.consul, syncer.Run, func(data []sd.ServiceTarget, _ []sd.HostInfo) {
+		syncer.Update(data)
+	})
+	n.log.Debug("startConsul: Consul registration started", "address", cfg.Address)
+}
+
+// startKube starts the Kubernetes syncer, replacing the running one. The caller must hold publishMutex.
+func (n *NmapSD) startKube(cfg kube.Config) {
+	n.kubeCfg = cfg
+	if !cfg.Enabled() {
+		n.replaceOutput(&n.kube, nil, nil)
+		return
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = n.log
+	}
+	// The Kubernetes configuration was already checked by Validate
+	syncer, err := kube.New(cfg)
+	if err != nil {
+		// Client configurations such as the in-cluster token can change after validation
+		n.log.Error("Failed to start Kubernetes sync", "namespace", cfg.Namespace, "error", err)
+		n.replaceOutput(&n.kube, nil, nil)
+		return
+	}
+	n.replaceOutput(&n.kube, syncer.Run, func(data []sd.ServiceTarget, _ []sd.HostInfo) {
+		syncer.Update(data)
+	})
+	n.log.Debug("startKube: Kubernetes sync started", "namespace", cfg.Namespace)
+}
+
+// listenDNS creates the DNS server of cfg and binds its sockets, nil if DNS is disabled.
+// The server logs to log unless cfg sets its own logger.
+func listenDNS(log *slog.Logger, cfg dnssd.Config) (*dnssd.Server, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log
+	}
+	// The DNS configuration was already checked by Validate
+	server, _ := dnssd.New(cfg)
+	if err := server.Listen(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// reloadDNS applies a changed DNS configuration. The running server is reconfigured in place
+// if its address is unchanged, otherwise it is only replaced once the new server is bound:
+// if binding fails, the running server and its configuration are kept, so reloading the
+// same configuration again retries. The caller must hold publishMutex.
+func (n *NmapSD) reloadDNS(cfg dnssd.Config) {
+	if n.dns != nil && cfg.Addr == n.dnsCfg.Addr {
+		// The DNS configuration was already checked by Validate
+		n.dns.Reconfigure(cfg)
+		n.dnsCfg = cfg
+		n.log.Debug("reloadDNS: DNS server reconfigured", "zone", cfg.Zone, "ttl", cfg.TTL)
+		return
+	}
+	server, err := listenDNS(n.log, cfg)
+	if err != nil {
+		n.log.Error("Failed to start DNS server, keeping the current one", "addr", cfg.Addr, "error", err)
+		return
+	}
+	n.startDNS(cfg, server)
+}
+
+// startDNS serves DNS with the bound server in place of the running one, which is stopped
+// first. A nil server only stops the running one. The caller must hold publishMutex.
+func (n *NmapSD) startDNS(cfg dnssd.Config, server *dnssd.Server) {
+	n.dnsCfg = cfg
+	if server == nil {
+		n.replaceOutput(&n.dnsOutput, nil, nil)
+		n.dns = nil
+		return
+	}
+	n.replaceOutput(&n.dnsOutput, server.Serve, server.Update)
+	n.dns = server
+	n.log.Debug("startDNS: DNS server started", "addr", server.Addr(), "zone", cfg.Zone)
+}
+
+// schedule adds the periodic scan job of a profile, the first run happens after one interval.
+// A tick while a scan of the profile is running queues a scan instead of overlapping it.
+func (n *NmapSD) schedule(p *profileState) {
+	n.log.Debug("schedule: Scheduling profile", "profile", p.Name, "interval_minutes", p.ScanInterval)
+	job, err := n.scheduler.Every(p.ScanInterval).Minutes().WaitForSchedule().Do(func() {
+		n.requestScan(p.Name)
+	})
+	if err != nil {
+		n.log.Error("Failed to schedule scan", "profile", p.Name, "error", err)
+		return
+	}
+	p.job = job
+}
+
+// currentScanPath returns the API path of the scan results
+func (n *NmapSD) currentScanPath() string {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	return n.scanPath
+}
+
+// currentMetricsPath returns the path of the metrics endpoint, empty if it is disabled
+func (n *NmapSD) currentMetricsPath() string {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	return n.metricsPath
 }
 
 // handleScanResult returns the current scan results
 func (n *NmapSD) handleScanResult(c *gin.Context) {
-	slog.Debug("handleScanResult: Acquiring read lock")
+	n.log.Debug("handleScanResult: Acquiring read lock")
 	n.dataMutex.RLock()
 	data := n.data
 	initialized := n.initialized
+	stale := n.staleLocked()
 	n.dataMutex.RUnlock()
-	slog.Debug("handleScanResult: Read lock released", "initialized", initialized, "data_count", len(data))
+	n.log.Debug("handleScanResult: Read lock released", "initialized", initialized, "stale", stale, "data_count", len(data))
+
+	if stale {
+		c.Header(StaleHeader, "true")
+	}
 
 	if !initialized {
-		slog.Debug("handleScanResult: Scan not initialized, returning empty array")
+		n.log.Debug("handleScanResult: Scan not initialized, returning empty array")
 		c.JSON(200, []sd.ServiceTarget{})
 		return
 	}
 
-	slog.Debug("handleScanResult: Returning scan results", "service_groups", len(data))
+	n.log.Debug("handleScanResult: Returning scan results", "service_groups", len(data))
 	c.JSON(200, data)
 }
 
 // handleInfo renders an HTML page with host information
 func (n *NmapSD) handleInfo(c *gin.Context) {
-	slog.Debug("handleInfo: Acquiring read lock")
+	n.log.Debug("handleInfo: Acquiring read lock")
 	n.dataMutex.RLock()
 	hostInfo := n.hostInfo
 	initialized := n.initialized
+	stale := n.staleLocked()
 	n.dataMutex.RUnlock()
-	slog.Debug("handleInfo: Read lock released", "initialized", initialized, "host_count", len(hostInfo))
+	n.log.Debug("handleInfo: Read lock released", "initialized", initialized, "host_count", len(hostInfo))
 
 	if !initialized {
-		slog.Debug("handleInfo: Scan not initialized, returning scanning message")
+		n.log.Debug("handleInfo: Scan not initialized, returning scanning message")
 		c.Data(200, "text/html; charset=utf-8", []byte("<h1>Scanning in progress...</h1>"))
 		return
 	}
 
-	slog.Debug("handleInfo: Parsing HTML template")
+	n.log.Debug("handleInfo: Parsing HTML template")
 	tmpl := template.Must(template.New("info").Parse(`
 <!DOCTYPE html>
 <html>
@@ -247,6 +942,12 @@ func (n *NmapSD) handleInfo(c *gin.Context) {
             padding: 40px;
             color: #666;
         }
+        .stale {
+            background-color: #fff3cd;
+            color: #856404;
+            padding: 12px;
+            margin-bottom: 20px;
+        }
         .timestamp {
             color: #666;
             font-size: 14px;
@@ -257,6 +958,7 @@ func (n *NmapSD) handleInfo(c *gin.Context) {
 <body>
     <h1>Network Scan Results</h1>
     <div class="timestamp">Last updated: {{.Timestamp}}</div>
+    {{if .Stale}}<div class="stale">Showing saved results from before the last restart, a new scan is in progress</div>{{end}}
     {{if .Hosts}}
     <table>
         <thead>
@@ -294,60 +996,75 @@ func (n *NmapSD) handleInfo(c *gin.Context) {
 </html>
 `))
 
-	slog.Debug("handleInfo: Template parsed successfully")
+	n.log.Debug("handleInfo: Template parsed successfully")
 	data := map[string]interface{}{
 		"Hosts":     hostInfo,
+		"Stale":     stale,
 		"Timestamp": time.Now().Format("2006-01-02 15:04:05"),
 	}
-	slog.Debug("handleInfo: Rendering template with data", "host_count", len(hostInfo))
+	n.log.Debug("handleInfo: Rendering template with data", "host_count", len(hostInfo))
 
 	c.Header("Content-Type", "text/html; charset=utf-8")
 	err := tmpl.Execute(c.Writer, data)
 	if err != nil {
-		slog.Error("handleInfo: Template execution failed", "error", err)
+		n.log.Error("handleInfo: Template execution failed", "error", err)
 	} else {
-		slog.Debug("handleInfo: Template rendered successfully")
+		n.log.Debug("handleInfo: Template rendered successfully")
+	}
+}
+
+// Targets returns a copy of the targets currently served
+func (n *NmapSD) Targets() []sd.ServiceTarget {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	targets := make([]sd.ServiceTarget, 0, len(n.data))
+	for _, st := range n.data {
+		targets = append(targets, sd.ServiceTarget{Targets: slices.Clone(st.Targets), Labels: maps.Clone(st.Labels)})
 	}
+	return targets
 }
 
-// Stop gracefully stops the scheduler
+// Hosts returns a copy of the hosts found by the last successful scans of all profiles
+func (n *NmapSD) Hosts() []sd.HostInfo {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	hosts := make([]sd.HostInfo, 0, len(n.hostInfo))
+	for _, h := range n.hostInfo {
+		h.Ports = slices.Clone(h.Ports)
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// LastScan returns the time of the most recent successful scan of any profile,
+// or the zero time if no results are available yet. Results restored from the
+// state file report the time of the scan that produced them.
+func (n *NmapSD) LastScan() time.Time {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	var last time.Time
+	for _, p := range n.profiles {
+		if p.initialized && p.scanTime.After(last) {
+			last = p.scanTime
+		}
+	}
+	return last
+}
+
+// Stop gracefully stops the scheduler and cancels any running scan
 func (n *NmapSD) Stop() {
-	slog.Debug("Stop: Stopping scheduler")
+	n.log.Debug("Stop: Cancelling running scan")
+	if n.cancel != nil {
+		n.cancel()
+	}
+
+	n.log.Debug("Stop: Stopping scheduler")
 	if n.scheduler != nil {
 		n.scheduler.Stop()
-		slog.Debug("Stop: Scheduler stopped successfully")
+		n.log.Debug("Stop: Scheduler stopped successfully")
 	} else {
-		slog.Debug("Stop: No scheduler to stop")
-	}
-}
-
-// setLogLevel sets the global log level based on the configuration
-func setLogLevel(level string) {
-	slog.Debug("setLogLevel: Setting log level", "requested_level", level)
-	var logLevel slog.Level
-	switch strings.ToUpper(level) {
-	case "DEBUG":
-		logLevel = slog.LevelDebug
-		slog.Debug("setLogLevel: DEBUG level selected")
-	case "ERROR":
-		logLevel = slog.LevelError
-		slog.Debug("setLogLevel: ERROR level selected")
-	case "INFO":
-		logLevel = slog.LevelInfo
-		slog.Debug("setLogLevel: INFO level selected")
-	default:
-		logLevel = slog.LevelInfo
-		slog.Debug("setLogLevel: Unknown level, defaulting to INFO", "provided_level", level)
-	}
-
-	opts := &slog.HandlerOptions{
-		Level: logLevel,
-	}
-	handler := slog.NewTextHandler(os.Stdout, opts)
-	logger := slog.New(handler)
-	slog.SetDefault(logger)
-
-	// Log after setting the new level
-	slog.Debug("setLogLevel: Log level configured", "level", level)
-	slog.Info("Log level set", "level", strings.ToUpper(level))
+		n.log.Debug("Stop: No scheduler to stop")
+	}
+
+	n.closeHistory()
 }
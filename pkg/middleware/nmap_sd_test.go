@@ -1,9 +1,24 @@
 package middleware
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
 	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/webhook"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -65,3 +80,345 @@ func TestCustomPorts(t *testing.T) {
 		t.Errorf("Expected first port to be 3000, got %d", cfg.Ports[0].Port)
 	}
 }
+
+// blockingScanner is a Scanner that blocks until the context is done
+type blockingScanner struct {
+	started chan struct{}
+}
+
+func (b *blockingScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]sd.HostInfo, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingScanner) ScanPorts(ctx context.Context, hosts []string, ports []sd.PortService) ([]sd.HostInfo, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestStopCancelsRunningScan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	scanner := &blockingScanner{started: make(chan struct{})}
+	profile := &profileState{ScanProfile: ScanProfile{Name: DefaultProfileName, Targets: []string{"10.0.0.0/24"}}}
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		profiles:    []*profileState{profile},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		nsd.performScan(profile)
+		close(done)
+	}()
+
+	<-scanner.started
+	nsd.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to cancel the running scan")
+	}
+
+	if nsd.initialized {
+		t.Error("Expected cancelled scan to leave results uninitialized")
+	}
+}
+
+func TestDefaultScanTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+
+	if cfg.ScanTimeout != sd.DefaultScanTimeout {
+		t.Errorf("Expected default ScanTimeout to be %s, got %s", sd.DefaultScanTimeout, cfg.ScanTimeout)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "cidr only", cfg: Config{CIDR: "10.0.0.0/24"}},
+		{name: "targets only", cfg: Config{Targets: []string{"10.0.0.0/24", "10.0.1.1-20", "db-01.dc.local"}}},
+		{name: "with excludes", cfg: Config{CIDR: "10.0.0.0/24", Excludes: []string{"10.0.0.5", "printer.local"}}},
+		{name: "no targets", cfg: Config{}, wantErr: true},
+		{name: "invalid target", cfg: Config{Targets: []string{"10.0.0.0/99"}}, wantErr: true},
+		{name: "invalid exclude", cfg: Config{CIDR: "10.0.0.0/24", Excludes: []string{"-sC"}}, wantErr: true},
+		{name: "invalid file_sd", cfg: Config{CIDR: "10.0.0.0/24", FileSD: filesd.Config{Path: "targets.json", Format: "xml"}}, wantErr: true},
+		{name: "invalid relabel", cfg: Config{CIDR: "10.0.0.0/24", RelabelConfigs: []relabel.Config{{Action: relabel.Drop}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr && err == nil {
+				t.Error("Expected validation error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected configuration to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewPanicsOnInvalidTargets(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected New to panic on invalid targets")
+		}
+	}()
+
+	New(Config{Targets: []string{"not a target"}})
+}
+
+func TestNewNmapSD(t *testing.T) {
+	if _, err := NewNmapSD(Config{Targets: []string{"not a target"}}); err == nil {
+		t.Error("Expected NewNmapSD to reject invalid targets")
+	}
+
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	nsd, err := NewNmapSD(Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Scanner: scanner,
+	})
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if !nsd.LastScan().IsZero() {
+		t.Error("Expected no last scan before the first scan finished")
+	}
+
+	waitFor(t, "initial scan", func() bool { return len(nsd.Targets()) == 1 })
+	targets := nsd.Targets()
+	if targets[0].Targets[0] != "10.0.0.1:80" || targets[0].Labels["job"] != "http_services" {
+		t.Errorf("Unexpected targets: %+v", targets)
+	}
+	targets[0].Labels["job"] = "modified"
+	if nsd.Targets()[0].Labels["job"] != "http_services" {
+		t.Error("Expected Targets to return a copy")
+	}
+	if hosts := nsd.Hosts(); len(hosts) != 1 || hosts[0].IP != "10.0.0.1" {
+		t.Errorf("Unexpected hosts: %+v", hosts)
+	}
+	if last := nsd.LastScan(); last.IsZero() || time.Since(last) > time.Minute {
+		t.Errorf("Unexpected last scan time: %v", last)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(nsd.Handler())
+	r.GET("/api/targets", nsd.ResultsHandler())
+	for _, path := range []string{"/mgsd", "/api/targets"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "10.0.0.1:80") {
+			t.Errorf("%s: unexpected response %d %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPerformScanWritesFileSD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	writer, err := filesd.NewWriter(filesd.Config{Path: path})
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	profile := &profileState{ScanProfile: ScanProfile{
+		Name:    DefaultProfileName,
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		profiles:    []*profileState{profile},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         context.Background(),
+		fileSD:      writer,
+	}
+
+	nsd.performScan(profile)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected file_sd output to be written: %v", err)
+	}
+	var got []sd.ServiceTarget
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to decode file_sd output: %v", err)
+	}
+	if len(got) != 1 || got[0].Targets[0] != "10.0.0.1:80" {
+		t.Errorf("Unexpected file_sd targets: %+v", got)
+	}
+}
+
+func TestPerformScanReportsDiff(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	profile := &profileState{ScanProfile: ScanProfile{
+		Name:    DefaultProfileName,
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	calls := make(chan sd.ScanDiff, 4)
+	diffs := make(chan sd.ScanDiff, 1)
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		profiles:    []*profileState{profile},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         context.Background(),
+		onDiff:      func(d sd.ScanDiff) { calls <- d },
+		diffs:       diffs,
+	}
+
+	// Neither the first nor an unchanged result is reported, so the first diff is the one of the third scan
+	nsd.performScan(profile)
+	nsd.performScan(profile)
+	scanner.hosts["10.0.0.0/24"] = append(scanner.hosts["10.0.0.0/24"], sd.HostInfo{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}})
+	nsd.performScan(profile)
+	var diff sd.ScanDiff
+	select {
+	case diff = <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the diff")
+	}
+	if diff.Profile != DefaultProfileName {
+		t.Errorf("Expected diff of profile %q, got %q", DefaultProfileName, diff.Profile)
+	}
+	want := []sd.ChangeType{sd.HostAdded, sd.PortOpened, sd.TargetAdded}
+	if len(diff.Changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %+v", len(want), diff.Changes)
+	}
+	for i, typ := range want {
+		if diff.Changes[i].Type != typ {
+			t.Errorf("Change %d: expected %s, got %s", i, typ, diff.Changes[i].Type)
+		}
+	}
+	if diff.Changes[2].Target != "10.0.0.2:80" {
+		t.Errorf("Expected target 10.0.0.2:80 to be added, got %q", diff.Changes[2].Target)
+	}
+
+	select {
+	case d := <-diffs:
+		if len(d.Changes) != len(want) {
+			t.Errorf("Expected the same diff on the channel, got %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the diff to be sent on the channel")
+	}
+	select {
+	case d := <-calls:
+		t.Errorf("Expected a single diff, got another one: %+v", d)
+	default:
+	}
+}
+
+func TestOnDiffCallsBack(t *testing.T) {
+	hosts := []sd.HostInfo{{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}}
+	cfg := Config{
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "web"}},
+		Scanner: &staticScanner{hosts: map[string][]sd.HostInfo{"10.0.0.0/24": hosts}},
+	}
+	var nsd *NmapSD
+	called := make(chan error, 1)
+	cfg.OnDiff = func(sd.ScanDiff) {
+		// Both wait for the instance to publish, which must not wait for the callback
+		err := nsd.Reload(cfg)
+		if err == nil {
+			err = nsd.TriggerScan(context.Background())
+		}
+		called <- err
+	}
+	var err error
+	nsd, err = NewNmapSD(cfg)
+	if err != nil {
+		t.Fatalf("NewNmapSD failed: %v", err)
+	}
+	defer nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	cfg.Scanner = &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": append(hosts, sd.HostInfo{IP: "10.0.0.2", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}),
+	}}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+	select {
+	case err := <-called:
+		if err != nil {
+			t.Errorf("Calling back from OnDiff failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the callback to call back into the instance")
+	}
+}
+
+func TestPerformScanSendsWebhook(t *testing.T) {
+	payloads := make(chan webhook.Payload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify("s3cret", body, r.Header.Get(webhook.SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var p webhook.Payload
+		json.Unmarshal(body, &p)
+		payloads <- p
+	}))
+	defer srv.Close()
+
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	profile := &profileState{ScanProfile: ScanProfile{
+		Name:    DefaultProfileName,
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		profiles:    []*profileState{profile},
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	nsd.startWebhooks([]webhook.Config{{URL: srv.URL, Secret: "s3cret"}})
+
+	nsd.performScan(profile)
+	scanner.hosts["10.0.0.0/24"] = nil
+	nsd.performScan(profile)
+
+	select {
+	case p := <-payloads:
+		if len(p.Removed) != 1 || p.Removed[0].Target != "10.0.0.1:80" || len(p.Added) != 0 {
+			t.Errorf("Unexpected webhook payload: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a signed webhook delivery")
+	}
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/go-co-op/gocron"
+)
+
+// DefaultProfileName is the name of the profile built from the top-level Config targets
+const DefaultProfileName = "default"
+
+// ScanProfile is a named set of targets scanned with its own ports, schedule and labels
+type ScanProfile struct {
+	// Profile name, must be unique (e.g., "datacenter")
+	Name string
+	// Targets to scan: CIDRs, nmap ranges, single hosts or hostnames
+	Targets []string
+	// Targets that must never be probed, in addition to Config.Excludes
+	Excludes []string
+	// Ports to scan (default: Config.Ports)
+	Ports []sd.PortService
+	// Scan interval in minutes (default: Config.ScanInterval)
+	ScanInterval int
+	// Static labels added to every target group of this profile
+	Labels map[string]string
+}
+
+// profileState holds a profile and the results of its last successful scan
+type profileState struct {
+	ScanProfile
+	job         *gocron.Job
+	data        []sd.ServiceTarget
+	hostInfo    []sd.HostInfo
+	initialized bool
+	// Time of the scan that produced data
+	scanTime time.Time
+	// Number of hosts found up by the discovery phase of that scan
+	hostsUp int
+	// The results were restored from the state file and not rescanned yet
+	stale bool
+}
+
+// scanProfiles returns the configured profiles with defaults from the top-level fields applied.
+// Top-level CIDR and Targets form an additional profile named DefaultProfileName.
+func (c Config) scanProfiles() []ScanProfile {
+	var profiles []ScanProfile
+	if targets := c.scanTargets(); len(targets) > 0 {
+		profiles = append(profiles, ScanProfile{
+			Name:    DefaultProfileName,
+			Targets: targets,
+		})
+	}
+	profiles = append(profiles, c.Profiles...)
+
+	resolved := make([]ScanProfile, 0, len(profiles))
+	for _, p := range profiles {
+		p.Excludes = append(append([]string{}, c.Excludes...), p.Excludes...)
+		if len(p.Ports) == 0 {
+			p.Ports = c.Ports
+		}
+		if p.ScanInterval <= 0 {
+			p.ScanInterval = c.ScanInterval
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved
+}
+
+// validateProfiles checks profile names, targets and exclusions
+func validateProfiles(profiles []ScanProfile) error {
+	if len(profiles) == 0 {
+		return fmt.Errorf("no scan targets configured")
+	}
+	seen := make(map[string]bool, len(profiles))
+	for _, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile without name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		seen[p.Name] = true
+		if len(p.Targets) == 0 {
+			return fmt.Errorf("profile %q: no scan targets configured", p.Name)
+		}
+		if err := sd.ValidateTargets(p.Targets); err != nil {
+			return fmt.Errorf("profile %q: targets: %w", p.Name, err)
+		}
+		if err := sd.ValidateTargets(p.Excludes); err != nil {
+			return fmt.Errorf("profile %q: excludes: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// mergeResults merges the results of all scanned profiles into a single view.
+// Profile labels are added to each target group unless the group already sets them,
+// and hosts found by several profiles are merged by IP.
+func mergeResults(log *slog.Logger, profiles []*profileState) ([]sd.ServiceTarget, []sd.HostInfo, bool) {
+	log.Debug("mergeResults: Merging profile results", "profile_count", len(profiles))
+	data := []sd.ServiceTarget{}
+	hostInfo := []sd.HostInfo{}
+	hostIndex := make(map[string]int)
+	initialized := false
+
+	for _, p := range profiles {
+		if !p.initialized {
+			log.Debug("mergeResults: Profile not scanned yet, skipping", "profile", p.Name)
+			continue
+		}
+		initialized = true
+
+		for _, st := range p.data {
+			labels := make(map[string]string, len(p.Labels)+len(st.Labels))
+			for k, v := range p.Labels {
+				labels[k] = v
+			}
+			for k, v := range st.Labels {
+				labels[k] = v
+			}
+			data = append(data, sd.ServiceTarget{Targets: st.Targets, Labels: labels})
+		}
+
+		for _, h := range p.hostInfo {
+			i, exists := hostIndex[h.IP]
+			if !exists {
+				hostIndex[h.IP] = len(hostInfo)
+				h.Ports = append([]sd.PortInfo{}, h.Ports...)
+				hostInfo = append(hostInfo, h)
+				continue
+			}
+			merged := &hostInfo[i]
+			for _, port := range h.Ports {
+				found := false
+				for _, existing := range merged.Ports {
+					if existing.Port == port.Port {
+						found = true
+						break
+					}
+				}
+				if !found {
+					merged.Ports = append(merged.Ports, port)
+				}
+			}
+			log.Debug("mergeResults: Merged host found by several profiles", "ip", h.IP, "profile", p.Name)
+		}
+	}
+
+	log.Debug("mergeResults: Profile results merged", "service_groups", len(data), "hosts", len(hostInfo))
+	return data, hostInfo, initialized
+}
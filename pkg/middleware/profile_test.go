@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// staticScanner is a Scanner returning fixed hosts per target
+type staticScanner struct {
+	hosts map[string][]sd.HostInfo
+}
+
+func (s *staticScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]sd.HostInfo, error) {
+	var hosts []sd.HostInfo
+	for _, t := range targets {
+		hosts = append(hosts, s.hosts[t]...)
+	}
+	return hosts, nil
+}
+
+func (s *staticScanner) ScanPorts(ctx context.Context, hosts []string, ports []sd.PortService) ([]sd.HostInfo, error) {
+	want := make(map[uint16]bool)
+	for _, ps := range ports {
+		want[ps.Port] = true
+	}
+	byIP := make(map[string]sd.HostInfo)
+	for _, list := range s.hosts {
+		for _, h := range list {
+			byIP[h.IP] = h
+		}
+	}
+	var result []sd.HostInfo
+	for _, ip := range hosts {
+		h, ok := byIP[ip]
+		if !ok {
+			continue
+		}
+		var portInfos []sd.PortInfo
+		for _, p := range h.Ports {
+			if want[p.Port] {
+				portInfos = append(portInfos, p)
+			}
+		}
+		if len(portInfos) > 0 {
+			h.Ports = portInfos
+			result = append(result, h)
+		}
+	}
+	return result, nil
+}
+
+func TestScanProfilesDefaults(t *testing.T) {
+	cfg := Config{
+		CIDR:         "192.168.2.0/24",
+		Excludes:     []string{"192.168.2.9"},
+		ScanInterval: 60,
+		Ports:        []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Profiles: []ScanProfile{
+			{
+				Name:         "datacenter",
+				Targets:      []string{"10.0.3.0/24"},
+				Excludes:     []string{"10.0.3.1"},
+				Ports:        []sd.PortService{{Port: 9182, Name: "windows_exporter", Job: "windows_exporter"}},
+				ScanInterval: 5,
+			},
+		},
+	}
+
+	profiles := cfg.scanProfiles()
+	if len(profiles) != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", len(profiles))
+	}
+
+	def, dc := profiles[0], profiles[1]
+	if def.Name != DefaultProfileName || def.ScanInterval != 60 || len(def.Ports) != 1 || def.Ports[0].Port != 80 {
+		t.Errorf("Unexpected default profile: %+v", def)
+	}
+
+	if dc.ScanInterval != 5 || dc.Ports[0].Port != 9182 {
+		t.Errorf("Unexpected datacenter profile: %+v", dc)
+	}
+
+	if len(dc.Excludes) != 2 || dc.Excludes[0] != "192.168.2.9" || dc.Excludes[1] != "10.0.3.1" {
+		t.Errorf("Expected global and profile excludes, got %v", dc.Excludes)
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "profiles only", cfg: Config{Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}}}}},
+		{name: "unnamed profile", cfg: Config{Profiles: []ScanProfile{{Targets: []string{"10.0.0.0/24"}}}}, wantErr: true},
+		{name: "duplicate profile", cfg: Config{CIDR: "10.0.0.0/24", Profiles: []ScanProfile{{Name: DefaultProfileName, Targets: []string{"10.0.1.0/24"}}}}, wantErr: true},
+		{name: "profile without targets", cfg: Config{Profiles: []ScanProfile{{Name: "office"}}}, wantErr: true},
+		{name: "invalid profile exclude", cfg: Config{Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}, Excludes: []string{"10.0.0.0/64"}}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr && err == nil {
+				t.Error("Expected validation error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected configuration to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProfilesMergeResults(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.3.0/24": {{IP: "10.0.3.15", Ports: []sd.PortInfo{{Port: 9182, State: "open"}, {Port: 80, State: "open"}}}},
+		"192.168.2.0/24": {
+			{IP: "192.168.2.11", Ports: []sd.PortInfo{{Port: 80, State: "open"}}},
+			{IP: "10.0.3.15", Ports: []sd.PortInfo{{Port: 9182, State: "open"}, {Port: 80, State: "open"}}},
+		},
+	}}
+
+	nsd := &NmapSD{log: slog.Default(), scanner: scanner, scanTimeout: time.Minute, ctx: context.Background()}
+	cfg := Config{
+		Ports: []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Profiles: []ScanProfile{
+			{
+				Name:    "datacenter",
+				Targets: []string{"10.0.3.0/24"},
+				Ports:   []sd.PortService{{Port: 9182, Name: "windows_exporter", Job: "windows_exporter"}},
+				Labels:  map[string]string{"site": "dc", "job": "ignored"},
+			},
+			{
+				Name:    "office",
+				Targets: []string{"192.168.2.0/24"},
+				Labels:  map[string]string{"site": "office"},
+			},
+		},
+	}
+	for _, p := range cfg.scanProfiles() {
+		nsd.profiles = append(nsd.profiles, &profileState{ScanProfile: p})
+	}
+
+	nsd.performScan(nsd.profiles[0])
+	if !nsd.initialized || len(nsd.data) != 1 {
+		t.Fatalf("Expected partial results after first profile, got %+v", nsd.data)
+	}
+
+	nsd.performScan(nsd.profiles[1])
+	if len(nsd.data) != 3 {
+		t.Fatalf("Expected 3 service groups, got %d", len(nsd.data))
+	}
+
+	dc, office := nsd.data[0], nsd.data[1]
+	if dc.Labels["job"] != "windows_exporter" || dc.Labels["site"] != "dc" || dc.Labels[sd.MetaLabelProfile] != "datacenter" {
+		t.Errorf("Unexpected datacenter labels: %v", dc.Labels)
+	}
+	if office.Labels["job"] != "http_services" || office.Labels["site"] != "office" || office.Labels[sd.MetaLabelProfile] != "office" {
+		t.Errorf("Unexpected office labels: %v", office.Labels)
+	}
+
+	relabeler, err := relabel.New([]relabel.Config{
+		{Action: relabel.Drop, SourceLabels: []string{"site"}, Regex: "office"},
+	}, nsd.log)
+	if err != nil {
+		t.Fatalf("relabel.New returned error: %v", err)
+	}
+	nsd.relabeler = relabeler
+	nsd.performScan(nsd.profiles[1])
+	if len(nsd.data) != 1 || nsd.data[0].Labels["site"] != "dc" {
+		t.Errorf("Expected office targets to be dropped by relabeling, got %+v", nsd.data)
+	}
+
+	if len(nsd.hostInfo) != 2 {
+		t.Fatalf("Expected 2 merged hosts, got %d", len(nsd.hostInfo))
+	}
+	if nsd.hostInfo[0].IP != "10.0.3.15" || len(nsd.hostInfo[0].Ports) != 2 {
+		t.Errorf("Expected 10.0.3.15 with ports from both profiles, got %+v", nsd.hostInfo[0])
+	}
+}
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/filesd"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/relabel"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/go-co-op/gocron"
+)
+
+// Reload applies a new configuration to the running instance without restarting it.
+// Unset fields get the same defaults as in New. Profiles whose targets, exclusions and
+// ports are unchanged keep their results, profiles whose interval changed get a new
+// scan job, and new or changed profiles are scanned right away.
+// The current scanner, OnDiff callback and Diffs channel are kept unless the configuration sets them.
+// Logger and LogHandler are fixed when the instance is created, LogLevel applies right away.
+// If the configuration is invalid, Reload returns an error and keeps the current one.
+func (n *NmapSD) Reload(cfg Config) error {
+	n.log.Debug("Reload: Reloading configuration")
+	if n.ctx.Err() != nil {
+		return fmt.Errorf("nmap_sd: instance stopped")
+	}
+	cfg = withDefaults(n.log, cfg)
+	if err := cfg.validate(n.log); err != nil {
+		return fmt.Errorf("nmap_sd: invalid configuration: %w", err)
+	}
+
+	n.publishMutex.Lock()
+	defer n.publishMutex.Unlock()
+
+	if level := parseLogLevel(cfg.LogLevel); level != n.logLevel.Level() {
+		n.log.Debug("Reload: Log level changed", "old", n.logLevel.Level(), "new", level)
+		n.logLevel.Set(level)
+	}
+
+	// Relabel rules and the file_sd configuration were already checked by Validate
+	relabeler, _ := relabel.New(cfg.RelabelConfigs, n.log)
+	fileSD := n.fileSD
+	if cfg.FileSD != n.fileSDCfg {
+		fileSD = nil
+		if cfg.FileSD.Path != "" {
+			fileSD, _ = filesd.NewWriter(cfg.FileSD)
+		}
+		n.log.Debug("Reload: file_sd output changed", "path", cfg.FileSD.Path)
+	}
+
+	current := make(map[string]*profileState, len(n.profiles))
+	for _, p := range n.profiles {
+		current[p.Name] = p
+	}
+
+	var profiles, reschedule, rescan []*profileState
+	var removed []*gocron.Job
+
+	n.dataMutex.Lock()
+	for _, sp := range cfg.scanProfiles() {
+		p, exists := current[sp.Name]
+		delete(current, sp.Name)
+		switch {
+		case !exists:
+			n.log.Debug("Reload: Profile added", "profile", sp.Name)
+			p = &profileState{ScanProfile: sp}
+			reschedule = append(reschedule, p)
+			rescan = append(rescan, p)
+		case !sameScan(p.ScanProfile, sp):
+			n.log.Debug("Reload: Profile targets or ports changed", "profile", sp.Name)
+			removed = append(removed, p.job)
+			p = &profileState{ScanProfile: sp}
+			reschedule = append(reschedule, p)
+			rescan = append(rescan, p)
+		default:
+			// Labels are only read under dataMutex, so the running profile is updated in place
+			p.Labels = sp.Labels
+			if p.ScanInterval != sp.ScanInterval {
+				n.log.Debug("Reload: Profile interval changed", "profile", sp.Name, "old", p.ScanInterval, "new", sp.ScanInterval)
+				removed = append(removed, p.job)
+				p.ScanInterval = sp.ScanInterval
+				reschedule = append(reschedule, p)
+			}
+		}
+		profiles = append(profiles, p)
+	}
+	for name, p := range current {
+		n.log.Debug("Reload: Profile removed", "profile", name)
+		removed = append(removed, p.job)
+	}
+
+	n.profiles = profiles
+	n.scanPath = cfg.ScanPath
+	n.scanTimeout = cfg.ScanTimeout
+	n.relabeler = relabeler
+	n.fileSD = fileSD
+	n.fileSDCfg = cfg.FileSD
+	n.stateFile = cfg.StateFile
+	n.metricsPath = cfg.MetricsPath
+	if cfg.OnDiff != nil {
+		n.onDiff = cfg.OnDiff
+	}
+	if cfg.Diffs != nil {
+		n.diffs = cfg.Diffs
+	}
+	if cfg.Scanner != nil {
+		n.scanner = cfg.Scanner
+	} else if nmapScanner, ok := n.scanner.(*sd.NmapScanner); ok && nmapScanner.DualStack != cfg.DualStack {
+		n.scanner = &sd.NmapScanner{DualStack: cfg.DualStack}
+	}
+	changes := n.mergeLocked()
+	data, hostInfo, initialized := n.data, n.hostInfo, n.initialized
+	n.dataMutex.Unlock()
+
+	if !reflect.DeepEqual(cfg.Webhooks, n.webhookCfgs) {
+		n.log.Debug("Reload: Webhooks changed", "count", len(cfg.Webhooks))
+		n.startWebhooks(cfg.Webhooks)
+	}
+	if !reflect.DeepEqual(cfg.Consul, n.consulCfg) {
+		n.log.Debug("Reload: Consul registration changed", "address", cfg.Consul.Address)
+		n.startConsul(cfg.Consul)
+	} else if initialized {
+		n.consul.Update(data, hostInfo)
+	}
+	if !reflect.DeepEqual(cfg.Kubernetes, n.kubeCfg) {
+		n.log.Debug("Reload: Kubernetes sync changed", "namespace", cfg.Kubernetes.Namespace)
+		n.startKube(cfg.Kubernetes)
+	} else if initialized {
+		n.kube.Update(data, hostInfo)
+	}
+	if cfg.DNS != n.dnsCfg {
+		n.log.Debug("Reload: DNS server changed", "addr", cfg.DNS.Addr)
+		n.reloadDNS(cfg.DNS)
+	} else if initialized {
+		n.dnsOutput.Update(data, hostInfo)
+	}
+	n.openHistory(cfg.History)
+
+	writeFileSD(n.log, fileSD, data)
+	n.saveState()
+	n.notifyDiff("", changes)
+
+	for _, job := range removed {
+		if job != nil {
+			n.scheduler.RemoveByReference(job)
+		}
+	}
+	for _, p := range reschedule {
+		n.schedule(p)
+	}
+	for _, p := range rescan {
+		n.log.Debug("Reload: Launching scan of changed profile", "profile", p.Name)
+		n.requestScan(p.Name)
+	}
+
+	n.log.Info("Configuration reloaded", "profiles", len(profiles), "rescheduled", len(reschedule), "rescanned", len(rescan))
+	return nil
+}
+
+// watchUpdates reloads every configuration received on updates until the instance stops
+func (n *NmapSD) watchUpdates(updates <-chan Config) {
+	for {
+		select {
+		case <-n.ctx.Done():
+			n.log.Debug("watchUpdates: Instance stopped")
+			return
+		case cfg, ok := <-updates:
+			if !ok {
+				n.log.Debug("watchUpdates: Updates channel closed")
+				return
+			}
+			if err := n.Reload(cfg); err != nil {
+				n.log.Error("Failed to reload configuration, keeping current configuration", "error", err)
+			}
+		}
+	}
+}
+
+// sameScan reports whether two profiles probe the same targets and ports
+func sameScan(a, b ScanProfile) bool {
+	return reflect.DeepEqual(a.Targets, b.Targets) &&
+		reflect.DeepEqual(a.Excludes, b.Excludes) &&
+		reflect.DeepEqual(a.Ports, b.Ports)
+}
@@ -0,0 +1,274 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/history"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/go-co-op/gocron"
+)
+
+// waitFor polls cond until it is true or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestNmapSD returns a started instance without profiles using the given scanner
+func newTestNmapSD(t *testing.T, scanner sd.Scanner) *NmapSD {
+	ctx, cancel := context.WithCancel(context.Background())
+	nsd := &NmapSD{
+		log:         slog.Default(),
+		scanPath:    "/mgsd",
+		logLevel:    new(slog.LevelVar),
+		scanner:     scanner,
+		scanTimeout: time.Minute,
+		scheduler:   gocron.NewScheduler(time.Local),
+		ctx:         ctx,
+		cancel:      cancel,
+		data:        []sd.ServiceTarget{},
+	}
+	nsd.scheduler.StartAsync()
+	t.Cleanup(nsd.Stop)
+	return nsd
+}
+
+// servedTargets returns the targets currently served
+func servedTargets(n *NmapSD) []string {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	var targets []string
+	for _, st := range n.data {
+		targets = append(targets, st.Targets...)
+	}
+	return targets
+}
+
+func TestReload(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		"10.0.1.0/24": {{IP: "10.0.1.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	ports := []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}}
+
+	cfg := Config{
+		Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}}},
+		Ports:    ports,
+	}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	waitFor(t, "initial scan", func() bool { return len(servedTargets(nsd)) == 1 })
+	office := nsd.profiles[0]
+	firstJob := office.job
+	if firstJob == nil {
+		t.Fatal("Expected profile to be scheduled")
+	}
+
+	// Interval and label changes keep the results and only replace the job
+	cfg.Profiles[0].ScanInterval = 10
+	cfg.Profiles[0].Labels = map[string]string{"site": "hq"}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if nsd.profiles[0] != office || !office.initialized {
+		t.Error("Expected unchanged profile to keep its results")
+	}
+	if office.job == firstJob {
+		t.Error("Expected the scan job to be rebuilt after an interval change")
+	}
+	if jobs := nsd.scheduler.Jobs(); len(jobs) != 1 {
+		t.Errorf("Expected 1 scheduled job, got %d", len(jobs))
+	}
+	nsd.dataMutex.RLock()
+	site := nsd.data[0].Labels["site"]
+	nsd.dataMutex.RUnlock()
+	if site != "hq" {
+		t.Errorf("Expected new profile labels to be served, got %q", site)
+	}
+
+	// Changed targets are scanned again right away
+	cfg.Profiles[0].Targets = []string{"10.0.1.0/24"}
+	cfg.ScanPath = "/targets"
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	waitFor(t, "rescan", func() bool {
+		targets := servedTargets(nsd)
+		return len(targets) == 1 && targets[0] == "10.0.1.1:80"
+	})
+	if path := nsd.currentScanPath(); path != "/targets" {
+		t.Errorf("Expected scan path to be reloaded, got %q", path)
+	}
+
+	// Invalid configurations are rejected and the current one is kept
+	cfg.Profiles[0].Targets = []string{"not a target"}
+	if err := nsd.Reload(cfg); err == nil {
+		t.Error("Expected invalid configuration to be rejected")
+	}
+	if nsd.profiles[0].Targets[0] != "10.0.1.0/24" {
+		t.Errorf("Expected current profile to be kept, got %v", nsd.profiles[0].Targets)
+	}
+}
+
+func TestReloadRemovesProfiles(t *testing.T) {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		"10.0.1.0/24": {{IP: "10.0.1.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	ports := []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}}
+
+	updates := make(chan Config)
+	go nsd.watchUpdates(updates)
+	updates <- Config{
+		Profiles: []ScanProfile{
+			{Name: "office", Targets: []string{"10.0.0.0/24"}},
+			{Name: "lab", Targets: []string{"10.0.1.0/24"}},
+		},
+		Ports: ports,
+	}
+	waitFor(t, "both profiles", func() bool { return len(servedTargets(nsd)) == 2 })
+
+	updates <- Config{
+		Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}}},
+		Ports:    ports,
+	}
+	waitFor(t, "removed profile", func() bool { return len(servedTargets(nsd)) == 1 })
+	if jobs := nsd.scheduler.Jobs(); len(jobs) != 1 {
+		t.Errorf("Expected 1 scheduled job, got %d", len(jobs))
+	}
+}
+
+// overlapScanner is a gatedScanner recording the most discoveries running at the same time
+type overlapScanner struct {
+	gatedScanner
+	active, maxActive atomic.Int32
+}
+
+func (o *overlapScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]sd.HostInfo, error) {
+	active := o.active.Add(1)
+	defer o.active.Add(-1)
+	for {
+		max := o.maxActive.Load()
+		if active <= max || o.maxActive.CompareAndSwap(max, active) {
+			break
+		}
+	}
+	return o.gatedScanner.Discover(ctx, targets, excludes)
+}
+
+func TestReloadDoesNotOverlapScans(t *testing.T) {
+	scanner := &overlapScanner{gatedScanner: gatedScanner{
+		staticScanner: staticScanner{hosts: map[string][]sd.HostInfo{
+			"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}, {Port: 443, State: "open"}}}},
+		}},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	cfg := Config{
+		Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}}},
+		Ports:    []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	<-scanner.started
+
+	// Changed ports replace the profile while its scan is running
+	cfg.Ports = append(cfg.Ports, sd.PortService{Port: 443, Name: "https", Job: "https_services"})
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	triggered := make(chan error, 1)
+	go func() { triggered <- nsd.TriggerScan(context.Background()) }()
+	waitFor(t, "queued scan", func() bool { return nsd.scanState("office") == ScanQueued })
+	select {
+	case <-scanner.started:
+		t.Error("Expected the rescan to wait for the running scan")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(scanner.release)
+	select {
+	case err := <-triggered:
+		if err != nil {
+			t.Errorf("TriggerScan failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for TriggerScan")
+	}
+	if max := scanner.maxActive.Load(); max != 1 {
+		t.Errorf("Expected at most 1 scan of the profile at a time, got %d", max)
+	}
+	if runs := scanner.runs.Load(); runs != 2 {
+		t.Errorf("Expected the rescan and the trigger to share one queued scan, got %d scans", runs)
+	}
+}
+
+func TestReloadDiscardsReplacedScan(t *testing.T) {
+	scanner := &gatedScanner{
+		staticScanner: staticScanner{hosts: map[string][]sd.HostInfo{
+			"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+			"10.0.1.0/24": {{IP: "10.0.1.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		}},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	nsd := newTestNmapSD(t, scanner)
+	cfg := Config{
+		Profiles: []ScanProfile{{Name: "office", Targets: []string{"10.0.0.0/24"}}},
+		Ports:    []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		History:  history.Config{Path: filepath.Join(t.TempDir(), "history.db")},
+	}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	<-scanner.started
+	replaced := nsd.profiles[0]
+
+	cfg.Profiles[0].Targets = []string{"10.0.1.0/24"}
+	if err := nsd.Reload(cfg); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	close(scanner.release)
+	if err := nsd.TriggerScan(context.Background()); err != nil {
+		t.Fatalf("TriggerScan failed: %v", err)
+	}
+
+	if replaced.initialized {
+		t.Error("Expected the results of the replaced profile to be discarded")
+	}
+	if targets := servedTargets(nsd); len(targets) != 1 || targets[0] != "10.0.1.1:80" {
+		t.Errorf("Expected only the targets of the reloaded profile, got %v", targets)
+	}
+	scans, err := nsd.history.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(scans) != 1 {
+		t.Errorf("Expected only the scan of the reloaded profile to be archived, got %d", len(scans))
+	}
+}
+
+func TestReloadAfterStop(t *testing.T) {
+	nsd := newTestNmapSD(t, &staticScanner{})
+	nsd.Stop()
+	if err := nsd.Reload(Config{CIDR: "10.0.0.0/24"}); err == nil {
+		t.Error("Expected Reload of a stopped instance to fail")
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"slices"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/render"
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RenderPathSuffix is appended to the scan path to form the static scrape configuration
+// endpoints: ScanPath + "/render/<format>" returns the served targets rendered in one of
+// render.Formats. Manifests accept ?namespace= and ?prefix= for their metadata.
+const RenderPathSuffix = "/render"
+
+// handleRender serves the served targets rendered in format
+func (n *NmapSD) handleRender(c *gin.Context, format string) {
+	if !slices.Contains(render.Formats(), render.Format(format)) {
+		n.log.Debug("handleRender: Unknown format", "format", format)
+		c.JSON(404, gin.H{"error": "unknown format, expected one of " + formatList()})
+		return
+	}
+
+	n.dataMutex.RLock()
+	data := n.data
+	initialized := n.initialized
+	stale := n.staleLocked()
+	n.dataMutex.RUnlock()
+
+	if stale {
+		c.Header(StaleHeader, "true")
+	}
+	if !initialized {
+		data = []sd.ServiceTarget{}
+	}
+
+	out, err := render.Render(render.Format(format), data, render.Options{
+		Namespace:  c.Query("namespace"),
+		NamePrefix: c.Query("prefix"),
+	})
+	if err != nil {
+		n.log.Error("Failed to render targets", "format", format, "error", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	n.log.Debug("handleRender: Returning rendered targets", "format", format, "service_groups", len(data))
+	c.Data(200, "application/yaml; charset=utf-8", out)
+}
+
+// formatList returns the supported render formats separated by commas
+func formatList() string {
+	var list string
+	for i, f := range render.Formats() {
+		if i > 0 {
+			list += ", "
+		}
+		list += string(f)
+	}
+	return list
+}
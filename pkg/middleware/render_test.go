@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRenderEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd := newRoutesTestNmapSD(t)
+	r := gin.New()
+	r.Use(nsd.Handler())
+
+	tests := []struct {
+		path     string
+		code     int
+		contains []string
+	}{
+		{"/mgsd/render/prometheus", 200, []string{"scrape_configs:", "job_name: http_services", "10.0.0.1:80"}},
+		{"/mgsd/render/scrapeconfig?namespace=monitoring", 200, []string{"kind: ScrapeConfig", "name: nmap-sd-http-services", "namespace: monitoring", "10.0.0.1:80"}},
+		{"/mgsd/render/vmstaticscrape?prefix=lab", 200, []string{"kind: VMStaticScrape", "name: lab-http-services", "targetEndpoints:"}},
+		{"/mgsd/render/json", 404, []string{"prometheus, scrapeconfig, vmstaticscrape"}},
+	}
+	for _, tt := range tests {
+		w := serveRequest(r, http.MethodGet, tt.path)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d %s", tt.path, tt.code, w.Code, w.Body.String())
+			continue
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("%s: expected the response to contain %q, got %s", tt.path, s, w.Body.String())
+			}
+		}
+	}
+	if ct := serveRequest(r, http.MethodGet, "/mgsd/render/prometheus").Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/yaml") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// InfoPathSuffix is appended to the scan path to form the host information page
+const InfoPathSuffix = "/info"
+
+// Routes are the paths RegisterRoutes mounts the endpoints on, relative to Group except for Metrics.
+// Endpoints other than Results are not registered if their path is empty.
+type Routes struct {
+	// Route group all endpoints are mounted below, created with gin.IRouter.Group
+	// (e.g., "/mgsd"); empty mounts them on the router itself
+	Group string
+	// Scan results in the Prometheus HTTP SD format, empty for the group path itself
+	Results string
+	// Server-Sent Events stream of scan events
+	Events string
+	// Manual scan trigger (POST) and scan status (GET)
+	Scan string
+	// Scan history, archived scans are served on History + "/:id"
+	History string
+	// Static scrape configurations, each format is served on Render + "/<format>"
+	Render string
+	// Self-instrumentation metrics, mounted on the router itself rather than below Group
+	// like the MetricsPath served by Handler
+	Metrics string
+	// HTML page listing the scanned hosts
+	Info string
+}
+
+// Routes returns the default routes: all endpoints below the scan path, using the same
+// suffixes as the middleware returned by Handler, and the metrics on MetricsPath if enabled
+func (n *NmapSD) Routes() Routes {
+	return Routes{
+		Group:   n.currentScanPath(),
+		Events:  EventsPathSuffix,
+		Scan:    TriggerPathSuffix,
+		History: HistoryPathSuffix,
+		Render:  RenderPathSuffix,
+		Metrics: n.currentMetricsPath(),
+		Info:    InfoPathSuffix,
+	}
+}
+
+// RegisterRoutes mounts the endpoints on a gin router or route group, using the default
+// Routes unless routes are given. Middleware of the router, such as authentication,
+// applies to all endpoints. Unlike Handler, the routes are fixed when they are
+// registered: a ScanPath changed by Reload does not move them.
+func (n *NmapSD) RegisterRoutes(r gin.IRouter, routes ...Routes) {
+	rt := n.Routes()
+	if len(routes) > 0 {
+		rt = routes[0]
+	}
+	root := r
+	if rt.Group != "" {
+		r = r.Group(rt.Group)
+	}
+	n.log.Debug("RegisterRoutes: Registering routes", "group", rt.Group, "results", rt.Results, "events", rt.Events, "scan", rt.Scan, "history", rt.History, "render", rt.Render, "metrics", rt.Metrics, "info", rt.Info)
+
+	r.GET(rt.Results, n.ResultsHandler())
+	if rt.Events != "" {
+		r.GET(rt.Events, n.EventsHandler())
+	}
+	if rt.Scan != "" {
+		r.POST(rt.Scan, n.TriggerScanHandler())
+		r.GET(rt.Scan, n.ScanStatusHandler())
+	}
+	if rt.History != "" {
+		r.GET(rt.History, n.HistoryHandler())
+		r.GET(rt.History+"/:id", n.HistoryHandler())
+	}
+	if rt.Render != "" {
+		r.GET(rt.Render+"/:format", n.RenderHandler())
+	}
+	if rt.Metrics != "" {
+		root.GET(rt.Metrics, n.MetricsHandler())
+	}
+	if rt.Info != "" {
+		r.GET(rt.Info, n.InfoHandler())
+	}
+}
+
+// ResultsHandler returns the handler of the scan results in the Prometheus HTTP SD format
+func (n *NmapSD) ResultsHandler() gin.HandlerFunc {
+	return n.handleScanResult
+}
+
+// EventsHandler returns the handler of the Server-Sent Events stream of scan events
+func (n *NmapSD) EventsHandler() gin.HandlerFunc {
+	return n.handleEvents
+}
+
+// TriggerScanHandler returns the handler starting a scan of all profiles, for POST routes
+func (n *NmapSD) TriggerScanHandler() gin.HandlerFunc {
+	return n.handleTriggerScan
+}
+
+// ScanStatusHandler returns the handler reporting the scan status of all profiles
+func (n *NmapSD) ScanStatusHandler() gin.HandlerFunc {
+	return n.handleScanStatus
+}
+
+// HistoryHandler returns the handler of the scan history. Mount it on the history path
+// and on the history path followed by "/:id" to look up scans by ID.
+func (n *NmapSD) HistoryHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n.handleHistory(c, c.Param("id"))
+	}
+}
+
+// RenderHandler returns the handler of the static scrape configurations. Mount it on a path
+// ending in "/:format", with format one of render.Formats.
+func (n *NmapSD) RenderHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n.handleRender(c, c.Param("format"))
+	}
+}
+
+// MetricsHandler returns the handler of the self-instrumentation metrics
+func (n *NmapSD) MetricsHandler() gin.HandlerFunc {
+	return n.handleMetrics
+}
+
+// InfoHandler returns the handler of the HTML page listing the scanned hosts
+func (n *NmapSD) InfoHandler() gin.HandlerFunc {
+	return n.handleInfo
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newRoutesTestNmapSD(t *testing.T) *NmapSD {
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	nsd := newTestNmapSD(t, scanner)
+	nsd.metrics = newMetrics(nsd)
+	nsd.metricsPath = "/metrics"
+	p := &profileState{ScanProfile: ScanProfile{
+		Name:    "office",
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	nsd.profiles = []*profileState{p}
+	nsd.performScan(p)
+	return nsd
+}
+
+func serveRequest(r http.Handler, method, path string, header ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegisterRoutesDefault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd := newRoutesTestNmapSD(t)
+	r := gin.New()
+	nsd.RegisterRoutes(r)
+	r.GET("/info", func(c *gin.Context) { c.String(200, "app info") })
+
+	tests := []struct {
+		method, path string
+		code         int
+		contains     string
+	}{
+		{http.MethodGet, "/mgsd", 200, "10.0.0.1:80"},
+		{http.MethodGet, "/mgsd/scan", 200, `"state":"idle"`},
+		{http.MethodGet, "/mgsd/history", 404, "not enabled"},
+		{http.MethodGet, "/mgsd/history/1", 404, "not enabled"},
+		{http.MethodGet, "/mgsd/render/prometheus", 200, "job_name: http_services"},
+		{http.MethodGet, "/mgsd/render/json", 404, "unknown format"},
+		{http.MethodGet, "/metrics", 200, "nmap_sd_targets_served 1"},
+		{http.MethodGet, "/mgsd/metrics", 404, ""},
+		{http.MethodGet, "/mgsd/info", 200, "10.0.0.1"},
+		{http.MethodGet, "/info", 200, "app info"},
+	}
+	for _, tt := range tests {
+		w := serveRequest(r, tt.method, tt.path)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s: expected %d containing %q, got %d %s", tt.method, tt.path, tt.code, tt.contains, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRegisterRoutesMetricsDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd := newRoutesTestNmapSD(t)
+	nsd.metricsPath = ""
+	r := gin.New()
+	nsd.RegisterRoutes(r)
+
+	if metrics := nsd.Routes().Metrics; metrics != "" {
+		t.Errorf("Expected no metrics route when metrics are disabled, got %q", metrics)
+	}
+	for _, path := range []string{"/metrics", "/mgsd/metrics"} {
+		if w := serveRequest(r, http.MethodGet, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 with metrics disabled, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestRegisterRoutesGroupWithAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd := newRoutesTestNmapSD(t)
+	r := gin.New()
+	auth := func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "Bearer token" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+	nsd.RegisterRoutes(r.Group("/api", auth), Routes{
+		Group:   "/sd",
+		Results: "/targets",
+		Scan:    "/rescan",
+	})
+
+	if w := serveRequest(r, http.MethodGet, "/api/sd/targets"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the group middleware to reject the request, got %d", w.Code)
+	}
+	if w := serveRequest(r, http.MethodGet, "/api/sd/targets", "Authorization", "Bearer token"); w.Code != 200 || !strings.Contains(w.Body.String(), "10.0.0.1:80") {
+		t.Errorf("Unexpected results response: %d %s", w.Code, w.Body.String())
+	}
+	if w := serveRequest(r, http.MethodGet, "/api/sd/rescan", "Authorization", "Bearer token"); w.Code != 200 {
+		t.Errorf("Expected scan status on the custom path, got %d", w.Code)
+	}
+	for _, path := range []string{"/api/sd/info", "/api/sd/metrics", "/api/sd/events", "/mgsd"} {
+		if w := serveRequest(r, http.MethodGet, path, "Authorization", "Bearer token"); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected disabled endpoint to be missing, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestHandlerDoesNotHijackInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd := newRoutesTestNmapSD(t)
+	r := gin.New()
+	r.Use(nsd.Handler())
+	r.GET("/info", func(c *gin.Context) { c.String(200, "app info") })
+
+	if w := serveRequest(r, http.MethodGet, "/info"); w.Body.String() != "app info" {
+		t.Errorf("Expected the application /info route, got %s", w.Body.String())
+	}
+	if w := serveRequest(r, http.MethodGet, "/mgsd/info"); w.Code != 200 || !strings.Contains(w.Body.String(), "10.0.0.1") {
+		t.Errorf("Expected the host information page below the scan path, got %d", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/state"
+)
+
+// StaleHeader is set to "true" on scan result responses while restored results
+// have not been confirmed by a fresh scan yet
+const StaleHeader = "X-Nmap-SD-Stale"
+
+// restoreState loads the results saved in the state file into the profiles that still
+// probe the same targets and ports. Restored profiles are stale until they are rescanned.
+// The caller must hold dataMutex or own the instance exclusively.
+func (n *NmapSD) restoreState() {
+	if n.stateFile == "" {
+		return
+	}
+	snapshot, err := state.Load(n.stateFile, n.log)
+	if errors.Is(err, fs.ErrNotExist) {
+		n.log.Debug("restoreState: No state file yet", "path", n.stateFile)
+		return
+	}
+	if err != nil {
+		n.log.Error("Failed to load state file, starting without saved results", "path", n.stateFile, "error", err)
+		return
+	}
+
+	saved := make(map[string]state.Profile, len(snapshot.Profiles))
+	for _, sp := range snapshot.Profiles {
+		saved[sp.Name] = sp
+	}
+	restored := 0
+	for _, p := range n.profiles {
+		sp, ok := saved[p.Name]
+		if !ok {
+			continue
+		}
+		if !sameScan(p.ScanProfile, ScanProfile{Targets: sp.Targets, Excludes: sp.Excludes, Ports: sp.Ports}) {
+			n.log.Debug("restoreState: Profile targets or ports changed, ignoring saved results", "profile", p.Name)
+			continue
+		}
+		p.data = sp.Data
+		p.hostInfo = sp.Hosts
+		p.scanTime = sp.ScanTime
+		p.initialized = true
+		p.stale = true
+		restored++
+	}
+	n.mergeLocked()
+	n.log.Info("Restored saved scan results", "path", n.stateFile, "saved_at", snapshot.Time, "profiles", restored)
+}
+
+// saveState writes the results of all scanned profiles to the state file.
+// The caller must hold publishMutex so snapshots are written in publication order.
+func (n *NmapSD) saveState() {
+	n.dataMutex.RLock()
+	path := n.stateFile
+	snapshot := &state.Snapshot{Time: time.Now()}
+	for _, p := range n.profiles {
+		if !p.initialized {
+			continue
+		}
+		snapshot.Profiles = append(snapshot.Profiles, state.Profile{
+			Name:     p.Name,
+			Targets:  p.Targets,
+			Excludes: p.Excludes,
+			Ports:    p.Ports,
+			ScanTime: p.scanTime,
+			Data:     p.data,
+			Hosts:    p.hostInfo,
+		})
+	}
+	n.dataMutex.RUnlock()
+
+	if path == "" {
+		return
+	}
+	n.log.Debug("saveState: Writing state file", "path", path, "profiles", len(snapshot.Profiles))
+	if err := state.Save(path, snapshot, n.log); err != nil {
+		n.log.Error("Failed to write state file", "path", path, "error", err)
+	}
+}
+
+// staleLocked reports whether any served profile result was restored and not rescanned yet.
+// The caller must hold dataMutex.
+func (n *NmapSD) staleLocked() bool {
+	for _, p := range n.profiles {
+		if p.initialized && p.stale {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStateRestoredAsStale(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "state.json")
+	scanner := &staticScanner{hosts: map[string][]sd.HostInfo{
+		"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+	}}
+	office := ScanProfile{
+		Name:    "office",
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+		Labels:  map[string]string{"site": "hq"},
+	}
+	newInstance := func(profiles ...ScanProfile) *NmapSD {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		nsd := &NmapSD{log: slog.Default(), scanPath: "/mgsd", stateFile: path, scanner: scanner, scanTimeout: time.Minute, ctx: ctx, cancel: cancel, data: []sd.ServiceTarget{}}
+		for _, p := range profiles {
+			nsd.profiles = append(nsd.profiles, &profileState{ScanProfile: p})
+		}
+		return nsd
+	}
+	serve := func(n *NmapSD) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/mgsd", nil)
+		n.handleScanResult(c)
+		return w
+	}
+
+	first := newInstance(office)
+	first.performScan(first.profiles[0])
+
+	// A restarted instance serves the saved results right away, marked as stale
+	restarted := newInstance(office)
+	restarted.restoreState()
+	if targets := servedTargets(restarted); len(targets) != 1 || targets[0] != "10.0.0.1:80" {
+		t.Fatalf("Expected saved target to be served, got %v", targets)
+	}
+	if restarted.data[0].Labels["site"] != "hq" {
+		t.Errorf("Expected profile labels on restored targets, got %v", restarted.data[0].Labels)
+	}
+	if w := serve(restarted); w.Header().Get(StaleHeader) != "true" {
+		t.Errorf("Expected %s header on restored results", StaleHeader)
+	}
+
+	// The first fresh scan clears the stale mark
+	restarted.performScan(restarted.profiles[0])
+	if w := serve(restarted); w.Header().Get(StaleHeader) != "" {
+		t.Errorf("Expected no %s header after a fresh scan", StaleHeader)
+	}
+
+	// Saved results of a profile whose ports changed are not restored
+	changed := office
+	changed.Ports = []sd.PortService{{Port: 443, Name: "https", Job: "http_services"}}
+	reconfigured := newInstance(changed)
+	reconfigured.restoreState()
+	if reconfigured.initialized || len(servedTargets(reconfigured)) != 0 {
+		t.Errorf("Expected no restored results for a changed profile, got %v", servedTargets(reconfigured))
+	}
+}
@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TriggerPathSuffix is appended to the scan path to form the manual scan endpoint:
+// POST starts a scan of all profiles, GET reports their scan status
+const TriggerPathSuffix = "/scan"
+
+// Scan states reported by the scan status
+const (
+	// ScanIdle means no scan of the profile is running
+	ScanIdle = "idle"
+	// ScanRunning means a scan of the profile is running
+	ScanRunning = "running"
+	// ScanQueued means a scan is running and another one will start when it finishes
+	ScanQueued = "queued"
+)
+
+// ScanStatus is the scan state of a profile
+type ScanStatus struct {
+	Profile string `json:"profile"`
+	State   string `json:"state"`
+	// Time of the last successful scan, zero if the profile was not scanned yet
+	LastScan time.Time `json:"last_scan,omitzero"`
+}
+
+// scanFlight is the single-flight scan state of a profile while scans of it run
+type scanFlight struct {
+	queued bool
+	// closed when the running scan finishes
+	done chan struct{}
+	// closed when the queued scan finishes
+	next chan struct{}
+}
+
+// requestScan asks for a scan of the named profile that starts after the call and returns
+// a channel closed when it finishes. Scans of a profile never overlap, also across reloads
+// that replace it: if one is running, a single follow-up scan is queued and all requests
+// made meanwhile share it.
+func (n *NmapSD) requestScan(name string) <-chan struct{} {
+	n.scanMu.Lock()
+	defer n.scanMu.Unlock()
+
+	f, running := n.flights[name]
+	if !running {
+		n.log.Debug("requestScan: Starting scan", "profile", name)
+		if n.flights == nil {
+			n.flights = make(map[string]*scanFlight)
+		}
+		f = &scanFlight{done: make(chan struct{})}
+		n.flights[name] = f
+		go n.runScans(name, f)
+		return f.done
+	}
+	if !f.queued {
+		n.log.Debug("requestScan: Scan running, queueing another one", "profile", name)
+		f.queued = true
+		f.next = make(chan struct{})
+	} else {
+		n.log.Debug("requestScan: Scan already queued, coalescing", "profile", name)
+	}
+	return f.next
+}
+
+// runScans scans the named profile until no further scan is queued. Every scan uses the
+// profile configured when it starts, so a scan queued by a reload probes the new targets.
+func (n *NmapSD) runScans(name string, f *scanFlight) {
+	for {
+		if p := n.profile(name); p != nil {
+			n.performScan(p)
+		} else {
+			n.log.Debug("runScans: Profile removed, skipping scan", "profile", name)
+		}
+
+		n.scanMu.Lock()
+		close(f.done)
+		if !f.queued || n.ctx.Err() != nil {
+			if f.queued {
+				close(f.next)
+			}
+			delete(n.flights, name)
+			n.scanMu.Unlock()
+			return
+		}
+		n.log.Debug("runScans: Starting queued scan", "profile", name)
+		f.done, f.next = f.next, nil
+		f.queued = false
+		n.scanMu.Unlock()
+	}
+}
+
+// profile returns the configured profile with the given name, nil if there is none
+func (n *NmapSD) profile(name string) *profileState {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	for _, p := range n.profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// scanState returns the scan state of the named profile
+func (n *NmapSD) scanState(name string) string {
+	n.scanMu.Lock()
+	defer n.scanMu.Unlock()
+	f, running := n.flights[name]
+	switch {
+	case !running:
+		return ScanIdle
+	case f.queued:
+		return ScanQueued
+	default:
+		return ScanRunning
+	}
+}
+
+// TriggerScan scans all profiles now and waits until the scans finish or ctx is done.
+// Scans that are already running are not interrupted: a single scan is queued after them
+// and shared by concurrent triggers. Scan failures are logged and reported on the events
+// endpoint; TriggerScan only returns an error if ctx is done or the instance is stopped.
+func (n *NmapSD) TriggerScan(ctx context.Context) error {
+	done, err := n.triggerScan()
+	if err != nil {
+		return err
+	}
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if n.ctx.Err() != nil {
+		return fmt.Errorf("nmap_sd: instance stopped")
+	}
+	return nil
+}
+
+// triggerScan requests a scan of every profile and returns the channels closed when they finish
+func (n *NmapSD) triggerScan() ([]<-chan struct{}, error) {
+	if n.ctx.Err() != nil {
+		return nil, fmt.Errorf("nmap_sd: instance stopped")
+	}
+	n.dataMutex.RLock()
+	profiles := n.profiles
+	n.dataMutex.RUnlock()
+
+	n.log.Info("Manual scan triggered", "profiles", len(profiles))
+	done := make([]<-chan struct{}, 0, len(profiles))
+	for _, p := range profiles {
+		done = append(done, n.requestScan(p.Name))
+	}
+	return done, nil
+}
+
+// scanStatus returns the scan status of every profile
+func (n *NmapSD) scanStatus() []ScanStatus {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	status := make([]ScanStatus, 0, len(n.profiles))
+	for _, p := range n.profiles {
+		s := ScanStatus{Profile: p.Name, State: n.scanState(p.Name)}
+		if p.initialized && !p.stale {
+			s.LastScan = p.scanTime
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// handleTriggerScan starts a scan of all profiles and responds with their scan status.
+// With ?wait=true the response is sent once the scans finished.
+func (n *NmapSD) handleTriggerScan(c *gin.Context) {
+	if c.Query("wait") == "true" {
+		n.log.Debug("handleTriggerScan: Triggering scan and waiting for it")
+		if err := n.TriggerScan(c.Request.Context()); err != nil {
+			n.log.Debug("handleTriggerScan: Scan not completed", "error", err)
+			c.JSON(503, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, n.scanStatus())
+		return
+	}
+
+	n.log.Debug("handleTriggerScan: Triggering scan")
+	if _, err := n.triggerScan(); err != nil {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(202, n.scanStatus())
+}
+
+// handleScanStatus responds with the scan status of all profiles
+func (n *NmapSD) handleScanStatus(c *gin.Context) {
+	n.log.Debug("handleScanStatus: Returning scan status")
+	c.JSON(200, n.scanStatus())
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gatedScanner is a Scanner whose discovery waits for a release and counts its runs
+type gatedScanner struct {
+	staticScanner
+	started chan struct{}
+	release chan struct{}
+	runs    atomic.Int32
+}
+
+func (g *gatedScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]sd.HostInfo, error) {
+	g.runs.Add(1)
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return g.staticScanner.Discover(ctx, targets, excludes)
+}
+
+func newGatedTestNmapSD(t *testing.T) (*NmapSD, *gatedScanner, *profileState) {
+	scanner := &gatedScanner{
+		staticScanner: staticScanner{hosts: map[string][]sd.HostInfo{
+			"10.0.0.0/24": {{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		}},
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	nsd := newTestNmapSD(t, scanner)
+	p := &profileState{ScanProfile: ScanProfile{
+		Name:    "office",
+		Targets: []string{"10.0.0.0/24"},
+		Ports:   []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+	}}
+	nsd.profiles = []*profileState{p}
+	return nsd, scanner, p
+}
+
+func TestTriggerScanCoalesces(t *testing.T) {
+	nsd, scanner, p := newGatedTestNmapSD(t)
+
+	first := nsd.requestScan(p.Name)
+	<-scanner.started
+	if state := nsd.scanState(p.Name); state != ScanRunning {
+		t.Errorf("Expected %s, got %s", ScanRunning, state)
+	}
+
+	// Triggers during a running scan share a single queued scan
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- nsd.TriggerScan(context.Background()) }()
+	}
+	waitFor(t, "queued scan", func() bool { return nsd.scanState(p.Name) == ScanQueued })
+
+	close(scanner.release)
+	<-first
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("TriggerScan failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for TriggerScan")
+		}
+	}
+	if runs := scanner.runs.Load(); runs != 2 {
+		t.Errorf("Expected 2 scans, got %d", runs)
+	}
+	if state := nsd.scanState(p.Name); state != ScanIdle {
+		t.Errorf("Expected %s, got %s", ScanIdle, state)
+	}
+	if len(servedTargets(nsd)) != 1 {
+		t.Errorf("Expected scan results to be served, got %v", servedTargets(nsd))
+	}
+}
+
+func TestTriggerScanContextDone(t *testing.T) {
+	nsd, scanner, _ := newGatedTestNmapSD(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := nsd.TriggerScan(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	<-scanner.started
+
+	nsd.Stop()
+	if err := nsd.TriggerScan(context.Background()); err == nil {
+		t.Error("Expected TriggerScan to fail after Stop")
+	}
+}
+
+func TestTriggerScanEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nsd, scanner, _ := newGatedTestNmapSD(t)
+	r := gin.New()
+	r.POST("/mgsd/scan", nsd.handleTriggerScan)
+	r.GET("/mgsd/scan", nsd.handleScanStatus)
+	do := func(method, url string) (int, []ScanStatus) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		var status []ScanStatus
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status
+	}
+
+	if code, status := do(http.MethodPost, "/mgsd/scan"); code != 202 || len(status) != 1 || status[0].State != ScanRunning {
+		t.Errorf("Expected 202 with a running scan, got %d %+v", code, status)
+	}
+	<-scanner.started
+	if code, status := do(http.MethodPost, "/mgsd/scan"); code != 202 || status[0].State != ScanQueued {
+		t.Errorf("Expected 202 with a queued scan, got %d %+v", code, status)
+	}
+	if code, status := do(http.MethodGet, "/mgsd/scan"); code != 200 || status[0].State != ScanQueued {
+		t.Errorf("Expected status of the queued scan, got %d %+v", code, status)
+	}
+
+	close(scanner.release)
+	code, status := do(http.MethodPost, "/mgsd/scan?wait=true")
+	if code != 200 || status[0].State != ScanIdle || status[0].LastScan.IsZero() {
+		t.Errorf("Expected 200 with a completed scan, got %d %+v", code, status)
+	}
+}
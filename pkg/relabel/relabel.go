@@ -0,0 +1,198 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// AddressLabel holds the target address while rules are applied, as in Prometheus
+const AddressLabel = "__address__"
+
+// Action is the relabeling action to perform
+type Action string
+
+const (
+	// Replace sets TargetLabel to Replacement if Regex matches the source labels
+	Replace Action = "replace"
+	// Keep drops targets whose source labels do not match Regex
+	Keep Action = "keep"
+	// Drop drops targets whose source labels match Regex
+	Drop Action = "drop"
+	// LabelMap copies labels whose names match Regex to the names given by Replacement
+	LabelMap Action = "labelmap"
+	// HashMod sets TargetLabel to the hash of the source labels modulo Modulus
+	HashMod Action = "hashmod"
+)
+
+// Config is a Prometheus style relabel rule
+type Config struct {
+	// Labels whose values are concatenated with Separator and matched against Regex
+	SourceLabels []string `json:"source_labels,omitempty" toml:"source_labels,omitempty"`
+	// Separator between concatenated source label values (default: ";")
+	Separator string `json:"separator,omitempty" toml:"separator,omitempty"`
+	// Regular expression matched against the source value, anchored at both ends (default: "(.*)")
+	Regex string `json:"regex,omitempty" toml:"regex,omitempty"`
+	// Modulus for the hashmod action
+	Modulus uint64 `json:"modulus,omitempty" toml:"modulus,omitempty"`
+	// Label written by the replace and hashmod actions
+	TargetLabel string `json:"target_label,omitempty" toml:"target_label,omitempty"`
+	// Replacement with regex capture group references, "$1" if nil. An empty replacement
+	// makes the replace action remove TargetLabel, as in Prometheus.
+	Replacement *string `json:"replacement,omitempty" toml:"replacement,omitempty"`
+	// Action to perform (default: "replace")
+	Action Action `json:"action,omitempty" toml:"action,omitempty"`
+}
+
+// rule is a validated Config with its regex compiled and its replacement resolved
+type rule struct {
+	Config
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// Relabeler applies a list of relabel rules to service targets
+type Relabeler struct {
+	rules []rule
+	log   *slog.Logger
+}
+
+// New validates the configs and compiles them into a Relabeler logging to log
+func New(configs []Config, log *slog.Logger) (*Relabeler, error) {
+	log.Debug("relabel.New: Compiling relabel rules", "rule_count", len(configs))
+	r := &Relabeler{log: log}
+	for i, c := range configs {
+		if c.Action == "" {
+			c.Action = Replace
+		}
+		if c.Separator == "" {
+			c.Separator = ";"
+		}
+		if c.Regex == "" {
+			c.Regex = "(.*)"
+		}
+		replacement := "$1"
+		if c.Replacement != nil {
+			replacement = *c.Replacement
+		}
+		c.Action = Action(strings.ToLower(string(c.Action)))
+
+		re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid regex %q: %w", i, c.Regex, err)
+		}
+
+		switch c.Action {
+		case Replace:
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("rule %d: target_label is required for action %q", i, c.Action)
+			}
+		case HashMod:
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("rule %d: target_label is required for action %q", i, c.Action)
+			}
+			if c.Modulus == 0 {
+				return nil, fmt.Errorf("rule %d: modulus is required for action %q", i, c.Action)
+			}
+		case Keep, Drop:
+			if len(c.SourceLabels) == 0 {
+				return nil, fmt.Errorf("rule %d: source_labels are required for action %q", i, c.Action)
+			}
+		case LabelMap:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", i, c.Action)
+		}
+
+		r.rules = append(r.rules, rule{Config: c, regex: re, replacement: replacement})
+	}
+	return r, nil
+}
+
+// Process applies the rules to every target and returns the targets that were kept.
+// Each target is relabeled on its own with its address in the __address__ label,
+// so the result holds one group per surviving target.
+func (r *Relabeler) Process(targets []sd.ServiceTarget) []sd.ServiceTarget {
+	r.log.Debug("Process: Relabeling service targets", "service_groups", len(targets), "rule_count", len(r.rules))
+	result := []sd.ServiceTarget{}
+	for _, st := range targets {
+		for _, addr := range st.Targets {
+			labels := make(map[string]string, len(st.Labels)+1)
+			for k, v := range st.Labels {
+				labels[k] = v
+			}
+			labels[AddressLabel] = addr
+
+			if !r.apply(labels) {
+				r.log.Debug("Process: Target dropped", "target", addr)
+				continue
+			}
+
+			newAddr := labels[AddressLabel]
+			delete(labels, AddressLabel)
+			if newAddr == "" {
+				r.log.Debug("Process: Target has empty address after relabeling, dropping", "target", addr)
+				continue
+			}
+			result = append(result, sd.ServiceTarget{Targets: []string{newAddr}, Labels: labels})
+		}
+	}
+	r.log.Debug("Process: Relabeling completed", "service_groups", len(result))
+	return result
+}
+
+// apply runs all rules on the labels in place and reports whether the target is kept
+func (r *Relabeler) apply(labels map[string]string) bool {
+	for _, rl := range r.rules {
+		values := make([]string, 0, len(rl.SourceLabels))
+		for _, name := range rl.SourceLabels {
+			values = append(values, labels[name])
+		}
+		val := strings.Join(values, rl.Separator)
+
+		switch rl.Action {
+		case Replace:
+			indexes := rl.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				continue
+			}
+			target := string(rl.regex.ExpandString(nil, rl.TargetLabel, val, indexes))
+			res := string(rl.regex.ExpandString(nil, rl.replacement, val, indexes))
+			if target == "" {
+				continue
+			}
+			if res == "" {
+				delete(labels, target)
+				continue
+			}
+			labels[target] = res
+		case Keep:
+			if !rl.regex.MatchString(val) {
+				return false
+			}
+		case Drop:
+			if rl.regex.MatchString(val) {
+				return false
+			}
+		case HashMod:
+			sum := md5.Sum([]byte(val))
+			mod := binary.BigEndian.Uint64(sum[8:]) % rl.Modulus
+			labels[rl.TargetLabel] = fmt.Sprintf("%d", mod)
+		case LabelMap:
+			mapped := make(map[string]string)
+			for name, value := range labels {
+				if rl.regex.MatchString(name) {
+					mapped[rl.regex.ReplaceAllString(name, rl.replacement)] = value
+				}
+			}
+			for name, value := range mapped {
+				labels[name] = value
+			}
+		}
+	}
+	return true
+}
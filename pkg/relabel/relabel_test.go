@@ -0,0 +1,158 @@
+package relabel
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func replacement(s string) *string {
+	return &s
+}
+
+func testTargets() []sd.ServiceTarget {
+	return []sd.ServiceTarget{
+		{
+			Targets: []string{"10.0.3.14:8080"},
+			Labels: map[string]string{
+				"job":                   "http_services",
+				sd.MetaLabelHostname:    "db-01.dc.local",
+				sd.MetaLabelSubnet:      "10.0.3.0/24",
+				sd.MetaLabelIP:          "10.0.3.14",
+				sd.MetaLabelProfile:     "datacenter",
+				sd.MetaLabelPortName:    "http-proxy",
+				sd.MetaLabelScanTime:    "2025-12-19T08:00:00Z",
+				sd.MetaLabelPort:        "8080",
+				sd.MetaLabelOS:          "Linux 4.15 - 5.8",
+				sd.MetaLabelServiceName: "http",
+			},
+		},
+		{
+			Targets: []string{"192.168.2.12:80"},
+			Labels: map[string]string{
+				"job":                "http_services",
+				sd.MetaLabelHostname: "printer-2f.corp.local",
+				sd.MetaLabelIP:       "192.168.2.12",
+				sd.MetaLabelPort:     "80",
+			},
+		},
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "defaults", cfg: Config{SourceLabels: []string{"job"}, TargetLabel: "service"}},
+		{name: "invalid regex", cfg: Config{SourceLabels: []string{"job"}, TargetLabel: "service", Regex: "("}, wantErr: true},
+		{name: "replace without target", cfg: Config{SourceLabels: []string{"job"}}, wantErr: true},
+		{name: "hashmod without modulus", cfg: Config{Action: HashMod, SourceLabels: []string{"job"}, TargetLabel: "shard"}, wantErr: true},
+		{name: "keep without sources", cfg: Config{Action: Keep, Regex: "x"}, wantErr: true},
+		{name: "unknown action", cfg: Config{Action: "explode"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New([]Config{tt.cfg}, slog.Default())
+			if tt.wantErr && err == nil {
+				t.Error("Expected error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected rule to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	r, err := New([]Config{
+		{Action: Drop, SourceLabels: []string{sd.MetaLabelHostname}, Regex: "printer-.*"},
+		{SourceLabels: []string{sd.MetaLabelHostname}, Regex: `([^.]+)\..*`, TargetLabel: "instance"},
+		{Action: LabelMap, Regex: "__meta_nmap_(profile|subnet)"},
+		{SourceLabels: []string{"job", sd.MetaLabelPortName}, Separator: "/", TargetLabel: "job", Replacement: replacement("${1}")},
+		{Action: HashMod, SourceLabels: []string{AddressLabel}, Modulus: 4, TargetLabel: "shard"},
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	result := r.Process(testTargets())
+	if len(result) != 1 {
+		t.Fatalf("Expected 1 target after dropping printers, got %d", len(result))
+	}
+
+	got := result[0]
+	if got.Targets[0] != "10.0.3.14:8080" {
+		t.Errorf("Expected address 10.0.3.14:8080, got %s", got.Targets[0])
+	}
+
+	want := map[string]string{
+		"instance": "db-01",
+		"profile":  "datacenter",
+		"subnet":   "10.0.3.0/24",
+		"job":      "http_services/http-proxy",
+	}
+	for k, v := range want {
+		if got.Labels[k] != v {
+			t.Errorf("Expected label %s=%q, got %q", k, v, got.Labels[k])
+		}
+	}
+
+	if _, ok := got.Labels[AddressLabel]; ok {
+		t.Error("Expected __address__ to be removed from labels")
+	}
+
+	if shard := got.Labels["shard"]; shard == "" || len(shard) != 1 || shard[0] < '0' || shard[0] > '3' {
+		t.Errorf("Expected shard in [0,3], got %q", shard)
+	}
+}
+
+func TestProcessKeepAndAddress(t *testing.T) {
+	r, err := New([]Config{
+		{Action: Keep, SourceLabels: []string{sd.MetaLabelIP}, Regex: `192\.168\..*`},
+		{SourceLabels: []string{sd.MetaLabelIP}, TargetLabel: AddressLabel, Replacement: replacement("$1:9100")},
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	result := r.Process(testTargets())
+	if len(result) != 1 || result[0].Targets[0] != "192.168.2.12:9100" {
+		t.Errorf("Expected single target 192.168.2.12:9100, got %+v", result)
+	}
+}
+
+func TestProcessEmptyReplacement(t *testing.T) {
+	r, err := New([]Config{
+		{SourceLabels: []string{sd.MetaLabelHostname}, Regex: "db-.*", TargetLabel: "job", Replacement: replacement("")},
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	for _, st := range r.Process(testTargets()) {
+		job, ok := st.Labels["job"]
+		if st.Labels[sd.MetaLabelHostname] == "db-01.dc.local" && ok {
+			t.Errorf("Expected an empty replacement to clear the job label, got %q", job)
+		}
+		if st.Labels[sd.MetaLabelHostname] != "db-01.dc.local" && !ok {
+			t.Errorf("Expected the job label of %v to be kept", st.Targets)
+		}
+	}
+}
+
+func TestProcessWithoutRules(t *testing.T) {
+	r, err := New(nil, slog.Default())
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	targets := []sd.ServiceTarget{{Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, Labels: map[string]string{"job": "web"}}}
+	result := r.Process(targets)
+	if len(result) != 2 || result[0].Labels["job"] != "web" || result[1].Targets[0] != "10.0.0.2:80" {
+		t.Errorf("Expected targets to pass through unchanged, got %+v", result)
+	}
+}
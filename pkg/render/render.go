@@ -0,0 +1,227 @@
+// Package render turns discovered targets into static scrape configurations for setups
+// that cannot use HTTP SD: a Prometheus scrape_configs fragment, Prometheus Operator
+// ScrapeConfig manifests and VictoriaMetrics VMStaticScrape manifests.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// Format is an output format of Render
+type Format string
+
+const (
+	// Prometheus is a scrape_configs fragment with one static scrape config per job
+	Prometheus Format = "prometheus"
+	// ScrapeConfig is a Prometheus Operator ScrapeConfig (monitoring.coreos.com/v1alpha1) per job
+	ScrapeConfig Format = "scrapeconfig"
+	// VMStaticScrape is a VictoriaMetrics operator VMStaticScrape (operator.victoriametrics.com/v1beta1) per job
+	VMStaticScrape Format = "vmstaticscrape"
+)
+
+const (
+	// ManagedByLabel marks the rendered manifests
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel on the rendered manifests
+	ManagedByValue = "nmap_sd"
+	// DefaultNamePrefix starts the names of the rendered manifests
+	DefaultNamePrefix = "nmap-sd"
+)
+
+// Formats returns the supported formats
+func Formats() []Format {
+	return []Format{Prometheus, ScrapeConfig, VMStaticScrape}
+}
+
+// Options of the rendered manifests, unused by the Prometheus format
+type Options struct {
+	// Namespace of the manifests, omitted when empty
+	Namespace string
+	// Prefix of the manifest names (default: DefaultNamePrefix), followed by the job
+	NamePrefix string
+}
+
+// Render renders the targets in the format. Targets are grouped by their job label, and
+// meta labels (those starting with "__meta_") are left out since they are only meaningful
+// to relabeling; other labels are kept as static labels of their targets.
+func Render(format Format, targets []sd.ServiceTarget, opts Options) ([]byte, error) {
+	if opts.NamePrefix == "" {
+		opts.NamePrefix = DefaultNamePrefix
+	}
+	jobs := groupByJob(targets)
+	switch format {
+	case Prometheus:
+		return renderPrometheus(jobs)
+	case ScrapeConfig:
+		return renderManifests(jobs, opts, func(j job, meta metadata) any {
+			return scrapeConfig{
+				APIVersion: "monitoring.coreos.com/v1alpha1",
+				Kind:       "ScrapeConfig",
+				Metadata:   meta,
+				Spec:       scrapeConfigSpec{JobName: j.name, StaticConfigs: j.groups},
+			}
+		})
+	case VMStaticScrape:
+		return renderManifests(jobs, opts, func(j job, meta metadata) any {
+			return vmStaticScrape{
+				APIVersion: "operator.victoriametrics.com/v1beta1",
+				Kind:       "VMStaticScrape",
+				Metadata:   meta,
+				Spec:       vmStaticScrapeSpec{JobName: j.name, TargetEndpoints: j.groups},
+			}
+		})
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// staticGroup is a list of targets sharing labels, the static_configs entry of Prometheus
+// and the Prometheus Operator and the targetEndpoints entry of VictoriaMetrics
+type staticGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// job is the target groups of a job
+type job struct {
+	name   string
+	groups []staticGroup
+}
+
+// groupByJob groups the targets by their job label, ordered by job name
+func groupByJob(targets []sd.ServiceTarget) []job {
+	byName := make(map[string]*job)
+	var names []string
+	for _, st := range targets {
+		if len(st.Targets) == 0 {
+			continue
+		}
+		name := st.Labels["job"]
+		if name == "" {
+			name = ManagedByValue
+		}
+		j, ok := byName[name]
+		if !ok {
+			j = &job{name: name}
+			byName[name] = j
+			names = append(names, name)
+		}
+		labels := make(map[string]string)
+		for k, v := range st.Labels {
+			if k != "job" && !strings.HasPrefix(k, sd.MetaLabelPrefix) {
+				labels[k] = v
+			}
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		j.groups = append(j.groups, staticGroup{Targets: st.Targets, Labels: labels})
+	}
+	sort.Strings(names)
+	jobs := make([]job, 0, len(names))
+	for _, name := range names {
+		jobs = append(jobs, *byName[name])
+	}
+	return jobs
+}
+
+// prometheusConfig is a fragment of the Prometheus configuration file
+type prometheusConfig struct {
+	ScrapeConfigs []prometheusScrapeConfig `yaml:"scrape_configs"`
+}
+
+type prometheusScrapeConfig struct {
+	JobName       string        `yaml:"job_name"`
+	StaticConfigs []staticGroup `yaml:"static_configs"`
+}
+
+func renderPrometheus(jobs []job) ([]byte, error) {
+	cfg := prometheusConfig{ScrapeConfigs: []prometheusScrapeConfig{}}
+	for _, j := range jobs {
+		cfg.ScrapeConfigs = append(cfg.ScrapeConfigs, prometheusScrapeConfig{JobName: j.name, StaticConfigs: j.groups})
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode scrape configs: %w", err)
+	}
+	return data, nil
+}
+
+type metadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+type scrapeConfig struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   metadata         `yaml:"metadata"`
+	Spec       scrapeConfigSpec `yaml:"spec"`
+}
+
+type scrapeConfigSpec struct {
+	JobName       string        `yaml:"jobName"`
+	StaticConfigs []staticGroup `yaml:"staticConfigs"`
+}
+
+type vmStaticScrape struct {
+	APIVersion string             `yaml:"apiVersion"`
+	Kind       string             `yaml:"kind"`
+	Metadata   metadata           `yaml:"metadata"`
+	Spec       vmStaticScrapeSpec `yaml:"spec"`
+}
+
+type vmStaticScrapeSpec struct {
+	JobName         string        `yaml:"jobName"`
+	TargetEndpoints []staticGroup `yaml:"targetEndpoints"`
+}
+
+// renderManifests renders the manifest of every job as a multi-document YAML stream
+func renderManifests(jobs []job, opts Options, manifest func(job, metadata) any) ([]byte, error) {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, j := range jobs {
+		name := manifestName(opts.NamePrefix, j.name)
+		if seen[name] {
+			return nil, fmt.Errorf("jobs with conflicting manifest name %q", name)
+		}
+		seen[name] = true
+		data, err := yaml.Marshal(manifest(j, metadata{
+			Name:      name,
+			Namespace: opts.Namespace,
+			Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode manifest %s: %w", name, err)
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// manifestName returns the name of the manifest of a job, a DNS subdomain of at most 253 characters
+func manifestName(prefix, job string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, prefix+"-"+job)
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-.")
+}
@@ -0,0 +1,109 @@
+package render
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+var targets = []sd.ServiceTarget{
+	{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node", "team": "infra", sd.MetaLabelIP: "10.0.0.1"}},
+	{Targets: []string{"10.0.0.2:9100"}, Labels: map[string]string{"job": "node", "team": "db"}},
+	{Targets: []string{"[2001:db8::1]:443"}, Labels: map[string]string{"job": "HTTP Services", "__scheme__": "https"}},
+}
+
+func TestRenderPrometheus(t *testing.T) {
+	data, err := Render(Prometheus, targets, Options{})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	var cfg prometheusConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("Invalid YAML: %v\n%s", err, data)
+	}
+	if len(cfg.ScrapeConfigs) != 2 || cfg.ScrapeConfigs[0].JobName != "HTTP Services" || cfg.ScrapeConfigs[1].JobName != "node" {
+		t.Fatalf("Expected one scrape config per job ordered by name, got %+v", cfg.ScrapeConfigs)
+	}
+	node := cfg.ScrapeConfigs[1].StaticConfigs
+	if len(node) != 2 || node[0].Targets[0] != "10.0.0.1:9100" || node[0].Labels["team"] != "infra" || node[1].Labels["team"] != "db" {
+		t.Errorf("Unexpected static configs: %+v", node)
+	}
+	if _, ok := node[0].Labels[sd.MetaLabelIP]; ok {
+		t.Error("Expected meta labels to be left out")
+	}
+	if _, ok := node[0].Labels["job"]; ok {
+		t.Error("Expected the job label to be set by job_name only")
+	}
+	if https := cfg.ScrapeConfigs[0].StaticConfigs[0]; https.Labels["__scheme__"] != "https" {
+		t.Errorf("Expected reserved labels other than meta labels to be kept, got %v", https.Labels)
+	}
+
+	data, err = Render(Prometheus, nil, Options{})
+	if err != nil || strings.TrimSpace(string(data)) != "scrape_configs: []" {
+		t.Errorf("Expected an empty scrape_configs list, got %q (%v)", data, err)
+	}
+}
+
+func TestRenderManifests(t *testing.T) {
+	tests := []struct {
+		format     Format
+		apiVersion string
+		kind       string
+		groups     string
+	}{
+		{ScrapeConfig, "monitoring.coreos.com/v1alpha1", "ScrapeConfig", "staticConfigs"},
+		{VMStaticScrape, "operator.victoriametrics.com/v1beta1", "VMStaticScrape", "targetEndpoints"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			data, err := Render(tt.format, targets, Options{Namespace: "monitoring", NamePrefix: "lab"})
+			if err != nil {
+				t.Fatalf("Render failed: %v", err)
+			}
+			docs := strings.Split(strings.TrimPrefix(string(data), "---\n"), "---\n")
+			if len(docs) != 2 {
+				t.Fatalf("Expected one manifest per job, got %d:\n%s", len(docs), data)
+			}
+			var manifest struct {
+				APIVersion string         `yaml:"apiVersion"`
+				Kind       string         `yaml:"kind"`
+				Metadata   metadata       `yaml:"metadata"`
+				Spec       map[string]any `yaml:"spec"`
+			}
+			if err := yaml.Unmarshal([]byte(docs[1]), &manifest); err != nil {
+				t.Fatalf("Invalid YAML: %v\n%s", err, docs[1])
+			}
+			if manifest.APIVersion != tt.apiVersion || manifest.Kind != tt.kind {
+				t.Errorf("Unexpected type %s %s", manifest.APIVersion, manifest.Kind)
+			}
+			if manifest.Metadata.Name != "lab-node" || manifest.Metadata.Namespace != "monitoring" || manifest.Metadata.Labels[ManagedByLabel] != ManagedByValue {
+				t.Errorf("Unexpected metadata: %+v", manifest.Metadata)
+			}
+			if manifest.Spec["jobName"] != "node" {
+				t.Errorf("Unexpected job name: %v", manifest.Spec["jobName"])
+			}
+			if groups, ok := manifest.Spec[tt.groups].([]any); !ok || len(groups) != 2 {
+				t.Errorf("Expected two %s, got %v", tt.groups, manifest.Spec[tt.groups])
+			}
+			if !strings.Contains(docs[0], "name: lab-http-services\n") {
+				t.Errorf("Expected the job name to be sanitized in the manifest name:\n%s", docs[0])
+			}
+		})
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	if _, err := Render("json", targets, Options{}); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+	conflicting := []sd.ServiceTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web_a"}},
+		{Targets: []string{"10.0.0.1:81"}, Labels: map[string]string{"job": "web-a"}},
+	}
+	if _, err := Render(ScrapeConfig, conflicting, Options{}); err == nil {
+		t.Error("Expected jobs with the same manifest name to fail")
+	}
+}
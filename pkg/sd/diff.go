@@ -0,0 +1,157 @@
+package sd
+
+import (
+	"strings"
+	"time"
+)
+
+// ChangeType is the kind of change between two consecutive scan results
+type ChangeType string
+
+const (
+	// HostAdded is a host that was not up in the previous result
+	HostAdded ChangeType = "host_added"
+	// HostRemoved is a host that is no longer up
+	HostRemoved ChangeType = "host_removed"
+	// PortOpened is a port that was not open in the previous result
+	PortOpened ChangeType = "port_opened"
+	// PortClosed is a port that is no longer open
+	PortClosed ChangeType = "port_closed"
+	// OSChanged is a host whose detected OS changed
+	OSChanged ChangeType = "os_changed"
+	// ServiceChanged is an open port whose detected service, product or version changed
+	ServiceChanged ChangeType = "service_changed"
+	// TargetAdded is a served target that was not served before
+	TargetAdded ChangeType = "target_added"
+	// TargetRemoved is a target that is no longer served
+	TargetRemoved ChangeType = "target_removed"
+)
+
+// Change is a single difference between two scan results
+type Change struct {
+	Type ChangeType `json:"type"`
+	// Host IP address, set for all host and port changes
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// Port of port and service changes
+	Port uint16 `json:"port,omitempty"`
+	// Previous and current OS or service of OS and service changes
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// Target address and labels of target changes
+	Target string            `json:"target,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ScanDiff is the difference between two consecutive scan results
+type ScanDiff struct {
+	// Time the new result was published
+	Time time.Time `json:"time"`
+	// Profile whose scan produced the new result, empty if the change was caused by a reload
+	Profile string   `json:"profile,omitempty"`
+	Changes []Change `json:"changes"`
+}
+
+// Diff compares two scan results. Host changes are reported before target
+// changes, additions in the order of the new result and removals in the order
+// of the old one. Targets are matched by address and job.
+func Diff(oldHosts, newHosts []HostInfo, oldTargets, newTargets []ServiceTarget) []Change {
+	var changes []Change
+
+	oldByIP := make(map[string]HostInfo, len(oldHosts))
+	for _, h := range oldHosts {
+		oldByIP[h.IP] = h
+	}
+	newIPs := make(map[string]bool, len(newHosts))
+	for _, h := range newHosts {
+		newIPs[h.IP] = true
+		old, existed := oldByIP[h.IP]
+		if !existed {
+			changes = append(changes, Change{Type: HostAdded, IP: h.IP, Hostname: h.Hostname, New: h.OS})
+			for _, p := range h.Ports {
+				changes = append(changes, Change{Type: PortOpened, IP: h.IP, Hostname: h.Hostname, Port: p.Port, New: serviceDescription(p)})
+			}
+			continue
+		}
+		if old.OS != h.OS {
+			changes = append(changes, Change{Type: OSChanged, IP: h.IP, Hostname: h.Hostname, Old: old.OS, New: h.OS})
+		}
+		changes = append(changes, diffPorts(old, h)...)
+	}
+	for _, h := range oldHosts {
+		if !newIPs[h.IP] {
+			changes = append(changes, Change{Type: HostRemoved, IP: h.IP, Hostname: h.Hostname, Old: h.OS})
+		}
+	}
+
+	oldKeys := targetKeys(oldTargets)
+	newKeys := targetKeys(newTargets)
+	for _, st := range newTargets {
+		for _, addr := range st.Targets {
+			if !oldKeys[targetKey(addr, st.Labels)] {
+				changes = append(changes, Change{Type: TargetAdded, Target: addr, Labels: st.Labels})
+			}
+		}
+	}
+	for _, st := range oldTargets {
+		for _, addr := range st.Targets {
+			if !newKeys[targetKey(addr, st.Labels)] {
+				changes = append(changes, Change{Type: TargetRemoved, Target: addr, Labels: st.Labels})
+			}
+		}
+	}
+	return changes
+}
+
+// diffPorts compares the open ports of a host found in both results
+func diffPorts(old, cur HostInfo) []Change {
+	var changes []Change
+	oldPorts := make(map[uint16]PortInfo, len(old.Ports))
+	for _, p := range old.Ports {
+		oldPorts[p.Port] = p
+	}
+	curPorts := make(map[uint16]bool, len(cur.Ports))
+	for _, p := range cur.Ports {
+		curPorts[p.Port] = true
+		prev, existed := oldPorts[p.Port]
+		switch {
+		case !existed:
+			changes = append(changes, Change{Type: PortOpened, IP: cur.IP, Hostname: cur.Hostname, Port: p.Port, New: serviceDescription(p)})
+		case serviceDescription(prev) != serviceDescription(p):
+			changes = append(changes, Change{Type: ServiceChanged, IP: cur.IP, Hostname: cur.Hostname, Port: p.Port, Old: serviceDescription(prev), New: serviceDescription(p)})
+		}
+	}
+	for _, p := range old.Ports {
+		if !curPorts[p.Port] {
+			changes = append(changes, Change{Type: PortClosed, IP: cur.IP, Hostname: cur.Hostname, Port: p.Port, Old: serviceDescription(p)})
+		}
+	}
+	return changes
+}
+
+// serviceDescription joins the detected service name, product and version
+func serviceDescription(p PortInfo) string {
+	var parts []string
+	for _, s := range []string{p.Service, p.Product, p.Version} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// targetKeys returns the set of address and job keys of the targets
+func targetKeys(targets []ServiceTarget) map[string]bool {
+	keys := make(map[string]bool)
+	for _, st := range targets {
+		for _, addr := range st.Targets {
+			keys[targetKey(addr, st.Labels)] = true
+		}
+	}
+	return keys
+}
+
+// targetKey identifies a target by its address and job
+func targetKey(addr string, labels map[string]string) string {
+	return addr + "\x00" + labels["job"]
+}
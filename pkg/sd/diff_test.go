@@ -0,0 +1,55 @@
+package sd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	oldHosts := []HostInfo{
+		{IP: "10.0.0.1", Hostname: "web-01", OS: "Linux 5.x", Ports: []PortInfo{
+			{Port: 80, State: "open", Service: "http", Product: "nginx", Version: "1.24"},
+			{Port: 22, State: "open", Service: "ssh"},
+		}},
+		{IP: "10.0.0.2", Hostname: "old-01", Ports: []PortInfo{{Port: 9182, State: "open"}}},
+	}
+	newHosts := []HostInfo{
+		{IP: "10.0.0.1", Hostname: "web-01", OS: "Linux 6.x", Ports: []PortInfo{
+			{Port: 80, State: "open", Service: "http", Product: "nginx", Version: "1.25"},
+			{Port: 443, State: "open", Service: "https"},
+		}},
+		{IP: "10.0.0.3", Ports: []PortInfo{{Port: 3389, State: "open", Service: "ms-wbt-server"}}},
+	}
+	oldTargets := []ServiceTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "http_services", MetaLabelScanTime: "t1"}},
+		{Targets: []string{"10.0.0.2:9182"}, Labels: map[string]string{"job": "windows_exporter"}},
+	}
+	newTargets := []ServiceTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "http_services", MetaLabelScanTime: "t2"}},
+		{Targets: []string{"10.0.0.1:443"}, Labels: map[string]string{"job": "http_services"}},
+	}
+
+	got := Diff(oldHosts, newHosts, oldTargets, newTargets)
+	want := []Change{
+		{Type: OSChanged, IP: "10.0.0.1", Hostname: "web-01", Old: "Linux 5.x", New: "Linux 6.x"},
+		{Type: ServiceChanged, IP: "10.0.0.1", Hostname: "web-01", Port: 80, Old: "http nginx 1.24", New: "http nginx 1.25"},
+		{Type: PortOpened, IP: "10.0.0.1", Hostname: "web-01", Port: 443, New: "https"},
+		{Type: PortClosed, IP: "10.0.0.1", Hostname: "web-01", Port: 22, Old: "ssh"},
+		{Type: HostAdded, IP: "10.0.0.3"},
+		{Type: PortOpened, IP: "10.0.0.3", Port: 3389, New: "ms-wbt-server"},
+		{Type: HostRemoved, IP: "10.0.0.2", Hostname: "old-01"},
+		{Type: TargetAdded, Target: "10.0.0.1:443", Labels: map[string]string{"job": "http_services"}},
+		{Type: TargetRemoved, Target: "10.0.0.2:9182", Labels: map[string]string{"job": "windows_exporter"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected changes:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDiffUnchanged(t *testing.T) {
+	hosts := []HostInfo{{IP: "10.0.0.1", Ports: []PortInfo{{Port: 80, State: "open"}}}}
+	targets := []ServiceTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	if changes := Diff(hosts, hosts, targets, targets); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes)
+	}
+}
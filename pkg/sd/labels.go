@@ -0,0 +1,30 @@
+package sd
+
+// Meta labels attached to every discovered target. They follow the Prometheus
+// service discovery convention and are available to relabel_configs.
+const (
+	// MetaLabelPrefix is the prefix of all nmap meta labels
+	MetaLabelPrefix = "__meta_nmap_"
+	// MetaLabelIP is the IP address of the host
+	MetaLabelIP = MetaLabelPrefix + "ip"
+	// MetaLabelHostname is the reverse DNS name of the host
+	MetaLabelHostname = MetaLabelPrefix + "hostname"
+	// MetaLabelOS is the best OS match of the host
+	MetaLabelOS = MetaLabelPrefix + "os"
+	// MetaLabelPort is the open port
+	MetaLabelPort = MetaLabelPrefix + "port"
+	// MetaLabelPortName is the configured PortService name of the port
+	MetaLabelPortName = MetaLabelPrefix + "port_name"
+	// MetaLabelServiceName is the service name detected by nmap
+	MetaLabelServiceName = MetaLabelPrefix + "service_name"
+	// MetaLabelServiceProduct is the service product detected by nmap
+	MetaLabelServiceProduct = MetaLabelPrefix + "service_product"
+	// MetaLabelServiceVersion is the service version detected by nmap
+	MetaLabelServiceVersion = MetaLabelPrefix + "service_version"
+	// MetaLabelSubnet is the scan target the host was found in
+	MetaLabelSubnet = MetaLabelPrefix + "subnet"
+	// MetaLabelProfile is the name of the scan profile that found the host
+	MetaLabelProfile = MetaLabelPrefix + "profile"
+	// MetaLabelScanTime is the RFC 3339 start time of the scan that found the host
+	MetaLabelScanTime = MetaLabelPrefix + "scan_time"
+)
@@ -0,0 +1,26 @@
+package sd
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogKeyScanID is the log attribute carrying the ID of the scan a message belongs to
+const LogKeyScanID = "scan_id"
+
+// loggerKey is the context key of the logger scans log to
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx whose scans log to l
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Logger returns the logger set with WithLogger, or slog.Default() if ctx has none.
+// Scanner implementations should log to it so their messages carry the scan attributes.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok && l != nil {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,148 @@
+package sd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Ullaakut/nmap/v3"
+)
+
+// ReplayScanner is a Scanner that replays saved nmap XML (-oX) output instead of running nmap
+type ReplayScanner struct {
+	paths []string
+}
+
+// NewReplayScanner creates a Scanner reading nmap XML from the given files or directories.
+// Directories are read non-recursively and only files ending in ".xml" are loaded.
+func NewReplayScanner(paths ...string) *ReplayScanner {
+	return &ReplayScanner{paths: paths}
+}
+
+// Discover returns the hosts that are up in the replayed results, within the targets and not excluded
+func (r *ReplayScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error) {
+	log := Logger(ctx)
+	log.Debug("ReplayScanner.Discover: Starting host discovery", "targets", targets, "excludes", excludes, "paths", r.paths)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result, err := loadNmapXML(log, r.paths...)
+	if err != nil {
+		log.Error("ReplayScanner.Discover: Failed to load nmap XML", "error", err)
+		return nil, fmt.Errorf("failed to load nmap xml: %w", err)
+	}
+
+	var hosts []HostInfo
+	for _, host := range buildActiveHosts(log, result) {
+		if !matchesTargets(host, targets) {
+			log.Debug("ReplayScanner.Discover: Skipping host outside targets", "ip", host.IP)
+			continue
+		}
+		if len(excludes) > 0 && matchesTargets(host, excludes) {
+			log.Debug("ReplayScanner.Discover: Skipping excluded host", "ip", host.IP)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+
+	log.Debug("ReplayScanner.Discover: Host discovery completed", "active_hosts", len(hosts))
+	return hosts, nil
+}
+
+// ScanPorts returns the replayed port results of the hosts restricted to the given ports
+func (r *ReplayScanner) ScanPorts(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, error) {
+	log := Logger(ctx)
+	log.Debug("ReplayScanner.ScanPorts: Starting port scan", "host_count", len(hosts), "port_count", len(ports))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result, err := loadNmapXML(log, r.paths...)
+	if err != nil {
+		log.Error("ReplayScanner.ScanPorts: Failed to load nmap XML", "error", err)
+		return nil, fmt.Errorf("failed to load nmap xml: %w", err)
+	}
+
+	wantHosts := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		wantHosts[h] = true
+	}
+	wantPorts := make(map[uint16]bool, len(ports))
+	for _, ps := range ports {
+		wantPorts[ps.Port] = true
+	}
+
+	var hostInfos []HostInfo
+	for _, host := range buildHostInfos(log, result) {
+		if !wantHosts[host.IP] {
+			continue
+		}
+		var portInfos []PortInfo
+		for _, p := range host.Ports {
+			if wantPorts[p.Port] {
+				portInfos = append(portInfos, p)
+			}
+		}
+		if len(portInfos) == 0 {
+			log.Debug("ReplayScanner.ScanPorts: No requested ports found for host, skipping", "ip", host.IP)
+			continue
+		}
+		host.Ports = portInfos
+		hostInfos = append(hostInfos, host)
+	}
+
+	log.Debug("ReplayScanner.ScanPorts: Port scan completed", "host_count", len(hostInfos))
+	return hostInfos, nil
+}
+
+// LoadNmapXML parses nmap XML files or directories of them into a single run.
+// Hosts of all files are merged in path order.
+func LoadNmapXML(paths ...string) (*nmap.Run, error) {
+	return loadNmapXML(slog.Default(), paths...)
+}
+
+// loadNmapXML is LoadNmapXML logging to log
+func loadNmapXML(log *slog.Logger, paths ...string) (*nmap.Run, error) {
+	log.Debug("LoadNmapXML: Loading nmap XML", "paths", paths)
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, e := range entries {
+			if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".xml") {
+				dirFiles = append(dirFiles, filepath.Join(p, e.Name()))
+			}
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+
+	merged := &nmap.Run{}
+	for _, f := range files {
+		var run nmap.Run
+		if err := run.FromFile(f); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", f, err)
+		}
+		log.Debug("LoadNmapXML: Parsed file", "file", f, "hosts", len(run.Hosts))
+		merged.Hosts = append(merged.Hosts, run.Hosts...)
+	}
+
+	log.Debug("LoadNmapXML: Loaded nmap XML", "files", len(files), "hosts", len(merged.Hosts))
+	return merged, nil
+}
@@ -0,0 +1,122 @@
+package sd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// replayPorts mirrors the default middleware port list
+var replayPorts = []PortService{
+	{Port: 9182, Name: "windows_exporter", Job: "windows_exporter"},
+	{Port: 80, Name: "http", Job: "http_services"},
+	{Port: 443, Name: "https", Job: "http_services", Labels: map[string]string{"scheme": "https"}},
+	{Port: 8080, Name: "http-proxy", Job: "http_services"},
+}
+
+// replayResult is the golden file representation of a scan
+type replayResult struct {
+	Targets []ServiceTarget `json:"targets"`
+	Hosts   []HostInfo      `json:"hosts"`
+}
+
+func TestReplayGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		cidr  string
+	}{
+		{name: "office", paths: []string{"testdata/nmap/office.xml"}, cidr: "192.168.2.0/24"},
+		{name: "datacenter_single_host", paths: []string{"testdata/nmap/datacenter.xml"}, cidr: "10.0.3.14/32"},
+		{name: "directory", paths: []string{"testdata/nmap"}, cidr: "0.0.0.0/0"},
+		{name: "out_of_range", paths: []string{"testdata/nmap"}, cidr: "172.16.0.0/16"},
+		{name: "ipv6", paths: []string{"testdata/nmap/ipv6.xml"}, cidr: "fd00:10::/64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, hosts, err := ScanWith(NewReplayScanner(tt.paths...), tt.cidr, replayPorts)
+			if err != nil {
+				t.Fatalf("ScanWith returned error: %v", err)
+			}
+
+			// The scan time changes on every run
+			for _, st := range targets {
+				st.Labels[MetaLabelScanTime] = "SCAN_TIME"
+			}
+
+			got, err := json.MarshalIndent(replayResult{Targets: targets, Hosts: hosts}, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to marshal result: %v", err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "golden", tt.name+".json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("Failed to update golden file: %v", err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("Result does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestReplayScannerMissingFile(t *testing.T) {
+	scanner := NewReplayScanner("testdata/nmap/missing.xml")
+	if _, err := scanner.Discover(context.Background(), nil, nil); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestLoadNmapXMLDirectory(t *testing.T) {
+	run, err := LoadNmapXML("testdata/nmap")
+	if err != nil {
+		t.Fatalf("LoadNmapXML returned error: %v", err)
+	}
+
+	// datacenter.xml sorts before ipv6.xml and office.xml
+	if len(run.Hosts) != 8 {
+		t.Fatalf("Expected 8 hosts, got %d", len(run.Hosts))
+	}
+
+	if run.Hosts[0].Addresses[0].String() != "10.0.3.14" {
+		t.Errorf("Expected first host 10.0.3.14, got %s", run.Hosts[0].Addresses[0].String())
+	}
+}
+
+func TestReplayScannerExcludes(t *testing.T) {
+	spec := ScanSpec{
+		Targets:  []string{"192.168.2.0/24", "10.0.3.14"},
+		Excludes: []string{"192.168.2.10", "printer-2f.corp.local"},
+		Ports:    replayPorts,
+	}
+
+	_, hosts, err := Scan(context.Background(), NewReplayScanner("testdata/nmap"), spec)
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+
+	var ips []string
+	for _, h := range hosts {
+		ips = append(ips, h.IP)
+	}
+
+	if len(ips) != 2 || ips[0] != "10.0.3.14" || ips[1] != "192.168.2.11" {
+		t.Errorf("Expected hosts [10.0.3.14 192.168.2.11], got %v", ips)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,242 +39,492 @@ type PortInfo struct {
 	Port    uint16 `json:"port"`
 	State   string `json:"state"`
 	Service string `json:"service,omitempty"`
+	Product string `json:"product,omitempty"`
+	Version string `json:"version,omitempty"`
 }
 
-// ScanNetworkRange scans the given CIDR range for active hosts and open ports
+// ScanSpec describes what a scan covers
+type ScanSpec struct {
+	// Targets are CIDR ranges, IP addresses, nmap ranges or hostnames to scan
+	Targets []string
+	// Excludes are targets that must never be probed
+	Excludes []string
+	// Ports are the ports to scan on active hosts
+	Ports []PortService
+	// Profile is the scan profile name reported in the __meta_nmap_profile label
+	Profile string
+	// Stats is filled in by Scan if set, also for failed scans as far as they got
+	Stats *ScanStats
+	// ID identifies the scan in the logs, added to every message as the LogKeyScanID attribute
+	ID string
+}
+
+// ScanStats describes the phases of a scan
+type ScanStats struct {
+	// Duration of the host discovery phase
+	DiscoveryDuration time.Duration
+	// Duration of the port scan phase, zero if no host was up
+	PortScanDuration time.Duration
+	// Number of hosts found up by host discovery
+	HostsUp int
+	// Number of warnings reported by nmap
+	Warnings int
+}
+
+// Scanner is a pluggable host discovery and port scanning backend
+type Scanner interface {
+	// Discover returns the hosts that are up within the given targets, skipping the excluded ones
+	Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error)
+	// ScanPorts scans the given ports on the hosts and returns the hosts with open ports
+	ScanPorts(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, error)
+}
+
+// WarningCounter is implemented by Scanners whose backend reports warnings, such as NmapScanner.
+// Scan calls its methods in place of Discover and ScanPorts and adds the warnings to ScanStats.
+type WarningCounter interface {
+	// DiscoverCountingWarnings is Discover also returning the number of warnings, as far as it got
+	DiscoverCountingWarnings(ctx context.Context, targets []string, excludes []string) ([]HostInfo, int, error)
+	// ScanPortsCountingWarnings is ScanPorts also returning the number of warnings, as far as it got
+	ScanPortsCountingWarnings(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, int, error)
+}
+
+// discover runs the host discovery of scanner and returns the warnings if it counts them
+func discover(ctx context.Context, scanner Scanner, targets []string, excludes []string) ([]HostInfo, int, error) {
+	if wc, ok := scanner.(WarningCounter); ok {
+		return wc.DiscoverCountingWarnings(ctx, targets, excludes)
+	}
+	hosts, err := scanner.Discover(ctx, targets, excludes)
+	return hosts, 0, err
+}
+
+// scanPorts runs the port scan of scanner and returns the warnings if it counts them
+func scanPorts(ctx context.Context, scanner Scanner, hosts []string, ports []PortService) ([]HostInfo, int, error) {
+	if wc, ok := scanner.(WarningCounter); ok {
+		return wc.ScanPortsCountingWarnings(ctx, hosts, ports)
+	}
+	hostInfos, err := scanner.ScanPorts(ctx, hosts, ports)
+	return hostInfos, 0, err
+}
+
+// NmapScanner is the default Scanner backed by the nmap binary.
+// IPv6 targets are scanned in a separate nmap run using -6.
+type NmapScanner struct {
+	// DualStack scans hostname targets over both IPv4 and IPv6 so hosts
+	// with addresses in both families are reported once per family
+	DualStack bool
+}
+
+// NewNmapScanner creates a Scanner that runs nmap
+func NewNmapScanner() *NmapScanner {
+	return &NmapScanner{}
+}
+
+// DefaultScanTimeout bounds scans started without a caller supplied context
+const DefaultScanTimeout = 10 * time.Minute
+
+// ScanNetworkRange scans the given CIDR range for active hosts and open ports using nmap
 func ScanNetworkRange(cidr string, ports []PortService) ([]ServiceTarget, []HostInfo, error) {
-	slog.Debug("ScanNetworkRange: Starting", "cidr", cidr, "port_count", len(ports))
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	return ScanWith(NewNmapScanner(), cidr, ports)
+}
+
+// ScanNetworkRangeContext is like ScanNetworkRange but runs until ctx is cancelled or expires
+func ScanNetworkRangeContext(ctx context.Context, cidr string, ports []PortService) ([]ServiceTarget, []HostInfo, error) {
+	return ScanWithContext(ctx, NewNmapScanner(), cidr, ports)
+}
+
+// ScanWith scans the given CIDR range for active hosts and open ports using the given scanner.
+// The scan is bounded by DefaultScanTimeout.
+func ScanWith(scanner Scanner, cidr string, ports []PortService) ([]ServiceTarget, []HostInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultScanTimeout)
 	defer cancel()
+	Logger(ctx).Debug("ScanWith: Created context with default timeout", "timeout", DefaultScanTimeout)
+	return ScanWithContext(ctx, scanner, cidr, ports)
+}
 
-	slog.Info("Starting nmap scan", "cidr", cidr)
-	slog.Debug("ScanNetworkRange: Creating context with 10 minute timeout")
+// ScanWithContext scans the given CIDR range using the given scanner until ctx is cancelled or expires
+func ScanWithContext(ctx context.Context, scanner Scanner, cidr string, ports []PortService) ([]ServiceTarget, []HostInfo, error) {
+	return Scan(ctx, scanner, ScanSpec{Targets: []string{cidr}, Ports: ports})
+}
+
+// Scan scans the targets of spec for active hosts and open ports until ctx is cancelled or expires
+func Scan(ctx context.Context, scanner Scanner, spec ScanSpec) ([]ServiceTarget, []HostInfo, error) {
+	log := Logger(ctx)
+	if spec.ID != "" {
+		log = log.With(LogKeyScanID, spec.ID)
+		ctx = WithLogger(ctx, log)
+	}
+	log.Debug("Scan: Starting", "targets", spec.Targets, "excludes", spec.Excludes, "port_count", len(spec.Ports))
+
+	log.Info("Starting network scan", "targets", spec.Targets)
+	scanTime := time.Now()
+	stats := spec.Stats
+	if stats == nil {
+		stats = &ScanStats{}
+	}
 
 	// First scan: host discovery
-	slog.Debug("ScanNetworkRange: Starting host discovery phase")
-	hosts, err := discoverHosts(ctx, cidr)
+	log.Debug("Scan: Starting host discovery phase")
+	discovered, warnings, err := discover(ctx, scanner, spec.Targets, spec.Excludes)
+	stats.DiscoveryDuration = time.Since(scanTime)
+	stats.HostsUp = len(discovered)
+	stats.Warnings += warnings
 	if err != nil {
-		slog.Error("ScanNetworkRange: Host discovery failed", "error", err)
+		log.Error("Scan: Host discovery failed", "error", err)
 		return nil, nil, fmt.Errorf("host discovery failed: %w", err)
 	}
-	slog.Debug("ScanNetworkRange: Host discovery completed", "hosts_found", len(hosts))
+	log.Debug("Scan: Host discovery completed", "hosts_found", len(discovered))
 
-	if len(hosts) == 0 {
-		slog.Warn("No active hosts found")
-		slog.Debug("ScanNetworkRange: Returning empty results")
+	if len(discovered) == 0 {
+		log.Warn("No active hosts found")
+		log.Debug("Scan: Returning empty results")
 		return []ServiceTarget{}, []HostInfo{}, nil
 	}
 
-	slog.Info("Found active hosts, scanning ports", "count", len(hosts))
-	slog.Debug("ScanNetworkRange: Active hosts", "hosts", hosts)
+	hosts := make([]string, 0, len(discovered))
+	for _, h := range discovered {
+		hosts = append(hosts, h.IP)
+	}
 
-	// Second scan: port detection on active hosts
-	slog.Debug("ScanNetworkRange: Starting port scan phase")
-	return scanPorts(ctx, hosts, ports)
-}
+	if err := ctx.Err(); err != nil {
+		log.Debug("Scan: Context done before port scan", "error", err)
+		return nil, nil, fmt.Errorf("scan cancelled: %w", err)
+	}
 
-// discoverHosts performs host discovery on the CIDR range
-func discoverHosts(ctx context.Context, cidr string) ([]string, error) {
-	slog.Debug("discoverHosts: Starting host discovery", "cidr", cidr)
+	log.Info("Found active hosts, scanning ports", "count", len(hosts))
+	log.Debug("Scan: Active hosts", "hosts", hosts)
 
-	slog.Debug("discoverHosts: Creating nmap scanner with ping scan")
-	scanner, err := nmap.NewScanner(
-		ctx,
-		nmap.WithTargets(cidr),
-		nmap.WithPingScan(),
-	)
+	// Second scan: port detection on active hosts
+	log.Debug("Scan: Starting port scan phase")
+	portScanStarted := time.Now()
+	hostInfos, warnings, err := scanPorts(ctx, scanner, hosts, spec.Ports)
+	stats.PortScanDuration = time.Since(portScanStarted)
+	stats.Warnings += warnings
 	if err != nil {
-		slog.Error("discoverHosts: Failed to create scanner", "error", err)
-		return nil, fmt.Errorf("failed to create scanner: %w", err)
+		log.Error("Scan: Port scan failed", "error", err)
+		return nil, nil, err
 	}
-	slog.Debug("discoverHosts: Scanner created successfully")
 
-	slog.Debug("discoverHosts: Running nmap scan...")
-	result, warnings, err := scanner.Run()
-	if err != nil {
-		slog.Error("discoverHosts: Scan execution failed", "error", err)
-		return nil, fmt.Errorf("scan failed: %w", err)
-	}
-	slog.Debug("discoverHosts: Nmap scan completed", "hosts_scanned", len(result.Hosts))
+	log.Debug("Scan: Building service targets from results")
+	serviceTargets := buildServiceTargets(log, hostInfos, spec, scanTime)
+	log.Debug("Scan: Service targets built", "target_groups", len(serviceTargets))
+
+	return serviceTargets, hostInfos, nil
+}
+
+// Discover performs an nmap ping scan and returns the hosts that are up
+func (s *NmapScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error) {
+	hosts, _, err := s.DiscoverCountingWarnings(ctx, targets, excludes)
+	return hosts, err
+}
 
-	if len(*warnings) > 0 {
-		slog.Debug("discoverHosts: Processing nmap warnings", "warning_count", len(*warnings))
-		for _, w := range *warnings {
-			slog.Warn("nmap warning", "message", w)
+// DiscoverCountingWarnings implements WarningCounter
+func (s *NmapScanner) DiscoverCountingWarnings(ctx context.Context, targets []string, excludes []string) ([]HostInfo, int, error) {
+	log := Logger(ctx)
+	log.Debug("Discover: Starting host discovery", "targets", targets, "excludes", excludes, "dual_stack", s.DualStack)
+
+	var hosts []HostInfo
+	var warnings int
+	for _, ipv6 := range []bool{false, true} {
+		familyTargets := s.filterFamily(targets, ipv6)
+		if len(familyTargets) == 0 {
+			continue
+		}
+
+		log.Debug("Discover: Creating nmap scanner with ping scan", "ipv6", ipv6, "targets", familyTargets)
+		opts := []nmap.Option{
+			nmap.WithTargets(familyTargets...),
+			nmap.WithPingScan(),
 		}
+		if familyExcludes := filterExcludes(excludes, ipv6); len(familyExcludes) > 0 {
+			opts = append(opts, nmap.WithTargetExclusion(strings.Join(familyExcludes, ",")))
+		}
+		if ipv6 {
+			opts = append(opts, nmap.WithIPv6Scanning())
+		}
+
+		result, n, err := runNmap(ctx, "Discover", opts)
+		warnings += n
+		if err != nil {
+			return nil, warnings, fmt.Errorf("scan failed: %w", err)
+		}
+
+		hosts = append(hosts, buildActiveHosts(log, result)...)
 	}
 
-	slog.Debug("discoverHosts: Filtering active hosts")
-	var activeHosts []string
-	for _, host := range result.Hosts {
-		if len(host.Addresses) > 0 && host.Status.State == "up" {
-			ip := host.Addresses[0].String()
-			activeHosts = append(activeHosts, ip)
-			slog.Debug("discoverHosts: Found active host", "ip", ip, "status", host.Status.State)
-		} else {
-			if len(host.Addresses) > 0 {
-				slog.Debug("discoverHosts: Skipping inactive host", "ip", host.Addresses[0].String(), "status", host.Status.State)
-			}
+	log.Debug("Discover: Host discovery completed", "active_hosts", len(hosts))
+	return hosts, warnings, nil
+}
+
+// ScanPorts runs an nmap port scan with service and OS detection on the hosts
+func (s *NmapScanner) ScanPorts(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, error) {
+	hostInfos, _, err := s.ScanPortsCountingWarnings(ctx, hosts, ports)
+	return hostInfos, err
+}
+
+// ScanPortsCountingWarnings implements WarningCounter
+func (s *NmapScanner) ScanPortsCountingWarnings(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, int, error) {
+	log := Logger(ctx)
+	log.Debug("ScanPorts: Starting port scan", "host_count", len(hosts), "port_count", len(ports))
+
+	portStr := portList(log, ports)
+	log.Debug("ScanPorts: Port list built", "ports", portStr)
+
+	var hostInfos []HostInfo
+	var warnings int
+	for _, ipv6 := range []bool{false, true} {
+		familyHosts := s.filterFamily(hosts, ipv6)
+		if len(familyHosts) == 0 {
+			continue
 		}
+
+		log.Debug("ScanPorts: Creating nmap scanner with service info and OS detection", "ipv6", ipv6, "host_count", len(familyHosts))
+		opts := []nmap.Option{
+			nmap.WithTargets(familyHosts...),
+			nmap.WithPorts(portStr),
+			nmap.WithServiceInfo(),
+			nmap.WithOSDetection(),
+		}
+		if ipv6 {
+			opts = append(opts, nmap.WithIPv6Scanning())
+		}
+
+		result, n, err := runNmap(ctx, "ScanPorts", opts)
+		warnings += n
+		if err != nil {
+			return nil, warnings, fmt.Errorf("port scan failed: %w", err)
+		}
+
+		log.Debug("ScanPorts: Building host information from results")
+		hostInfos = append(hostInfos, buildHostInfos(log, result)...)
 	}
 
-	slog.Debug("discoverHosts: Host discovery completed", "active_hosts", len(activeHosts))
-	return activeHosts, nil
+	log.Debug("ScanPorts: Host information built", "host_count", len(hostInfos))
+	return hostInfos, warnings, nil
 }
 
-// scanPorts scans common ports on active hosts
-func scanPorts(ctx context.Context, hosts []string, ports []PortService) ([]ServiceTarget, []HostInfo, error) {
-	slog.Debug("scanPorts: Starting port scan", "host_count", len(hosts), "port_count", len(ports))
+// filterFamily returns the targets to scan in the IPv4 or IPv6 nmap run.
+// Hostnames are scanned over IPv4, and over IPv6 as well in dual-stack mode.
+func (s *NmapScanner) filterFamily(targets []string, ipv6 bool) []string {
+	var filtered []string
+	for _, t := range targets {
+		switch targetFamily(t) {
+		case familyIPv4:
+			if !ipv6 {
+				filtered = append(filtered, t)
+			}
+		case familyIPv6:
+			if ipv6 {
+				filtered = append(filtered, t)
+			}
+		default:
+			if !ipv6 || s.DualStack {
+				filtered = append(filtered, t)
+			}
+		}
+	}
+	return filtered
+}
 
-	// Build port list
-	slog.Debug("scanPorts: Building port list")
-	var portList []string
-	for _, ps := range ports {
-		portList = append(portList, fmt.Sprintf("%d", ps.Port))
-		slog.Debug("scanPorts: Adding port to scan", "port", ps.Port, "name", ps.Name, "job", ps.Job)
+// filterExcludes returns the excludes to pass to the IPv4 or IPv6 nmap run. Hostnames are
+// excluded from both runs whatever DualStack says, since an IPv6 prefix target can cover them.
+func filterExcludes(excludes []string, ipv6 bool) []string {
+	var filtered []string
+	for _, e := range excludes {
+		switch targetFamily(e) {
+		case familyIPv4:
+			if !ipv6 {
+				filtered = append(filtered, e)
+			}
+		case familyIPv6:
+			if ipv6 {
+				filtered = append(filtered, e)
+			}
+		default:
+			filtered = append(filtered, e)
+		}
 	}
-	portStr := strings.Join(portList, ",")
-	slog.Debug("scanPorts: Port list built", "ports", portStr)
-
-	slog.Debug("scanPorts: Creating nmap scanner with service info and OS detection")
-	scanner, err := nmap.NewScanner(
-		ctx,
-		nmap.WithTargets(hosts...),
-		nmap.WithPorts(portStr),
-		nmap.WithServiceInfo(),
-		nmap.WithOSDetection(),
-	)
+	return filtered
+}
+
+// runNmap creates and runs an nmap scanner, logs its warnings and returns their number
+func runNmap(ctx context.Context, phase string, opts []nmap.Option) (*nmap.Run, int, error) {
+	log := Logger(ctx)
+	scanner, err := nmap.NewScanner(ctx, opts...)
 	if err != nil {
-		slog.Error("scanPorts: Failed to create port scanner", "error", err)
-		return nil, nil, fmt.Errorf("failed to create port scanner: %w", err)
+		log.Error(phase+": Failed to create scanner", "error", err)
+		return nil, 0, fmt.Errorf("failed to create scanner: %w", err)
 	}
-	slog.Debug("scanPorts: Scanner created successfully")
+	log.Debug(phase + ": Scanner created successfully")
 
-	slog.Debug("scanPorts: Running nmap port scan...")
+	log.Debug(phase + ": Running nmap scan...")
 	result, warnings, err := scanner.Run()
 	if err != nil {
-		slog.Error("scanPorts: Port scan execution failed", "error", err)
-		return nil, nil, fmt.Errorf("port scan failed: %w", err)
+		log.Error(phase+": Scan execution failed", "error", err)
+		return nil, 0, err
 	}
-	slog.Debug("scanPorts: Nmap port scan completed", "hosts_scanned", len(result.Hosts))
+	log.Debug(phase+": Nmap scan completed", "hosts_scanned", len(result.Hosts))
 
-	if len(*warnings) > 0 {
-		slog.Debug("scanPorts: Processing nmap warnings", "warning_count", len(*warnings))
-		for _, w := range *warnings {
-			slog.Warn("nmap warning", "message", w)
-		}
+	logWarnings(log, warnings)
+	if warnings == nil {
+		return result, 0, nil
 	}
+	return result, len(*warnings), nil
+}
 
-	slog.Debug("scanPorts: Building service targets from results")
-	serviceTargets := buildServiceTargets(result, ports)
-	slog.Debug("scanPorts: Service targets built", "target_groups", len(serviceTargets))
+// portList builds the comma separated nmap port list
+func portList(log *slog.Logger, ports []PortService) string {
+	var list []string
+	for _, ps := range ports {
+		list = append(list, fmt.Sprintf("%d", ps.Port))
+		log.Debug("portList: Adding port to scan", "port", ps.Port, "name", ps.Name, "job", ps.Job)
+	}
+	return strings.Join(list, ",")
+}
 
-	slog.Debug("scanPorts: Building host information from results")
-	hostInfos := buildHostInfos(result)
-	slog.Debug("scanPorts: Host information built", "host_count", len(hostInfos))
+// logWarnings logs the warnings reported by nmap
+func logWarnings(log *slog.Logger, warnings *[]string) {
+	if warnings == nil || len(*warnings) == 0 {
+		return
+	}
+	log.Debug("logWarnings: Processing nmap warnings", "warning_count", len(*warnings))
+	for _, w := range *warnings {
+		log.Warn("nmap warning", "message", w)
+	}
+}
 
-	return serviceTargets, hostInfos, nil
+// hostAddress returns the first IPv4 or IPv6 address of the host, skipping MAC addresses
+func hostAddress(host nmap.Host) string {
+	for _, addr := range host.Addresses {
+		if addr.AddrType != "mac" {
+			return addr.String()
+		}
+	}
+	return ""
 }
 
-// buildServiceTargets organizes scan results by service type
-func buildServiceTargets(result *nmap.Run, ports []PortService) []ServiceTarget {
-	slog.Debug("buildServiceTargets: Starting to build service targets", "total_hosts", len(result.Hosts))
+// buildActiveHosts extracts the hosts that are up from a discovery scan
+func buildActiveHosts(log *slog.Logger, result *nmap.Run) []HostInfo {
+	log.Debug("buildActiveHosts: Filtering active hosts")
+	var activeHosts []HostInfo
+	for _, host := range result.Hosts {
+		ip := hostAddress(host)
+		if ip != "" && host.Status.State == "up" {
+			hostname := ""
+			if len(host.Hostnames) > 0 {
+				hostname = host.Hostnames[0].String()
+			}
+			activeHosts = append(activeHosts, HostInfo{IP: ip, Hostname: hostname})
+			log.Debug("buildActiveHosts: Found active host", "ip", ip, "status", host.Status.State)
+		} else if ip != "" {
+			log.Debug("buildActiveHosts: Skipping inactive host", "ip", ip, "status", host.Status.State)
+		}
+	}
+	return activeHosts
+}
 
-	// Group targets by job
-	jobMap := make(map[string][]string)
-	jobLabels := make(map[string]map[string]string)
+// buildServiceTargets creates one target group per open host:port matching a PortService.
+// Each group carries the job, the static PortService labels and the __meta_nmap_* labels.
+func buildServiceTargets(log *slog.Logger, hosts []HostInfo, spec ScanSpec, scanTime time.Time) []ServiceTarget {
+	log.Debug("buildServiceTargets: Starting to build service targets", "total_hosts", len(hosts))
 
-	for _, host := range result.Hosts {
-		if len(host.Addresses) == 0 {
-			slog.Debug("buildServiceTargets: Skipping host with no addresses")
+	targets := []ServiceTarget{}
+	for _, host := range hosts {
+		if host.IP == "" {
+			log.Debug("buildServiceTargets: Skipping host with no addresses")
 			continue
 		}
 
-		ip := host.Addresses[0].String()
-		slog.Debug("buildServiceTargets: Processing host", "ip", ip, "port_count", len(host.Ports))
+		ip := host.IP
+		subnet := matchTarget(host, spec.Targets)
+		log.Debug("buildServiceTargets: Processing host", "ip", ip, "subnet", subnet, "port_count", len(host.Ports))
 
 		for _, port := range host.Ports {
-			if port.State.State != "open" {
-				slog.Debug("buildServiceTargets: Skipping non-open port", "ip", ip, "port", port.ID, "state", port.State.State)
+			if port.State != "open" {
+				log.Debug("buildServiceTargets: Skipping non-open port", "ip", ip, "port", port.Port, "state", port.State)
 				continue
 			}
 
 			// Find matching port service
-			for _, ps := range ports {
-				if port.ID == ps.Port {
-					target := fmt.Sprintf("%s:%d", ip, port.ID)
-					jobMap[ps.Job] = append(jobMap[ps.Job], target)
-					slog.Debug("buildServiceTargets: Matched port to job", "target", target, "job", ps.Job, "service", ps.Name)
-
-					// Set labels for this job
-					if _, exists := jobLabels[ps.Job]; !exists {
-						labels := map[string]string{
-							"job": ps.Job,
-						}
-						// Add custom labels
-						for k, v := range ps.Labels {
-							labels[k] = v
-						}
-						jobLabels[ps.Job] = labels
-						slog.Debug("buildServiceTargets: Created labels for job", "job", ps.Job, "labels", labels)
-					}
-					break
+			for _, ps := range spec.Ports {
+				if port.Port != ps.Port {
+					continue
 				}
-			}
-		}
-	}
 
-	slog.Debug("buildServiceTargets: Converting job map to service targets", "job_count", len(jobMap))
-	// Convert to ServiceTarget slice
-	var targets []ServiceTarget
-	for job, targetList := range jobMap {
-		if len(targetList) > 0 {
-			targets = append(targets, ServiceTarget{
-				Targets: targetList,
-				Labels:  jobLabels[job],
-			})
-			slog.Debug("buildServiceTargets: Added service target", "job", job, "target_count", len(targetList))
+				target := net.JoinHostPort(ip, strconv.Itoa(int(port.Port)))
+				labels := map[string]string{
+					"job":             ps.Job,
+					MetaLabelIP:       ip,
+					MetaLabelPort:     strconv.Itoa(int(port.Port)),
+					MetaLabelScanTime: scanTime.UTC().Format(time.RFC3339),
+				}
+				setLabel(labels, MetaLabelHostname, host.Hostname)
+				setLabel(labels, MetaLabelOS, host.OS)
+				setLabel(labels, MetaLabelPortName, ps.Name)
+				setLabel(labels, MetaLabelServiceName, port.Service)
+				setLabel(labels, MetaLabelServiceProduct, port.Product)
+				setLabel(labels, MetaLabelServiceVersion, port.Version)
+				setLabel(labels, MetaLabelSubnet, subnet)
+				setLabel(labels, MetaLabelProfile, spec.Profile)
+				// Add custom labels
+				for k, v := range ps.Labels {
+					labels[k] = v
+				}
+
+				targets = append(targets, ServiceTarget{
+					Targets: []string{target},
+					Labels:  labels,
+				})
+				log.Debug("buildServiceTargets: Matched port to job", "target", target, "job", ps.Job, "service", ps.Name)
+				break
+			}
 		}
 	}
 
-	slog.Debug("buildServiceTargets: Completed building service targets", "total_service_groups", len(targets))
+	log.Debug("buildServiceTargets: Completed building service targets", "total_service_groups", len(targets))
 	return targets
 }
 
+// setLabel sets a label only when the value is not empty
+func setLabel(labels map[string]string, name, value string) {
+	if value != "" {
+		labels[name] = value
+	}
+}
+
 // buildHostInfos extracts detailed host information from scan results
-func buildHostInfos(result *nmap.Run) []HostInfo {
-	slog.Debug("buildHostInfos: Starting to build host information", "total_hosts", len(result.Hosts))
+func buildHostInfos(log *slog.Logger, result *nmap.Run) []HostInfo {
+	log.Debug("buildHostInfos: Starting to build host information", "total_hosts", len(result.Hosts))
 	var hostInfos []HostInfo
 
 	for _, host := range result.Hosts {
-		if len(host.Addresses) == 0 {
-			slog.Debug("buildHostInfos: Skipping host with no addresses")
+		ip := hostAddress(host)
+		if ip == "" {
+			log.Debug("buildHostInfos: Skipping host with no addresses")
 			continue
 		}
 
-		ip := host.Addresses[0].String()
-		slog.Debug("buildHostInfos: Processing host", "ip", ip)
+		log.Debug("buildHostInfos: Processing host", "ip", ip)
 
 		// Get hostname if available
 		hostname := ""
 		if len(host.Hostnames) > 0 {
 			hostname = host.Hostnames[0].String()
-			slog.Debug("buildHostInfos: Found hostname", "ip", ip, "hostname", hostname)
+			log.Debug("buildHostInfos: Found hostname", "ip", ip, "hostname", hostname)
 		} else {
-			slog.Debug("buildHostInfos: No hostname found", "ip", ip)
+			log.Debug("buildHostInfos: No hostname found", "ip", ip)
 		}
 
 		// Get OS information if available
 		osInfo := ""
 		if len(host.OS.Matches) > 0 {
 			osInfo = host.OS.Matches[0].Name
-			slog.Debug("buildHostInfos: Found OS info", "ip", ip, "os", osInfo, "accuracy", host.OS.Matches[0].Accuracy)
+			log.Debug("buildHostInfos: Found OS info", "ip", ip, "os", osInfo, "accuracy", host.OS.Matches[0].Accuracy)
 		} else {
-			slog.Debug("buildHostInfos: No OS information detected", "ip", ip)
+			log.Debug("buildHostInfos: No OS information detected", "ip", ip)
 		}
 
 		// Collect port information
-		slog.Debug("buildHostInfos: Collecting port information", "ip", ip, "total_ports", len(host.Ports))
+		log.Debug("buildHostInfos: Collecting port information", "ip", ip, "total_ports", len(host.Ports))
 		var portInfos []PortInfo
 		for _, port := range host.Ports {
 			if port.State.State != "closed" && port.State.State != "filtered" {
@@ -280,10 +532,12 @@ func buildHostInfos(result *nmap.Run) []HostInfo {
 					Port:    port.ID,
 					State:   port.State.State,
 					Service: port.Service.Name,
+					Product: port.Service.Product,
+					Version: port.Service.Version,
 				})
-				slog.Debug("buildHostInfos: Added port info", "ip", ip, "port", port.ID, "state", port.State.State, "service", port.Service.Name)
+				log.Debug("buildHostInfos: Added port info", "ip", ip, "port", port.ID, "state", port.State.State, "service", port.Service.Name)
 			} else {
-				slog.Debug("buildHostInfos: Skipping port", "ip", ip, "port", port.ID, "state", port.State.State)
+				log.Debug("buildHostInfos: Skipping port", "ip", ip, "port", port.ID, "state", port.State.State)
 			}
 		}
 
@@ -294,12 +548,12 @@ func buildHostInfos(result *nmap.Run) []HostInfo {
 				OS:       osInfo,
 				Ports:    portInfos,
 			})
-			slog.Debug("buildHostInfos: Added host info", "ip", ip, "port_count", len(portInfos))
+			log.Debug("buildHostInfos: Added host info", "ip", ip, "port_count", len(portInfos))
 		} else {
-			slog.Debug("buildHostInfos: No open ports found for host, skipping", "ip", ip)
+			log.Debug("buildHostInfos: No open ports found for host, skipping", "ip", ip)
 		}
 	}
 
-	slog.Debug("buildHostInfos: Completed building host information", "total_hosts_with_ports", len(hostInfos))
+	log.Debug("buildHostInfos: Completed building host information", "total_hosts_with_ports", len(hostInfos))
 	return hostInfos
 }
@@ -1,7 +1,14 @@
 package sd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServiceTarget(t *testing.T) {
@@ -40,3 +47,246 @@ func TestPortService(t *testing.T) {
 		t.Errorf("Expected job windows_exporter, got %s", port.Job)
 	}
 }
+
+// fakeScanner is a Scanner returning canned results
+type fakeScanner struct {
+	discovered []HostInfo
+	scanned    []HostInfo
+	gotHosts   []string
+}
+
+func (f *fakeScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error) {
+	return f.discovered, nil
+}
+
+func (f *fakeScanner) ScanPorts(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, error) {
+	f.gotHosts = hosts
+	return f.scanned, nil
+}
+
+func TestScanWithCustomScanner(t *testing.T) {
+	scanner := &fakeScanner{
+		discovered: []HostInfo{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+		scanned: []HostInfo{
+			{IP: "10.0.0.1", Ports: []PortInfo{{Port: 9182, State: "open"}, {Port: 80, State: "open|filtered"}}},
+			{IP: "10.0.0.2", Ports: []PortInfo{{Port: 80, State: "open", Service: "http"}}},
+		},
+	}
+	ports := []PortService{
+		{Port: 9182, Name: "windows_exporter", Job: "windows_exporter"},
+		{Port: 80, Name: "http", Job: "http_services", Labels: map[string]string{"env": "test"}},
+	}
+
+	targets, hosts, err := ScanWith(scanner, "10.0.0.0/24", ports)
+	if err != nil {
+		t.Fatalf("ScanWith returned error: %v", err)
+	}
+
+	if len(scanner.gotHosts) != 2 {
+		t.Errorf("Expected 2 hosts passed to ScanPorts, got %d", len(scanner.gotHosts))
+	}
+
+	if len(hosts) != 2 {
+		t.Errorf("Expected 2 hosts, got %d", len(hosts))
+	}
+
+	jobs := make(map[string]ServiceTarget)
+	for _, st := range targets {
+		jobs[st.Labels["job"]] = st
+	}
+
+	if got := jobs["windows_exporter"].Targets; len(got) != 1 || got[0] != "10.0.0.1:9182" {
+		t.Errorf("Unexpected windows_exporter targets: %v", got)
+	}
+
+	if got := jobs["http_services"].Targets; len(got) != 1 || got[0] != "10.0.0.2:80" {
+		t.Errorf("Unexpected http_services targets: %v", got)
+	}
+
+	if jobs["http_services"].Labels["env"] != "test" {
+		t.Errorf("Expected env label to be test, got %s", jobs["http_services"].Labels["env"])
+	}
+}
+
+// warningScanner is a fakeScanner reporting a fixed number of warnings per phase
+type warningScanner struct {
+	fakeScanner
+	discoveryWarnings int
+	portScanWarnings  int
+}
+
+func (w *warningScanner) DiscoverCountingWarnings(ctx context.Context, targets []string, excludes []string) ([]HostInfo, int, error) {
+	hosts, err := w.Discover(ctx, targets, excludes)
+	return hosts, w.discoveryWarnings, err
+}
+
+func (w *warningScanner) ScanPortsCountingWarnings(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, int, error) {
+	hostInfos, err := w.ScanPorts(ctx, hosts, ports)
+	return hostInfos, w.portScanWarnings, err
+}
+
+func TestScanStats(t *testing.T) {
+	scanner := &warningScanner{
+		fakeScanner: fakeScanner{
+			discovered: []HostInfo{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+			scanned:    []HostInfo{{IP: "10.0.0.1", Ports: []PortInfo{{Port: 80, State: "open"}}}},
+		},
+		discoveryWarnings: 2,
+		portScanWarnings:  1,
+	}
+	var stats ScanStats
+	_, _, err := Scan(context.Background(), scanner, ScanSpec{Targets: []string{"10.0.0.0/24"}, Stats: &stats})
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	if stats.HostsUp != 2 || stats.Warnings != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.DiscoveryDuration <= 0 || stats.PortScanDuration <= 0 {
+		t.Errorf("Expected both phase durations to be set, got %+v", stats)
+	}
+}
+
+// loggingScanner is a fakeScanner logging its discovery to the logger of the context
+type loggingScanner struct {
+	fakeScanner
+}
+
+func (l *loggingScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error) {
+	Logger(ctx).Info("loggingScanner: Discovering")
+	return l.fakeScanner.Discover(ctx, targets, excludes)
+}
+
+func TestScanLogsWithScanID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	scanner := &loggingScanner{fakeScanner{
+		discovered: []HostInfo{{IP: "10.0.0.1"}},
+		scanned:    []HostInfo{{IP: "10.0.0.1", Ports: []PortInfo{{Port: 80, State: "open"}}}},
+	}}
+
+	ctx := WithLogger(context.Background(), logger)
+	if _, _, err := Scan(ctx, scanner, ScanSpec{Targets: []string{"10.0.0.0/24"}, ID: "scan-1"}); err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	foundScanner := false
+	for _, line := range lines {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		if record[LogKeyScanID] != "scan-1" {
+			t.Errorf("Expected %s attribute on every message, got %q", LogKeyScanID, line)
+		}
+		if record["msg"] == "loggingScanner: Discovering" {
+			foundScanner = true
+		}
+	}
+	if !foundScanner {
+		t.Error("Expected the scanner to log to the injected logger")
+	}
+}
+
+func TestLoggerDefault(t *testing.T) {
+	if Logger(context.Background()) != slog.Default() {
+		t.Error("Expected slog.Default() without an injected logger")
+	}
+}
+
+func TestScanWithNoActiveHosts(t *testing.T) {
+	targets, hosts, err := ScanWith(&fakeScanner{}, "10.0.0.0/24", nil)
+	if err != nil {
+		t.Fatalf("ScanWith returned error: %v", err)
+	}
+
+	if len(targets) != 0 || len(hosts) != 0 {
+		t.Errorf("Expected empty results, got %d targets and %d hosts", len(targets), len(hosts))
+	}
+}
+
+// blockingScanner is a Scanner whose discovery blocks until the context is done
+type blockingScanner struct{}
+
+func (blockingScanner) Discover(ctx context.Context, targets []string, excludes []string) ([]HostInfo, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingScanner) ScanPorts(ctx context.Context, hosts []string, ports []PortService) ([]HostInfo, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestScanWithContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := ScanWithContext(ctx, blockingScanner{}, "10.0.0.0/24", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestNmapScannerFilterFamily(t *testing.T) {
+	targets := []string{"10.0.0.0/24", "10.0.1.1-20", "fd00::/64", "fd00::1", "db-01.dc.local"}
+
+	tests := []struct {
+		name      string
+		dualStack bool
+		ipv6      bool
+		want      []string
+	}{
+		{name: "ipv4", ipv6: false, want: []string{"10.0.0.0/24", "10.0.1.1-20", "db-01.dc.local"}},
+		{name: "ipv6", ipv6: true, want: []string{"fd00::/64", "fd00::1"}},
+		{name: "ipv6 dual-stack", dualStack: true, ipv6: true, want: []string{"fd00::/64", "fd00::1", "db-01.dc.local"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &NmapScanner{DualStack: tt.dualStack}
+			got := s.filterFamily(targets, tt.ipv6)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterExcludesHostnames(t *testing.T) {
+	s := &NmapScanner{}
+	targets := []string{"2001:db8::/64"}
+	excludes := []string{"10.0.0.1", "2001:db8::1", "db-01.dc.local"}
+
+	if got := s.filterFamily(targets, true); len(got) != 1 {
+		t.Fatalf("Expected the IPv6 prefix in the -6 run, got %v", got)
+	}
+	if got := filterExcludes(excludes, true); strings.Join(got, " ") != "2001:db8::1 db-01.dc.local" {
+		t.Errorf("Expected the hostname exclude in the -6 run without dual-stack, got %v", got)
+	}
+	if got := filterExcludes(excludes, false); strings.Join(got, " ") != "10.0.0.1 db-01.dc.local" {
+		t.Errorf("Expected the hostname exclude in the IPv4 run, got %v", got)
+	}
+}
+
+func TestBuildServiceTargetsIPv6(t *testing.T) {
+	hosts := []HostInfo{
+		{IP: "fd00::14", Ports: []PortInfo{{Port: 9182, State: "open"}}},
+		{IP: "10.0.0.14", Ports: []PortInfo{{Port: 9182, State: "open"}}},
+	}
+	spec := ScanSpec{Ports: []PortService{{Port: 9182, Name: "windows_exporter", Job: "windows_exporter"}}}
+
+	targets := buildServiceTargets(slog.Default(), hosts, spec, time.Now())
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+
+	if targets[0].Targets[0] != "[fd00::14]:9182" {
+		t.Errorf("Expected bracketed IPv6 target, got %s", targets[0].Targets[0])
+	}
+
+	if targets[1].Targets[0] != "10.0.0.14:9182" {
+		t.Errorf("Expected IPv4 target, got %s", targets[1].Targets[0])
+	}
+}
@@ -0,0 +1,198 @@
+package sd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ValidateTarget checks that a target is a CIDR range, an IP address, an nmap
+// IPv4 octet range (e.g. "10.0.0.1-50" or "10.0.1,3.*") or a hostname
+func ValidateTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("empty target")
+	}
+	if strings.HasPrefix(target, "-") || strings.ContainsAny(target, " \t\r\n") {
+		return fmt.Errorf("invalid target %q", target)
+	}
+
+	if strings.Contains(target, "/") {
+		if _, _, err := net.ParseCIDR(target); err != nil {
+			return fmt.Errorf("invalid CIDR %q: %w", target, err)
+		}
+		return nil
+	}
+
+	if net.ParseIP(target) != nil {
+		return nil
+	}
+
+	if isOctetRange(target) {
+		return nil
+	}
+
+	if isHostname(target) {
+		return nil
+	}
+
+	return fmt.Errorf("invalid target %q: not a CIDR, IP address, range or hostname", target)
+}
+
+// ValidateTargets validates every target and returns the first error found
+func ValidateTargets(targets []string) error {
+	for _, t := range targets {
+		if err := ValidateTarget(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOctetRange reports whether s is an nmap IPv4 octet range expression
+func isOctetRange(s string) bool {
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return false
+	}
+	for _, octet := range octets {
+		if octet == "*" {
+			continue
+		}
+		for _, part := range strings.Split(octet, ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			low, high := bounds[0], bounds[len(bounds)-1]
+			// Open ranges like "-100" or "10-" default to 0 and 255
+			if len(bounds) == 2 && low == "" {
+				low = "0"
+			}
+			if len(bounds) == 2 && high == "" {
+				high = "255"
+			}
+			l, err := strconv.ParseUint(low, 10, 8)
+			if err != nil {
+				return false
+			}
+			h, err := strconv.ParseUint(high, 10, 8)
+			if err != nil || h < l {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isHostname reports whether s is a valid RFC 1123 hostname
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	// A top-level label without letters is a malformed address or range, not a hostname
+	return strings.IndexFunc(labels[len(labels)-1], func(c rune) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}) >= 0
+}
+
+// matchesTargets reports whether the host is covered by one of the targets.
+// No targets match every host.
+func matchesTargets(host HostInfo, targets []string) bool {
+	return len(targets) == 0 || matchTarget(host, targets) != ""
+}
+
+// matchTarget returns the first target covering the host, or "" if none does.
+// Targets are matched as CIDR ranges, IP addresses, IPv4 octet ranges or hostnames.
+func matchTarget(host HostInfo, targets []string) string {
+	ip := net.ParseIP(host.IP)
+	for _, t := range targets {
+		if _, ipNet, err := net.ParseCIDR(t); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return t
+			}
+			continue
+		}
+		if t == host.IP || (host.Hostname != "" && strings.EqualFold(t, host.Hostname)) {
+			return t
+		}
+		if ip != nil && octetRangeContains(t, ip) {
+			return t
+		}
+	}
+	return ""
+}
+
+// octetRangeContains reports whether the IPv4 address is within the nmap octet range expression
+func octetRangeContains(expr string, ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil || !isOctetRange(expr) {
+		return false
+	}
+	for i, octet := range strings.Split(expr, ".") {
+		if octet == "*" {
+			continue
+		}
+		matched := false
+		for _, part := range strings.Split(octet, ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			low, high := 0, 255
+			if bounds[0] != "" {
+				low, _ = strconv.Atoi(bounds[0])
+			}
+			if len(bounds) == 1 {
+				high = low
+			} else if bounds[1] != "" {
+				high, _ = strconv.Atoi(bounds[1])
+			}
+			if int(ip4[i]) >= low && int(ip4[i]) <= high {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// addressFamily is the IP family a target resolves to
+type addressFamily int
+
+const (
+	familyUnknown addressFamily = iota
+	familyIPv4
+	familyIPv6
+)
+
+// targetFamily returns the family of an IP, CIDR or octet range target.
+// Hostnames have an unknown family.
+func targetFamily(target string) addressFamily {
+	host := target
+	if i := strings.IndexByte(target, '/'); i >= 0 {
+		host = target[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return familyIPv4
+		}
+		return familyIPv6
+	}
+	if isOctetRange(target) {
+		return familyIPv4
+	}
+	return familyUnknown
+}
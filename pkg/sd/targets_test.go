@@ -0,0 +1,72 @@
+package sd
+
+import (
+	"testing"
+)
+
+func TestValidateTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "192.168.2.0/22"},
+		{target: "10.0.0.1"},
+		{target: "fd00::/64"},
+		{target: "fd00::1"},
+		{target: "10.0.0.1-50"},
+		{target: "10.0.1,3.*"},
+		{target: "10.0.0.-100"},
+		{target: "printer-2f.corp.local"},
+		{target: "localhost"},
+		{target: "", wantErr: true},
+		{target: "10.0.0.0/33", wantErr: true},
+		{target: "10.0.0.256", wantErr: true},
+		{target: "10.0.0.50-1", wantErr: true},
+		{target: "-oN /tmp/out", wantErr: true},
+		{target: "--script=vuln", wantErr: true},
+		{target: "bad_host.local", wantErr: true},
+		{target: "host .local", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := ValidateTarget(tt.target)
+		if tt.wantErr && err == nil {
+			t.Errorf("Expected error for target %q", tt.target)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("Expected target %q to be valid, got %v", tt.target, err)
+		}
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	if err := ValidateTargets([]string{"10.0.0.0/24", "db-01.dc.local"}); err != nil {
+		t.Errorf("Expected targets to be valid, got %v", err)
+	}
+
+	if err := ValidateTargets([]string{"10.0.0.0/24", "10.0.0.0/40"}); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+}
+
+func TestMatchTarget(t *testing.T) {
+	targets := []string{"10.0.3.0/24", "192.168.2.1-50", "db-01.dc.local", "172.16.0.9"}
+
+	tests := []struct {
+		host HostInfo
+		want string
+	}{
+		{host: HostInfo{IP: "10.0.3.14"}, want: "10.0.3.0/24"},
+		{host: HostInfo{IP: "192.168.2.20"}, want: "192.168.2.1-50"},
+		{host: HostInfo{IP: "192.168.2.51"}, want: ""},
+		{host: HostInfo{IP: "10.9.9.9", Hostname: "DB-01.dc.local"}, want: "db-01.dc.local"},
+		{host: HostInfo{IP: "172.16.0.9"}, want: "172.16.0.9"},
+		{host: HostInfo{IP: "fd00::1"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := matchTarget(tt.host, targets); got != tt.want {
+			t.Errorf("matchTarget(%s) = %q, want %q", tt.host.IP, got, tt.want)
+		}
+	}
+}
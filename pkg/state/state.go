@@ -0,0 +1,90 @@
+// Package state persists the last scan results so they can be served right after a restart.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// Version is the snapshot format version written by Save
+const Version = 1
+
+// Snapshot is the persisted state of all scanned profiles
+type Snapshot struct {
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`
+	Profiles []Profile `json:"profiles"`
+}
+
+// Profile is the result of the last successful scan of a profile, together with
+// the targets, exclusions and ports it was scanned with
+type Profile struct {
+	Name     string             `json:"name"`
+	Targets  []string           `json:"targets"`
+	Excludes []string           `json:"excludes,omitempty"`
+	Ports    []sd.PortService   `json:"ports"`
+	ScanTime time.Time          `json:"scan_time"`
+	Data     []sd.ServiceTarget `json:"data"`
+	Hosts    []sd.HostInfo      `json:"hosts"`
+}
+
+// Load reads a snapshot written by Save, logging to log.
+// If the file does not exist, the returned error satisfies errors.Is(err, fs.ErrNotExist).
+func Load(path string, log *slog.Logger) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	if s.Version != Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d in %s", s.Version, path)
+	}
+	log.Debug("Load: Snapshot loaded", "path", path, "time", s.Time, "profiles", len(s.Profiles))
+	return &s, nil
+}
+
+// Save atomically replaces path with the snapshot, creating its directory if needed, logging to log
+func Save(path string, s *Snapshot, log *slog.Logger) error {
+	s.Version = Version
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	// Write to a temporary file and rename it so a crash never leaves a truncated snapshot
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), path, err)
+	}
+	log.Debug("Save: Snapshot written", "path", path, "profiles", len(s.Profiles))
+	return nil
+}
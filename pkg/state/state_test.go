@@ -0,0 +1,64 @@
+package state
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "nmap_sd.json")
+	want := &Snapshot{
+		Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Profiles: []Profile{{
+			Name:     "office",
+			Targets:  []string{"10.0.0.0/24"},
+			Ports:    []sd.PortService{{Port: 80, Name: "http", Job: "http_services"}},
+			ScanTime: time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC),
+			Data:     []sd.ServiceTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "http_services"}}},
+			Hosts:    []sd.HostInfo{{IP: "10.0.0.1", Ports: []sd.PortInfo{{Port: 80, State: "open"}}}},
+		}},
+	}
+	if err := Save(path, want, slog.Default()); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	got, err := Load(path, slog.Default())
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got.Version != Version || !reflect.DeepEqual(got, want) {
+		t.Errorf("Loaded snapshot differs:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %d entries", len(entries))
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.json"), slog.Default()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for a missing file, got %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"corrupt.json": `{"version": 1, "profiles": [`,
+		"future.json":  `{"version": 99, "profiles": []}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path, slog.Default()); err == nil || errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected a decode error, got %v", name, err)
+		}
+	}
+}
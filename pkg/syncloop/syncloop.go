@@ -0,0 +1,71 @@
+// Package syncloop runs the background loop shared by the outputs mirroring the scan
+// results into external systems: the latest value is synced, superseded values are
+// skipped and failed syncs are retried with the value current at that time.
+package syncloop
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Loop syncs the latest value handed to Update from Run
+type Loop[T any] struct {
+	name          string
+	sync          func(context.Context, T) error
+	retryInterval time.Duration
+	log           *slog.Logger
+	mu            sync.Mutex
+	pending       T
+	notify        chan struct{}
+}
+
+// New creates a Loop calling sync with the latest value. Failed syncs are logged to log
+// along with the name of the loop and retried after retryInterval.
+func New[T any](name string, sync func(context.Context, T) error, retryInterval time.Duration, log *slog.Logger) *Loop[T] {
+	return &Loop[T]{
+		name:          name,
+		sync:          sync,
+		retryInterval: retryInterval,
+		log:           log,
+		notify:        make(chan struct{}, 1),
+	}
+}
+
+// Update hands the latest value to Run. A value not synced yet is replaced.
+func (l *Loop[T]) Update(v T) {
+	l.mu.Lock()
+	l.pending = v
+	l.mu.Unlock()
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs the value of every Update until ctx is done, retrying failed syncs
+func (l *Loop[T]) Run(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			l.log.Debug("Loop.Run: Stopped", "sync", l.name)
+			return
+		case <-l.notify:
+		case <-retry:
+		}
+		retry = nil
+
+		l.mu.Lock()
+		v := l.pending
+		l.mu.Unlock()
+		if err := l.sync(ctx, v); err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			l.log.Error("Failed to sync, retrying", "sync", l.name, "retry_in", l.retryInterval, "error", err)
+			retry = time.After(l.retryInterval)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package syncloop
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder records the synced values and fails the syncs while failing is set.
+// With started and release set, every sync reports its start and waits to be released.
+type recorder struct {
+	mu      sync.Mutex
+	synced  []int
+	failing bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *recorder) sync(ctx context.Context, v int) error {
+	if r.started != nil {
+		r.started <- struct{}{}
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.synced = append(r.synced, v)
+	if r.failing {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (r *recorder) values() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.synced...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoopSyncsLatestValue(t *testing.T) {
+	r := &recorder{started: make(chan struct{}), release: make(chan struct{})}
+	l := New("test", r.sync, time.Hour, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	// Values handed over while a sync is running are coalesced into the latest one
+	l.Update(1)
+	<-r.started
+	l.Update(2)
+	l.Update(3)
+	r.release <- struct{}{}
+	<-r.started
+	r.release <- struct{}{}
+	waitFor(t, "the latest value", func() bool { return len(r.values()) == 2 })
+	if v := r.values(); v[0] != 1 || v[1] != 3 {
+		t.Errorf("Expected the first and the latest value to be synced, got %v", v)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once ctx is done")
+	}
+}
+
+func TestLoopRetries(t *testing.T) {
+	r := &recorder{failing: true}
+	l := New("test", r.sync, 10*time.Millisecond, slog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+
+	l.Update(1)
+	waitFor(t, "a retry", func() bool { return len(r.values()) >= 2 })
+	r.mu.Lock()
+	r.failing = false
+	r.mu.Unlock()
+	l.Update(2)
+	waitFor(t, "the new value", func() bool {
+		v := r.values()
+		return v[len(v)-1] == 2
+	})
+	synced := len(r.values())
+	time.Sleep(50 * time.Millisecond)
+	if len(r.values()) != synced {
+		t.Error("Expected no retries after a successful sync")
+	}
+}
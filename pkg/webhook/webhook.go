@@ -0,0 +1,257 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+const (
+	// SignatureHeader carries the hex HMAC-SHA256 of the body as "sha256=<hex>" when a secret is set
+	SignatureHeader = "X-Nmap-SD-Signature"
+	// DeliveryHeader carries an ID that stays the same across retries of a delivery
+	DeliveryHeader = "X-Nmap-SD-Delivery"
+
+	// EventTargetsChanged is the event name of diff payloads
+	EventTargetsChanged = "targets_changed"
+
+	// DefaultMaxRetries is the number of retries after a failed delivery
+	DefaultMaxRetries = 3
+	// DefaultInitialBackoff is the delay before the first retry, doubled for every further retry
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff caps the delay between retries
+	DefaultMaxBackoff = time.Minute
+	// DefaultTimeout bounds a single delivery attempt
+	DefaultTimeout = 10 * time.Second
+
+	// queueSize is the number of diffs waiting for delivery before new ones are dropped
+	queueSize = 64
+)
+
+// Config of an outgoing webhook
+type Config struct {
+	// URL receiving a POST request with the JSON payload
+	URL string
+	// Optional secret used to sign the body with HMAC-SHA256
+	Secret string
+	// Retries after a failed delivery (default: DefaultMaxRetries, negative disables retries)
+	MaxRetries int
+	// Delay before the first retry, doubled for every further retry (default: DefaultInitialBackoff)
+	InitialBackoff time.Duration
+	// Maximum delay between retries (default: DefaultMaxBackoff)
+	MaxBackoff time.Duration
+	// Timeout of a single delivery attempt (default: DefaultTimeout)
+	Timeout time.Duration
+	// Additional request headers, e.g. for authentication
+	Headers map[string]string
+	// Logger of the notifier (default: slog.Default())
+	Logger *slog.Logger
+}
+
+// Target is a target added or removed between two scans
+type Target struct {
+	Target string            `json:"target"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Payload is the JSON body sent to the webhook
+type Payload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Profile whose scan produced the change, empty if the change was caused by a reload
+	Profile string   `json:"profile,omitempty"`
+	Added   []Target `json:"added"`
+	Removed []Target `json:"removed"`
+	// All host, port and target changes of the scan
+	Changes []sd.Change `json:"changes"`
+}
+
+// NewPayload builds the webhook payload of a scan diff
+func NewPayload(diff sd.ScanDiff) Payload {
+	p := Payload{
+		Event:   EventTargetsChanged,
+		Time:    diff.Time,
+		Profile: diff.Profile,
+		Added:   []Target{},
+		Removed: []Target{},
+		Changes: diff.Changes,
+	}
+	for _, c := range diff.Changes {
+		switch c.Type {
+		case sd.TargetAdded:
+			p.Added = append(p.Added, Target{Target: c.Target, Labels: c.Labels})
+		case sd.TargetRemoved:
+			p.Removed = append(p.Removed, Target{Target: c.Target, Labels: c.Labels})
+		}
+	}
+	return p
+}
+
+// Notifier delivers scan diffs to a webhook from a background queue
+type Notifier struct {
+	cfg    Config
+	client *http.Client
+	queue  chan sd.ScanDiff
+	log    *slog.Logger
+	// host of the URL used in logs, chat webhook URLs often carry a token in the path
+	host string
+}
+
+// New validates the configuration and creates a Notifier. Run must be started to deliver diffs.
+func New(cfg Config) (*Notifier, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", cfg.URL)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = DefaultInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	cfg.Logger.Debug("webhook.New: Created webhook notifier", "host", u.Host, "max_retries", cfg.MaxRetries, "signed", cfg.Secret != "")
+	return &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan sd.ScanDiff, queueSize),
+		log:    cfg.Logger,
+		host:   u.Host,
+	}, nil
+}
+
+// Enqueue queues a diff for delivery and reports whether it was queued.
+// Diffs are dropped when the queue is full.
+func (n *Notifier) Enqueue(diff sd.ScanDiff) bool {
+	select {
+	case n.queue <- diff:
+		return true
+	default:
+		n.log.Error("Webhook queue full, dropping diff", "host", n.host, "changes", len(diff.Changes))
+		return false
+	}
+}
+
+// Run delivers queued diffs in order until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			n.log.Debug("Notifier.Run: Stopped", "host", n.host, "pending", len(n.queue))
+			return
+		case diff := <-n.queue:
+			if err := n.Send(ctx, diff); err != nil {
+				n.log.Error("Failed to deliver webhook", "host", n.host, "error", err)
+			}
+		}
+	}
+}
+
+// Send delivers a diff, retrying with exponential backoff on network errors,
+// 429 and 5xx responses
+func (n *Notifier) Send(ctx context.Context, diff sd.ScanDiff) error {
+	body, err := json.Marshal(NewPayload(diff))
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+	delivery, err := deliveryID()
+	if err != nil {
+		return err
+	}
+
+	backoff := n.cfg.InitialBackoff
+	retries := max(n.cfg.MaxRetries, 0)
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(ctx, body, delivery)
+		if err == nil {
+			n.log.Debug("Send: Webhook delivered", "host", n.host, "delivery", delivery, "attempt", attempt+1)
+			return nil
+		}
+		if !retry || attempt >= retries {
+			return fmt.Errorf("delivery %s failed after %d attempts: %w", delivery, attempt+1, err)
+		}
+
+		n.log.Debug("Send: Webhook delivery failed, retrying", "host", n.host, "delivery", delivery, "attempt", attempt+1, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("delivery %s cancelled: %w", delivery, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, n.cfg.MaxBackoff)
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failure should be retried
+func (n *Notifier) post(ctx context.Context, body []byte, delivery string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nmap_sd-webhook")
+	req.Header.Set(DeliveryHeader, delivery)
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if n.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.cfg.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// Drop the URL from the error so it is not logged
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// Sign returns the signature header value of a body: "sha256=" followed by the hex HMAC-SHA256
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid signature of body, for use by receivers
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// deliveryID returns a random delivery ID
+func deliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate delivery ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
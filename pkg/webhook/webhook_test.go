@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hoverhuang-er/nmap_sd/pkg/sd"
+)
+
+// receiver is an httptest webhook receiver answering with the queued status codes
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	requests   []*http.Request
+	bodies     [][]byte
+	deliveries chan Payload
+}
+
+func newReceiver(statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{statuses: statuses, deliveries: make(chan Payload, 10)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+
+		if status == http.StatusOK {
+			var p Payload
+			json.Unmarshal(body, &p)
+			r.deliveries <- p
+		}
+		w.WriteHeader(status)
+	}))
+	return r, srv
+}
+
+func testDiff() sd.ScanDiff {
+	return sd.ScanDiff{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Profile: "office",
+		Changes: []sd.Change{
+			{Type: sd.HostAdded, IP: "10.0.0.2"},
+			{Type: sd.TargetAdded, Target: "10.0.0.2:9182", Labels: map[string]string{"job": "windows_exporter"}},
+			{Type: sd.TargetRemoved, Target: "10.0.0.1:80", Labels: map[string]string{"job": "http_services"}},
+		},
+	}
+}
+
+func TestSendRetriesAndSigns(t *testing.T) {
+	recv, srv := newReceiver(http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+	defer srv.Close()
+
+	n, err := New(Config{URL: srv.URL, Secret: "s3cret", InitialBackoff: time.Millisecond, Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := n.Send(context.Background(), testDiff()); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if len(recv.requests) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(recv.requests))
+	}
+	delivery := recv.requests[0].Header.Get(DeliveryHeader)
+	for i, req := range recv.requests {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Attempt %d: unexpected request %s %s", i, req.Method, req.Header.Get("Content-Type"))
+		}
+		if req.Header.Get(DeliveryHeader) != delivery {
+			t.Errorf("Attempt %d: expected delivery ID to stay %q, got %q", i, delivery, req.Header.Get(DeliveryHeader))
+		}
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Attempt %d: expected custom header", i)
+		}
+		if !Verify("s3cret", recv.bodies[i], req.Header.Get(SignatureHeader)) {
+			t.Errorf("Attempt %d: invalid signature %q", i, req.Header.Get(SignatureHeader))
+		}
+	}
+
+	p := <-recv.deliveries
+	if p.Event != EventTargetsChanged || p.Profile != "office" || len(p.Changes) != 3 {
+		t.Errorf("Unexpected payload: %+v", p)
+	}
+	if len(p.Added) != 1 || p.Added[0].Target != "10.0.0.2:9182" || p.Added[0].Labels["job"] != "windows_exporter" {
+		t.Errorf("Unexpected added targets: %+v", p.Added)
+	}
+	if len(p.Removed) != 1 || p.Removed[0].Target != "10.0.0.1:80" {
+		t.Errorf("Unexpected removed targets: %+v", p.Removed)
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		attempts int
+	}{
+		{name: "client error is not retried", statuses: []int{http.StatusBadRequest}, retries: 3, attempts: 1},
+		{name: "retries exhausted", statuses: []int{500, 502, 503}, retries: 2, attempts: 3},
+		{name: "retries disabled", statuses: []int{500}, retries: -1, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv, srv := newReceiver(tt.statuses...)
+			defer srv.Close()
+
+			n, err := New(Config{URL: srv.URL, MaxRetries: tt.retries, InitialBackoff: time.Millisecond})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			if err := n.Send(context.Background(), testDiff()); err == nil {
+				t.Error("Expected Send to fail")
+			}
+			if len(recv.requests) != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, len(recv.requests))
+			}
+			if recv.requests[0].Header.Get(SignatureHeader) != "" {
+				t.Error("Expected no signature without a secret")
+			}
+		})
+	}
+}
+
+func TestRunDeliversQueuedDiffs(t *testing.T) {
+	recv, srv := newReceiver()
+	defer srv.Close()
+
+	n, err := New(Config{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	first, second := testDiff(), testDiff()
+	second.Profile = "datacenter"
+	n.Enqueue(first)
+	n.Enqueue(second)
+
+	for _, want := range []string{"office", "datacenter"} {
+		select {
+		case p := <-recv.deliveries:
+			if p.Profile != want {
+				t.Errorf("Expected delivery of profile %q, got %q", want, p.Profile)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for webhook delivery")
+		}
+	}
+}
+
+func TestNewRejectsInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "ftp://example.com/hook", "http://", "://bad"} {
+		if _, err := New(Config{URL: u}); err == nil {
+			t.Errorf("Expected %q to be rejected", u)
+		}
+	}
+}